@@ -20,11 +20,15 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -39,9 +43,27 @@ type Auth struct {
 	// If empty, the stanard US region of "s3.amazonaws.com" is
 	// used.
 	Hostname string
+
+	// Region is the region requests are signed for with Signature
+	// Version 4. If empty, "us-east-1" is used.
+	Region string
+
+	// SignatureVersion is 2 for the legacy signing scheme or 4 for
+	// AWS Signature Version 4. If zero, 2 is used.
+	SignatureVersion int
 }
 
-const standardUSRegionAWS = "s3.amazonaws.com"
+const (
+	standardUSRegionAWS = "s3.amazonaws.com"
+	defaultRegion       = "us-east-1"
+)
+
+func (a *Auth) region() string {
+	if a.Region != "" {
+		return a.Region
+	}
+	return defaultRegion
+}
 
 func (a *Auth) hostname() string {
 	if a.Hostname != "" {
@@ -50,7 +72,14 @@ func (a *Auth) hostname() string {
 	return standardUSRegionAWS
 }
 
+// SignRequest signs req with the scheme selected by SignatureVersion.
+// With Signature Version 4 the payload isn't signed, so the body can
+// be streamed; set Content-MD5 to protect it.
 func (a *Auth) SignRequest(req *http.Request) {
+	if a.SignatureVersion == 4 {
+		a.signRequestV4(req)
+		return
+	}
 	if date := req.Header.Get("Date"); date == "" {
 		req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
 	}
@@ -180,3 +209,201 @@ func (a *Auth) bucketFromHostname(req *http.Request) string {
 	}
 	return host
 }
+
+// See http://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+
+const (
+	v4Algorithm     = "AWS4-HMAC-SHA256"
+	v4DateFormat    = "20060102T150405Z"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+func (a *Auth) signRequestV4(req *http.Request) {
+	date := req.Header.Get("X-Amz-Date")
+	if date == "" {
+		date = time.Now().UTC().Format(v4DateFormat)
+		req.Header.Set("X-Amz-Date", date)
+	}
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	}
+
+	scope := strings.Join([]string{date[:8], a.region(), "s3", "aws4_request"}, "/")
+	canonical, signedHeaders := a.canonicalRequestV4(req)
+	sum := sha256.Sum256([]byte(canonical))
+	stringToSign := strings.Join([]string{v4Algorithm, date, scope, hex.EncodeToString(sum[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+a.SecretAccessKey), date[:8])
+	key = hmacSHA256(key, a.region())
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		v4Algorithm, a.AccessKey, scope, signedHeaders, signature))
+}
+
+// maxPresignV4 is the longest a Signature Version 4 presigned URL may
+// be valid for.
+const maxPresignV4 = 7 * 24 * time.Hour
+
+// PresignRequest authorizes req until expires with query parameters
+// instead of the Authorization header, so its URL can be handed to
+// clients. Only the host header is signed.
+func (a *Auth) PresignRequest(req *http.Request, expires time.Time) {
+	q := req.URL.Query()
+
+	if a.SignatureVersion != 4 {
+		q.Set("AWSAccessKeyId", a.AccessKey)
+		q.Set("Expires", strconv.FormatInt(expires.Unix(), 10))
+		q.Del("Signature")
+
+		buf := new(bytes.Buffer)
+		fmt.Fprintf(buf, "%s\n\n\n%d\n", req.Method, expires.Unix())
+		a.writeCanonicalizedResource(buf, req)
+		q.Set("Signature", base64.StdEncoding.EncodeToString(hmacSHA1([]byte(a.SecretAccessKey), buf.String())))
+		req.URL.RawQuery = q.Encode()
+		return
+	}
+
+	date := q.Get("X-Amz-Date")
+	signedAt, err := time.Parse(v4DateFormat, date)
+	if err != nil {
+		signedAt = time.Now().UTC()
+		date = signedAt.Format(v4DateFormat)
+	}
+
+	ttl := expires.Sub(signedAt)
+	if ttl > maxPresignV4 {
+		ttl = maxPresignV4
+	}
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+
+	scope := strings.Join([]string{date[:8], a.region(), "s3", "aws4_request"}, "/")
+	q.Set("X-Amz-Algorithm", v4Algorithm)
+	q.Set("X-Amz-Credential", a.AccessKey+"/"+scope)
+	q.Set("X-Amz-Date", date)
+	q.Set("X-Amz-Expires", strconv.Itoa(int(ttl/time.Second)))
+	q.Set("X-Amz-SignedHeaders", "host")
+	q.Del("X-Amz-Signature")
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+
+	canonical := strings.Join([]string{
+		req.Method,
+		uriEncode(path, false),
+		canonicalQueryV4(q),
+		"host:" + host,
+		"",
+		"host",
+		unsignedPayload,
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	stringToSign := strings.Join([]string{v4Algorithm, date, scope, hex.EncodeToString(sum[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+a.SecretAccessKey), date[:8])
+	key = hmacSHA256(key, a.region())
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	q.Set("X-Amz-Signature", hex.EncodeToString(hmacSHA256(key, stringToSign)))
+	req.URL.RawQuery = canonicalQueryV4(q)
+}
+
+func hmacSHA1(key []byte, data string) []byte {
+	hm := hmac.New(sha1.New, key)
+	io.WriteString(hm, data)
+	return hm.Sum(nil)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	hm := hmac.New(sha256.New, key)
+	io.WriteString(hm, data)
+	return hm.Sum(nil)
+}
+
+// signedHeaderV4 reports whether the lower-cased header k is signed.
+func signedHeaderV4(k string) bool {
+	return k == "content-md5" || k == "content-type" || strings.HasPrefix(k, "x-amz-")
+}
+
+// canonicalRequestV4 returns the canonical form of req and the list of
+// headers signed. The canonical request is the method, URI, query
+// string, headers, signed header names and payload hash, separated by
+// newlines.
+func (a *Auth) canonicalRequestV4(req *http.Request) (canonical, signedHeaders string) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	names := []string{"host"}
+	vals := map[string]string{"host": host}
+	for k, vv := range req.Header {
+		lk := strings.ToLower(k)
+		if signedHeaderV4(lk) {
+			names = append(names, lk)
+			vals[lk] = strings.TrimSpace(strings.Join(vv, ","))
+		}
+	}
+	sort.Strings(names)
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(req.Method)
+	buf.WriteByte('\n')
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	buf.WriteString(uriEncode(path, false))
+	buf.WriteByte('\n')
+	buf.WriteString(canonicalQueryV4(req.URL.Query()))
+	buf.WriteByte('\n')
+	for _, k := range names {
+		buf.WriteString(k)
+		buf.WriteByte(':')
+		buf.WriteString(vals[k])
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	signedHeaders = strings.Join(names, ";")
+	buf.WriteString(signedHeaders)
+	buf.WriteByte('\n')
+	buf.WriteString(req.Header.Get("X-Amz-Content-Sha256"))
+	return buf.String(), signedHeaders
+}
+
+func canonicalQueryV4(q url.Values) string {
+	var params []string
+	for k, vv := range q {
+		for _, v := range vv {
+			params = append(params, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// uriEncode escapes every byte of s except the RFC 3986 unreserved
+// characters, and '/' unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	buf := new(bytes.Buffer)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !encodeSlash {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
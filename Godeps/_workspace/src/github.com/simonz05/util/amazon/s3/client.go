@@ -19,6 +19,7 @@ package s3
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/xml"
 	"errors"
@@ -33,6 +34,7 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/simonz05/util/httputil"
@@ -45,6 +47,27 @@ type Client struct {
 	*Auth
 	HTTPClient *http.Client // or nil for default client
 	DefaultACL string
+
+	// Scheme is the URL scheme used to reach S3, "http" or "https".
+	// If empty, "http" is used.
+	Scheme string
+
+	// PathStyle addresses buckets in the URL path,
+	// http://hostname/bucket/key, instead of by subdomain, as
+	// required by some S3 compatible services.
+	PathStyle bool
+}
+
+// Error is returned when S3 answers a request with an unexpected
+// HTTP status code.
+type Error struct {
+	Op         string // HTTP method
+	Key        string
+	StatusCode int
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("Amazon HTTP error on %s: %d - %s", e.Op, e.StatusCode, e.Key)
 }
 
 type Bucket struct {
@@ -59,6 +82,22 @@ func (c *Client) httpClient() *http.Client {
 	return http.DefaultClient
 }
 
+func (c *Client) scheme() string {
+	if c.Scheme != "" {
+		return c.Scheme
+	}
+	return "http"
+}
+
+// keyURL returns the URL of key in bucket. An empty key is the URL of
+// the bucket.
+func (c *Client) keyURL(bucket, key string) string {
+	if c.PathStyle {
+		return fmt.Sprintf("%s://%s/%s/%s", c.scheme(), c.hostname(), bucket, key)
+	}
+	return fmt.Sprintf("%s://%s.%s/%s", c.scheme(), bucket, c.hostname(), key)
+}
+
 func newReq(url_ string) *http.Request {
 	req, err := http.NewRequest("GET", url_, nil)
 	if err != nil {
@@ -69,7 +108,7 @@ func newReq(url_ string) *http.Request {
 }
 
 func (c *Client) Buckets() ([]*Bucket, error) {
-	req := newReq("https://" + c.hostname() + "/")
+	req := newReq(c.scheme() + "://" + c.hostname() + "/")
 	c.Auth.SignRequest(req)
 	res, err := c.httpClient().Do(req)
 	if err != nil {
@@ -97,27 +136,126 @@ func parseListAllMyBuckets(r io.Reader) ([]*Bucket, error) {
 
 // Returns 0, os.ErrNotExist if not on S3, otherwise reterr is real.
 func (c *Client) Stat(name, bucket string) (size int64, reterr error) {
-	req := newReq("http://" + bucket + "." + c.hostname() + "/" + name)
+	oi, err := c.Head(name, bucket)
+	if err != nil {
+		return 0, err
+	}
+	return oi.Size, nil
+}
+
+// ObjectInfo is the metadata of an object as returned by Head.
+type ObjectInfo struct {
+	Size         int64
+	ETag         string // without the surrounding quotes
+	LastModified time.Time
+	ContentType  string
+	PutOptions
+}
+
+// PutOptions are optional settings for how an object is stored.
+type PutOptions struct {
+	CacheControl         string
+	ContentDisposition   string
+	StorageClass         string // e.g. STANDARD_IA. Default STANDARD
+	ServerSideEncryption string // AES256 for SSE-S3 or aws:kms for SSE-KMS
+	SSEKMSKeyID          string // KMS key for aws:kms. Default the account's S3 key
+}
+
+func (o *PutOptions) setHeaders(h http.Header) {
+	set := func(k, v string) {
+		if v != "" {
+			h.Set(k, v)
+		}
+	}
+	set("Cache-Control", o.CacheControl)
+	set("Content-Disposition", o.ContentDisposition)
+	set("x-amz-storage-class", o.StorageClass)
+	set("x-amz-server-side-encryption", o.ServerSideEncryption)
+	set("x-amz-server-side-encryption-aws-kms-key-id", o.SSEKMSKeyID)
+}
+
+func readPutOptions(h http.Header) PutOptions {
+	return PutOptions{
+		CacheControl:         h.Get("Cache-Control"),
+		ContentDisposition:   h.Get("Content-Disposition"),
+		StorageClass:         h.Get("x-amz-storage-class"),
+		ServerSideEncryption: h.Get("x-amz-server-side-encryption"),
+		SSEKMSKeyID:          h.Get("x-amz-server-side-encryption-aws-kms-key-id"),
+	}
+}
+
+// Head returns the metadata of an object.
+// Returns nil, os.ErrNotExist if not on S3, otherwise reterr is real.
+func (c *Client) Head(name, bucket string) (oi *ObjectInfo, reterr error) {
+	return c.HeadContext(context.Background(), name, bucket)
+}
+
+// HeadContext is like Head but the request is cancelled when ctx is done.
+func (c *Client) HeadContext(ctx context.Context, name, bucket string) (oi *ObjectInfo, reterr error) {
+	req := newReq(c.keyURL(bucket, name)).WithContext(ctx)
 	req.Method = "HEAD"
 	c.Auth.SignRequest(req)
 	res, err := c.httpClient().Do(req)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	if res.Body != nil {
 		defer res.Body.Close()
 	}
 	switch res.StatusCode {
 	case http.StatusNotFound:
-		return 0, os.ErrNotExist
+		return nil, os.ErrNotExist
 	case http.StatusOK:
-		return strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+		oi = &ObjectInfo{
+			ETag:        strings.Trim(res.Header.Get("ETag"), `"`),
+			ContentType: res.Header.Get("Content-Type"),
+			PutOptions:  readPutOptions(res.Header),
+		}
+		if oi.Size, err = strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64); err != nil {
+			return nil, err
+		}
+		if lm := res.Header.Get("Last-Modified"); lm != "" {
+			if oi.LastModified, err = http.ParseTime(lm); err != nil {
+				return nil, err
+			}
+		}
+		return oi, nil
+	}
+	return nil, &Error{Op: "HEAD", Key: name, StatusCode: res.StatusCode}
+}
+
+// HeadBucket checks that bucket exists and may be accessed.
+func (c *Client) HeadBucket(ctx context.Context, bucket string) error {
+	req := newReq(c.keyURL(bucket, "")).WithContext(ctx)
+	req.Method = "HEAD"
+	c.Auth.SignRequest(req)
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	if res.Body != nil {
+		res.Body.Close()
+	}
+	if res.StatusCode != http.StatusOK {
+		return &Error{Op: "HEAD", Key: bucket, StatusCode: res.StatusCode}
 	}
-	return 0, fmt.Errorf("s3: Unexpected status code %d statting object %v", res.StatusCode, name)
+	return nil
 }
 
 func (c *Client) PutObject(name, bucket string, md5 hash.Hash, size int64, body io.Reader) error {
-	req := newReq("http://" + bucket + "." + c.hostname() + "/" + name)
+	return c.PutObjectContext(context.Background(), name, bucket, md5, size, body)
+}
+
+// PutObjectContext is like PutObject but the request is cancelled when
+// ctx is done.
+func (c *Client) PutObjectContext(ctx context.Context, name, bucket string, md5 hash.Hash, size int64, body io.Reader) error {
+	return c.PutObjectOptions(ctx, name, bucket, md5, size, body, nil)
+}
+
+// PutObjectOptions is like PutObjectContext but stores the object with
+// opts, which may be nil.
+func (c *Client) PutObjectOptions(ctx context.Context, name, bucket string, md5 hash.Hash, size int64, body io.Reader, opts *PutOptions) error {
+	req := newReq(c.keyURL(bucket, name)).WithContext(ctx)
 	req.Method = "PUT"
 	req.ContentLength = size
 	if md5 != nil {
@@ -135,6 +273,9 @@ func (c *Client) PutObject(name, bucket string, md5 hash.Hash, size int64, body
 		contentType = "application/octet-stream"
 	}
 	req.Header.Set("Content-Type", contentType)
+	if opts != nil {
+		opts.setHeaders(req.Header)
+	}
 	c.Auth.SignRequest(req)
 	req.Body = ioutil.NopCloser(body)
 
@@ -147,7 +288,7 @@ func (c *Client) PutObject(name, bucket string, md5 hash.Hash, size int64, body
 	}
 	if res.StatusCode != http.StatusOK {
 		res.Write(os.Stderr)
-		return fmt.Errorf("Got response code %d from s3", res.StatusCode)
+		return &Error{Op: "PUT", Key: name, StatusCode: res.StatusCode}
 	}
 	return nil
 }
@@ -182,8 +323,8 @@ func (c *Client) ListBucket(bucket string, startAt string, maxKeys int) (items [
 		}
 		var bres listBucketResults
 
-		url_ := fmt.Sprintf("http://%s.%s/?marker=%s&max-keys=%d",
-			bucket, c.hostname(), url.QueryEscape(marker), fetchN)
+		url_ := fmt.Sprintf("%s?marker=%s&max-keys=%d",
+			c.keyURL(bucket, ""), url.QueryEscape(marker), fetchN)
 
 		// Try the enumerate three times, since Amazon likes to close
 		// https connections a lot, and Go sucks at dealing with it:
@@ -242,8 +383,14 @@ func (c *Client) ListBucket(bucket string, startAt string, maxKeys int) (items [
 }
 
 func (c *Client) Get(bucket, key string) (body io.ReadCloser, size int64, err error) {
-	url_ := fmt.Sprintf("http://%s.%s/%s", bucket, c.hostname(), key)
-	req := newReq(url_)
+	return c.GetContext(context.Background(), bucket, key)
+}
+
+// GetContext is like Get but the request, including reading the body,
+// is cancelled when ctx is done.
+func (c *Client) GetContext(ctx context.Context, bucket, key string) (body io.ReadCloser, size int64, err error) {
+	url_ := c.keyURL(bucket, key)
+	req := newReq(url_).WithContext(ctx)
 	c.Auth.SignRequest(req)
 	var res *http.Response
 	res, err = c.httpClient().Do(req)
@@ -260,15 +407,29 @@ func (c *Client) Get(bucket, key string) (body io.ReadCloser, size int64, err er
 		return
 	}
 	if res.StatusCode != http.StatusOK {
-		err = fmt.Errorf("Amazon HTTP error on GET: %d - %s", res.StatusCode, key)
+		err = &Error{Op: "GET", Key: key, StatusCode: res.StatusCode}
 		return
 	}
 	return res.Body, res.ContentLength, nil
 }
 
+// PresignedGetURL returns a URL which gets key in bucket without
+// credentials until expires.
+func (c *Client) PresignedGetURL(bucket, key string, expires time.Time) string {
+	req := newReq(c.keyURL(bucket, key))
+	c.Auth.PresignRequest(req, expires)
+	return req.URL.String()
+}
+
 func (c *Client) Delete(bucket, key string) error {
-	url_ := fmt.Sprintf("http://%s.%s/%s", bucket, c.hostname(), key)
-	req := newReq(url_)
+	return c.DeleteContext(context.Background(), bucket, key)
+}
+
+// DeleteContext is like Delete but the request is cancelled when ctx
+// is done.
+func (c *Client) DeleteContext(ctx context.Context, bucket, key string) error {
+	url_ := c.keyURL(bucket, key)
+	req := newReq(url_).WithContext(ctx)
 	req.Method = "DELETE"
 	c.Auth.SignRequest(req)
 	res, err := c.httpClient().Do(req)
@@ -282,5 +443,5 @@ func (c *Client) Delete(bucket, key string) error {
 		res.StatusCode == http.StatusOK {
 		return nil
 	}
-	return fmt.Errorf("Amazon HTTP error on DELETE: %d - %s", res.StatusCode, key)
+	return &Error{Op: "DELETE", Key: key, StatusCode: res.StatusCode}
 }
@@ -17,6 +17,8 @@ limitations under the License.
 // Package syncutil provides various concurrency mechanisms.
 package syncutil
 
+import "context"
+
 // A Gate limits concurrency.
 type Gate struct {
 	c chan struct{}
@@ -32,6 +34,18 @@ func (g *Gate) Start() {
 	g.c <- struct{}{}
 }
 
+// StartContext is like Start but gives up and returns ctx.Err() if
+// ctx is done before the gate has room. Done must only be called if
+// StartContext returned nil.
+func (g *Gate) StartContext(ctx context.Context) error {
+	select {
+	case g.c <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // Done finishes an operation.
 func (g *Gate) Done() {
 	select {
@@ -40,3 +54,13 @@ func (g *Gate) Done() {
 		panic("Done called more than Start")
 	}
 }
+
+// Len returns the number of operations in progress.
+func (g *Gate) Len() int {
+	return len(g.c)
+}
+
+// Cap returns the number of operations permitted at once.
+func (g *Gate) Cap() int {
+	return cap(g.c)
+}
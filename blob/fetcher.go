@@ -25,8 +25,8 @@ import (
 // The full storage interface is blobserver.Storage.
 type Fetcher interface {
 	// Fetch returns a blob.  If the blob is not found then
-	// os.ErrNotExist should be returned for the error (not a wrapped
-	// error with a ErrNotExist inside)
+	// blobserver.ErrNotFound should be returned for the error (not a
+	// wrapped error with a ErrNotFound inside)
 	//
 	// The caller should close blob.
 	Fetch(Ref) (blob io.ReadCloser, size uint32, err error)
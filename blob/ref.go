@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"hash"
 	"path/filepath"
+	"time"
 
 	"github.com/nu7hatch/gouuid"
 )
@@ -92,11 +93,46 @@ func NewSizedRef(name string) SizedRef {
 	return SizedRef{Ref: NewRef(name)}
 }
 
-// SizedInfoRef is like a Ref but includes a size and MD5.
+// SizedInfoRef is like a Ref but includes a size and the metadata
+// reported by a stat of the blob.
 type SizedInfoRef struct {
 	Ref
-	Size uint32
-	MD5  string
+	Size        uint32
+	MD5         string    // optional. hex encoded MD5 of the contents
+	ModTime     time.Time // last modified time
+	ContentType string
+	Options
+}
+
+// Options are optional attributes a blob is stored with. Storage types
+// apply the ones they support and ignore the rest.
+type Options struct {
+	CacheControl         string
+	ContentDisposition   string
+	StorageClass         string // e.g. STANDARD_IA or GLACIER_IR on S3
+	ServerSideEncryption string // AES256 or aws:kms on S3
+	KMSKeyID             string // key used with aws:kms
+}
+
+// Merge returns o with the non-empty fields of override applied.
+func (o Options) Merge(override Options) Options {
+	if override.CacheControl != "" {
+		o.CacheControl = override.CacheControl
+	}
+	if override.ContentDisposition != "" {
+		o.ContentDisposition = override.ContentDisposition
+	}
+	if override.StorageClass != "" {
+		o.StorageClass = override.StorageClass
+	}
+	if override.ServerSideEncryption != "" {
+		o.ServerSideEncryption = override.ServerSideEncryption
+		o.KMSKeyID = ""
+	}
+	if override.KMSKeyID != "" {
+		o.KMSKeyID = override.KMSKeyID
+	}
+	return o
 }
 
 var bufPool = make(chan []byte, 20)
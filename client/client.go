@@ -15,6 +15,7 @@ import (
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -27,21 +28,45 @@ import (
 type Client struct {
 	CDNBaseURL string
 	ServerAddr string
+	// Token is sent as a bearer token with every request if set.
+	Token string
 }
 
+// New returns a client of the API at addr, which may be the root of a
+// namespace such as http://localhost:6064/v1/api/blobserver/team.
 func New(addr string) (*Client, error) {
+	return NewWithToken(addr, "")
+}
+
+// NewWithToken is like New but authenticates requests with token.
+func NewWithToken(addr, token string) (*Client, error) {
 	if addr == "" {
 		addr = "http://localhost:6064/v1/api/blobserver"
 	}
 	c := &Client{
 		ServerAddr: addr,
+		Token:      token,
 	}
 	err := c.setBaseURL()
 	return c, err
 }
 
+// do sends req with the credentials of the client.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	return http.DefaultClient.Do(req)
+}
+
 func (c *Client) setBaseURL() error {
-	res, err := http.Get(c.absURL("/config/", nil))
+	req, err := http.NewRequest("GET", c.absURL("/config/", nil), nil)
+
+	if err != nil {
+		return err
+	}
+
+	res, err := c.do(req)
 
 	if err != nil {
 		return err
@@ -132,7 +157,7 @@ func (c *Client) multiStat(paths []string) (Resources, error) {
 		return results, err
 	}
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := c.do(req)
 
 	if err != nil {
 		return results, err
@@ -156,31 +181,42 @@ func (c *Client) multiStat(paths []string) (Resources, error) {
 		cur.URL = c.CDNBaseURL + si.Path
 	}
 
+	for _, ref := range sr.Missing {
+		log.Printf("%s missing", ref.Path)
+	}
+
+	for ref, msg := range sr.Error {
+		log.Errorf("stat %s: %s", ref, msg)
+	}
+
 	return results, nil
 }
 
 func (c *Client) multiUpload(results Resources, toUpload []string) error {
-	req, err := c.multiMultipartRequest("/blob/upload/", toUpload)
+	req, err := c.multiMultipartRequest("/blob/upload/", results, toUpload)
 
 	if err != nil {
 		return err
 	}
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := c.do(req)
 
 	if err != nil {
 		return err
 	}
 
-	if res.StatusCode != 201 {
+	ur := new(protocol.UploadResponse)
+
+	if err := parseResponse(res, ur); err != nil {
 		return fmt.Errorf("Unexpected status code %d", res.StatusCode)
 	}
 
-	ur := new(protocol.UploadResponse)
-	parseResponse(res, ur)
+	for _, f := range ur.Failed {
+		log.Errorf("upload %s: %s", f.Name, f.Error)
+	}
 
 	if len(ur.Received) != len(toUpload) {
-		return fmt.Errorf("Expected %d received got %d", len(toUpload), len(ur.Received))
+		err = fmt.Errorf("Expected %d received got %d", len(toUpload), len(ur.Received))
 	}
 
 	for _, rec := range ur.Received {
@@ -194,10 +230,10 @@ func (c *Client) multiUpload(results Resources, toUpload []string) error {
 		cur.URL = c.CDNBaseURL + rec.Path
 	}
 
-	return nil
+	return err
 }
 
-func (c *Client) multiMultipartRequest(endpoint string, paths []string) (*http.Request, error) {
+func (c *Client) multiMultipartRequest(endpoint string, results Resources, paths []string) (*http.Request, error) {
 	var b bytes.Buffer
 	w := multipart.NewWriter(&b)
 
@@ -209,7 +245,16 @@ func (c *Client) multiMultipartRequest(endpoint string, paths []string) (*http.R
 		}
 
 		filename := filepath.Base(path)
-		part, err := w.CreateFormFile("file", filename)
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, filename))
+		h.Set("Content-Type", "application/octet-stream")
+
+		// let the server verify that the part arrived intact
+		if cur := results.findByLocalPath(path); cur != nil && cur.MD5 != "" {
+			h.Set("Content-MD5", cur.MD5)
+		}
+
+		part, err := w.CreatePart(h)
 
 		if err != nil {
 			file.Close()
@@ -277,6 +322,15 @@ func (res Resources) findByPath(path string) *Resource {
 	return nil
 }
 
+func (res Resources) findByLocalPath(path string) *Resource {
+	for j := 0; j < len(res); j++ {
+		if res[j].Path == path {
+			return res[j]
+		}
+	}
+	return nil
+}
+
 func pathToFilename(path string) string {
 	pc := strings.SplitN(path, "/", 2)
 
@@ -0,0 +1,99 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/simonz05/blobserver/protocol"
+)
+
+// SigningKey is a key of the [signing] config of a server. URLs signed
+// with it grant a single kind of request without a token, which makes
+// them safe to hand to browsers.
+type SigningKey struct {
+	ID     string
+	Secret string
+}
+
+// UploadPolicy restricts what a signed upload URL may store. With Ref
+// or Prefix set, blobs are stored by their filename, which must be Ref
+// or start with Prefix. Filenames are base names with .bin added if
+// they have no extension, so Ref and Prefix can't contain a slash.
+// ContentType may end in /* to allow any subtype.
+type UploadPolicy struct {
+	Ref         string
+	Prefix      string
+	MaxSize     int64
+	ContentType string
+}
+
+// UploadURL returns a URL of the server at addr which accepts uploads
+// allowed by p until expires.
+func (k SigningKey) UploadURL(addr string, p UploadPolicy, expires time.Time) (string, error) {
+	args := url.Values{}
+
+	if p.Ref != "" {
+		ref, err := protocol.UploadRef(p.Ref)
+
+		if err != nil {
+			return "", err
+		}
+
+		args.Set(protocol.SignRef, ref)
+	}
+
+	if p.Prefix != "" {
+		if strings.Contains(p.Prefix, "/") {
+			return "", protocol.ErrUploadPath
+		}
+
+		args.Set(protocol.SignPrefix, p.Prefix)
+	}
+
+	if p.MaxSize > 0 {
+		args.Set(protocol.SignMaxSize, strconv.FormatInt(p.MaxSize, 10))
+	}
+
+	if p.ContentType != "" {
+		args.Set(protocol.SignContentType, p.ContentType)
+	}
+
+	return k.sign("POST", addr, "/blob/upload/", args, expires)
+}
+
+// DownloadURL returns a URL of the server at addr which serves the blob
+// ref until expires, even if the blob isn't public.
+func (k SigningKey) DownloadURL(addr, ref string, expires time.Time) (string, error) {
+	return k.sign("GET", addr, fmt.Sprintf("/blob/get/%s/", ref), url.Values{}, expires)
+}
+
+func (k SigningKey) sign(method, addr, endpoint string, args url.Values, expires time.Time) (string, error) {
+	u, err := url.Parse(strings.TrimSuffix(addr, "/") + endpoint)
+
+	if err != nil {
+		return "", err
+	}
+
+	args.Set(protocol.SignKey, k.ID)
+	args.Set(protocol.SignExpires, strconv.FormatInt(expires.Unix(), 10))
+	args.Set(protocol.SignSignature, protocol.Signature([]byte(k.Secret), method, u.Path, args))
+	u.RawQuery = args.Encode()
+	return u.String(), nil
+}
+
+// SignUploadURL is like SigningKey.UploadURL for the server of c.
+func (c *Client) SignUploadURL(k SigningKey, p UploadPolicy, expires time.Time) (string, error) {
+	return k.UploadURL(c.ServerAddr, p, expires)
+}
+
+// SignDownloadURL is like SigningKey.DownloadURL for the server of c.
+func (c *Client) SignDownloadURL(k SigningKey, ref string, expires time.Time) (string, error) {
+	return k.DownloadURL(c.ServerAddr, ref, expires)
+}
@@ -0,0 +1,53 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/simonz05/blobserver/config"
+	"github.com/simonz05/blobserver/swift"
+	"github.com/simonz05/util/log"
+)
+
+func init() {
+	fs := flag.NewFlagSet("containers", flag.ExitOnError)
+	workers := fs.Int("workers", 0, "concurrent requests. Default max_conns from the config")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage: blobserver-admin [OPTIONS] containers [-workers N]
+
+Creates the containers of the swift storage and sets the configured read
+ACL on containers which have another. Containers which are fine are left
+alone, so it's safe to run against a live storage.
+
+Options:
+`)
+		fs.PrintDefaults()
+	}
+
+	commands = append(commands, &command{
+		name:  "containers",
+		usage: "create swift containers and repair their read ACL",
+		flags: fs,
+		run: func(conf *config.Config) error {
+			if conf.Swift == nil {
+				return fmt.Errorf("no swift storage configured")
+			}
+
+			if *workers > 0 {
+				conf.Swift.MaxConns = *workers
+			}
+
+			ctx, cancel := interruptContext()
+			defer cancel()
+
+			stats, err := swift.Provision(ctx, conf.Swift)
+			log.Printf("containers: %d created, %d repaired, %d ok", stats.Created, stats.Repaired, stats.OK)
+			return err
+		},
+	})
+}
@@ -0,0 +1,117 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Command blobserver-admin runs maintenance tasks on the storage of a
+// blobserver.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/simonz05/blobserver/config"
+	"github.com/simonz05/util/log"
+)
+
+var (
+	help           = flag.Bool("h", false, "show help text")
+	configFilename = flag.String("config", "config.toml", "config file path")
+	namespace      = flag.String("namespace", "", "run the command on the storage of this namespace")
+)
+
+// command is a blobserver-admin subcommand.
+type command struct {
+	name  string
+	usage string
+	flags *flag.FlagSet
+	run   func(conf *config.Config) error
+}
+
+var commands []*command
+
+// interruptContext returns a context which is canceled on interrupt,
+// letting a command stop once requests in flight are done.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt)
+
+	go func() {
+		select {
+		case <-sigc:
+			log.Println("interrupted, waiting for requests in flight")
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sigc)
+	}()
+
+	return ctx, cancel
+}
+
+// namespaceConfig returns the config of the storage of the namespace
+// name.
+func namespaceConfig(conf *config.Config, name string) (*config.Config, error) {
+	for i := range conf.Namespaces {
+		if ns := &conf.Namespaces[i]; ns.Name == name {
+			return conf.Namespace(ns), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown namespace %q", name)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] COMMAND [COMMAND OPTIONS]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\nOptions:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nCommands:\n")
+
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", cmd.name, cmd.usage)
+	}
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if *help || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var cmd *command
+
+	for _, c := range commands {
+		if c.name == flag.Arg(0) {
+			cmd = c
+		}
+	}
+
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	cmd.flags.Parse(flag.Args()[1:])
+	conf, err := config.ReadFile(*configFilename)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *namespace != "" {
+		if conf, err = namespaceConfig(conf, *namespace); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err = cmd.run(conf); err != nil {
+		log.Fatalf("%s: %v", cmd.name, err)
+	}
+}
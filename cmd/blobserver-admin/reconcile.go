@@ -0,0 +1,74 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/simonz05/blobserver"
+	"github.com/simonz05/blobserver/config"
+	"github.com/simonz05/blobserver/quota"
+	"github.com/simonz05/util/log"
+
+	_ "github.com/simonz05/blobserver/s3"
+)
+
+func init() {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage: blobserver-admin [OPTIONS] reconcile
+
+Recomputes the usage of a namespace from the blobs in its storage and
+replaces the tracked usage with it. Use -namespace to pick a namespace
+other than the API root.
+
+Usage kept in a file can only be reconciled while the server is
+stopped, since the server holds the file.
+`)
+	}
+
+	commands = append(commands, &command{
+		name:  "reconcile",
+		usage: "recompute the usage quotas are enforced against",
+		flags: fs,
+		run: func(conf *config.Config) error {
+			if conf.Usage == nil {
+				return fmt.Errorf("no [usage] configured")
+			}
+
+			store, err := quota.NewStore(conf.Usage)
+
+			if err != nil {
+				return err
+			}
+
+			sto, err := blobserver.CreateStorage(conf)
+
+			if err != nil {
+				return err
+			}
+
+			enum, ok := sto.(blobserver.BlobEnumerator)
+
+			if !ok {
+				return fmt.Errorf("storage can't enumerate blobs")
+			}
+
+			ctx, cancel := interruptContext()
+			defer cancel()
+
+			u, err := quota.Reconcile(ctx, enum, store, *namespace)
+
+			if err != nil {
+				return err
+			}
+
+			log.Printf("reconcile: %d bytes in %d objects", u.Bytes, u.Objects)
+			return nil
+		},
+	})
+}
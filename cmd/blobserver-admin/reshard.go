@@ -0,0 +1,64 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/simonz05/blobserver/config"
+	"github.com/simonz05/blobserver/swift"
+	"github.com/simonz05/util/log"
+)
+
+func init() {
+	fs := flag.NewFlagSet("reshard", flag.ExitOnError)
+	count := fs.Int("count", 0, "shard count to move to. Default shard_count from the config")
+	hash := fs.String("hash", "", "shard hash to move to: md5, sha1 or fnv. Default shard_hash from the config")
+	finish := fs.Bool("finish", false, "make the new scheme the current once every server has been restarted")
+	prune := fs.Bool("prune", false, "remove the copies kept in the old layout")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage: blobserver-admin [OPTIONS] reshard [-count N] [-hash H] [-finish] [-prune]
+
+Moves the blobs of a sharded swift container to a new shard scheme.
+Run it once to copy the blobs, then restart every server with the new
+scheme configured and run it again with -finish.
+
+The copies in the old layout are kept, since CDN URLs issued before
+point at them. Run it with -prune to remove them once those URLs are
+no longer used.
+
+Options:
+`)
+		fs.PrintDefaults()
+	}
+
+	commands = append(commands, &command{
+		name:  "reshard",
+		usage: "move swift blobs to a new shard scheme",
+		flags: fs,
+		run: func(conf *config.Config) error {
+			if conf.Swift == nil {
+				return fmt.Errorf("no swift storage configured")
+			}
+
+			if *count != 0 {
+				conf.Swift.ShardCount = *count
+			}
+
+			if *hash != "" {
+				conf.Swift.ShardHash = *hash
+			}
+
+			ctx, cancel := interruptContext()
+			defer cancel()
+
+			stats, err := swift.Reshard(ctx, conf.Swift, *finish, *prune)
+			log.Printf("reshard: %d copied, %d present, %d removed", stats.Copied, stats.Present, stats.Removed)
+			return err
+		},
+	})
+}
@@ -16,6 +16,7 @@ import (
 var (
 	serverAddr = flag.String("addr", "http://localhost:6064/v1/api/blobserver", "server addr")
 	outputType = flag.String("output", "json", "print result")
+	token      = flag.String("token", os.Getenv("BLOBSERVER_TOKEN"), "API token. Default $BLOBSERVER_TOKEN")
 )
 
 func main() {
@@ -26,7 +27,7 @@ func main() {
 		log.Fatal("Expected file argument missing")
 	}
 
-	c, err := client.New(*serverAddr)
+	c, err := client.NewWithToken(*serverAddr, *token)
 
 	if err != nil {
 		log.Fatal(err)
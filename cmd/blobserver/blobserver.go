@@ -82,7 +82,7 @@ func main() {
 	}
 
 	log.Printf("Using `%s` storage", conf.StorageType())
-	err = server.ListenAndServe(*laddr, storage)
+	err = server.ListenAndServe(*laddr, conf, storage)
 
 	if err != nil {
 		log.Errorln(err)
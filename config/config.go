@@ -5,36 +5,274 @@
 package config
 
 import (
+	"time"
+
 	"github.com/BurntSushi/toml"
 )
 
 type Config struct {
-	Listen string
-	S3     *S3Config
-	Swift  *SwiftConfig
+	Listen  string
+	S3      *S3Config
+	Swift   *SwiftConfig
+	Timeout *TimeoutConfig
+	Auth    *AuthConfig
+	Signing *SigningConfig
+	CORS    *CORSConfig
+
+	RateLimit *RateLimitConfig `toml:"rate_limit"`
+	Health    *HealthConfig
+
+	// optional. How long connections are still accepted on shutdown
+	// after /readyz reports not ready, so load balancers stop sending
+	// requests first. Default 5s
+	DrainDelay Duration `toml:"drain_delay"`
+
+	// optional. How long requests in flight are waited for on shutdown.
+	// Default 30s
+	ShutdownTimeout Duration `toml:"shutdown_timeout"`
+
+	Namespaces []NamespaceConfig `toml:"namespace"`
+
+	Quota *QuotaConfig // optional. Quota of the storage at the API root
+	Usage *UsageConfig
+}
+
+// QuotaConfig caps the usage of a namespace. Zero is no limit.
+type QuotaConfig struct {
+	Bytes   int64 `toml:"bytes"`
+	Objects int64 `toml:"objects"`
+}
+
+// UsageConfig turns on tracking the usage of every namespace, which
+// quotas are enforced against. It's kept in Redis if redis is set, or
+// in a local file otherwise.
+//
+// The file suits a single server. Changes are written to it at most
+// once a second, and on shutdown, so a crash loses the changes of the
+// last second. Run blobserver-admin reconcile to correct the usage
+// after one. The server keeps the file locked, so stop it before
+// running reconcile; the usage in Redis can be reconciled at any time.
+type UsageConfig struct {
+	Redis  string `toml:"redis"`  // kvstore DSN such as redis://:password@localhost:6379/0
+	Prefix string `toml:"prefix"` // optional. Default blobserver:usage
+	File   string `toml:"file"`
+}
+
+// NamespaceConfig is a tenant with its own storage, served under
+// /v1/api/blobserver/{name}/. The storage is configured by the [s3] or
+// [swift] section with the settings set here replaced.
+type NamespaceConfig struct {
+	Name   string `toml:"name"`
+	Bucket string `toml:"bucket"`  // optional. S3 bucket or Swift container
+	CDNUrl string `toml:"cdn_url"` // optional
+	ACL    string `toml:"acl"`     // optional. S3 default_acl or Swift container_read_acl
+	Quota  *QuotaConfig
+
+	// optional. Replaces the [s3] or [swift] section.
+	S3    *S3Config
+	Swift *SwiftConfig
+}
+
+// Namespace returns the config of the storage of ns. The storage
+// section is copied, so neither c nor ns is changed.
+func (c *Config) Namespace(ns *NamespaceConfig) *Config {
+	nc := &Config{Timeout: c.Timeout, Quota: ns.Quota, Usage: c.Usage}
+	s3, swift := c.S3, c.Swift
+
+	if ns.S3 != nil || ns.Swift != nil {
+		s3, swift = ns.S3, ns.Swift
+	}
+
+	switch {
+	case s3 != nil:
+		s3 := *s3
+		nc.S3 = &s3
+	case swift != nil:
+		swift := *swift
+		nc.Swift = &swift
+	}
+
+	if s3 := nc.S3; s3 != nil {
+		s3.Bucket = replace(s3.Bucket, ns.Bucket)
+		s3.CDNUrl = replace(s3.CDNUrl, ns.CDNUrl)
+		s3.DefaultACL = replace(s3.DefaultACL, ns.ACL)
+	}
+
+	if swift := nc.Swift; swift != nil {
+		swift.Container = replace(swift.Container, ns.Bucket)
+		swift.CDNUrl = replace(swift.CDNUrl, ns.CDNUrl)
+		swift.ContainerReadACL = replace(swift.ContainerReadACL, ns.ACL)
+	}
+
+	return nc
+}
+
+func replace(v, with string) string {
+	if with != "" {
+		return with
+	}
+	return v
+}
+
+// AuthConfig turns on token authentication. Requests send a token in
+// an "Authorization: Bearer" header and may do what its scopes allow.
+// The scopes are read, upload, remove and admin, which allows all.
+type AuthConfig struct {
+	Anonymous []string      `toml:"anonymous"` // optional. Scopes of requests without a token
+	Tokens    []TokenConfig `toml:"token"`
+
+	// optional. Tokens are also looked up in the util/session storage
+	// at this Redis address. Admin sessions have every scope.
+	SessionRedis  string   `toml:"session_redis"`
+	SessionPrefix string   `toml:"session_prefix"` // optional. Default blobserver:token
+	SessionScopes []string `toml:"session_scopes"`
+}
+
+type TokenConfig struct {
+	Name   string   `toml:"name"`
+	Token  string   `toml:"token"`
+	Scopes []string `toml:"scopes"`
+}
+
+// SigningConfig turns on signed URLs. A URL signed with one of the
+// keys grants the request it was signed for without a token until it
+// expires. Keys are listed by id so they can be rotated.
+type SigningConfig struct {
+	Keys      []SigningKeyConfig `toml:"key"`
+	MaxExpiry Duration           `toml:"max_expiry"` // optional. Max lifetime of a URL. Default 24h
+}
+
+type SigningKeyConfig struct {
+	ID     string `toml:"id"`
+	Secret string `toml:"secret"`
+}
+
+// CORSConfig lets browsers on the listed origins use the API. An
+// origin may be "*", or contain a "*" for any subdomain such as
+// "https://*.example.com". Credentials can't be allowed with "*".
+type CORSConfig struct {
+	Origins     []string `toml:"origins"`
+	Methods     []string `toml:"methods"`     // optional. Default GET, HEAD, POST and DELETE
+	Headers     []string `toml:"headers"`     // optional. Request headers allowed. Default Authorization and Content-Type
+	MaxAge      Duration `toml:"max_age"`     // optional. How long preflight responses may be cached
+	Credentials bool     `toml:"credentials"` // optional. Allow cookies and HTTP auth
+}
+
+// RateLimitConfig limits the requests of each client, which is an API
+// token or else an IP address. Zero is no limit.
+type RateLimitConfig struct {
+	Requests    float64 `toml:"requests"`     // requests per second
+	Burst       int     `toml:"burst"`        // optional. Requests above the rate allowed at once. Default the rate
+	UploadBytes int64   `toml:"upload_bytes"` // upload bytes per second
+	UploadBurst int64   `toml:"upload_burst"` // optional. Default upload_bytes
+	MaxUploads  int     `toml:"max_uploads"`  // uploads at once, of all clients
+	IPHeader    string  `toml:"ip_header"`    // optional. Header with the client IP set by a proxy, such as X-Forwarded-For
+
+	// optional. Proxies in front of the server which add to ip_header.
+	// The client IP is the entry this many from the right. Default 1
+	TrustedProxies int `toml:"trusted_proxies"`
+}
+
+// HealthConfig tunes the readiness check of /readyz.
+type HealthConfig struct {
+	Sentinel string   `toml:"sentinel"`  // optional. Blob of the default storage which must exist
+	CacheTTL Duration `toml:"cache_ttl"` // optional. How long a check result is reused. Default 5s
+	Timeout  Duration `toml:"timeout"`   // optional. Default 5s
+}
+
+// TimeoutConfig sets per-operation deadlines for storage calls made
+// by the server. Zero means no deadline.
+type TimeoutConfig struct {
+	Fetch   Duration `toml:"fetch"`
+	Receive Duration `toml:"receive"`
+	Stat    Duration `toml:"stat"`
+	Remove  Duration `toml:"remove"`
+}
+
+// Duration is a time.Duration read from a string such as "30s".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
 }
 
+// S3Config configures the s3 storage.
+//
+// Requests are signed with signature version 4 if region is set, and
+// with the legacy version 2 otherwise, as before version 4 was
+// supported. To move a config to version 4 set region to the region of
+// the bucket; version 4 signs for us-east-1 if region isn't set, which
+// fails for buckets elsewhere.
 type S3Config struct {
-	Hostname        string // Optional. Default s3.amazonaws.com
-	AccessKey       string `toml:"access_key"`
-	SecretAccessKey string `toml:"secret_access_key"`
-	Bucket          string
-	DefaultACL      string `toml:"default_acl"` // optional. Default private. public-read
-	CDNUrl          string `toml:"cdn_url"`
+	Hostname         string // Optional. Default s3.amazonaws.com or s3.<region>.amazonaws.com
+	Endpoint         string `toml:"endpoint"` // optional. URL such as http://minio:9000, overrides hostname and disable_tls
+	Region           string `toml:"region"`   // optional. Default us-east-1
+	PathStyle        bool   `toml:"path_style"`
+	DisableTLS       bool   `toml:"disable_tls"`
+	SignatureVersion int    `toml:"signature_version"` // optional. 2 or 4. Default 4 if region is set, or else 2
+	AccessKey        string `toml:"access_key"`
+	SecretAccessKey  string `toml:"secret_access_key"`
+	Bucket           string
+	DefaultACL       string `toml:"default_acl"` // optional. Default private. public-read
+	CDNUrl           string `toml:"cdn_url"`
+
+	// Defaults for how objects are stored. Uploads may override them.
+	ServerSideEncryption string `toml:"server_side_encryption"` // optional. AES256 or aws:kms
+	SSEKMSKeyID          string `toml:"sse_kms_key_id"`         // optional. Key for aws:kms
+	StorageClass         string `toml:"storage_class"`          // optional. Default STANDARD
+	CacheControl         string `toml:"cache_control"`
+	ContentDisposition   string `toml:"content_disposition"`
+
+	// optional. Redirect downloads to a presigned URL with "presign",
+	// or to cdn_url with "cdn", instead of serving them.
+	Redirect       string   `toml:"redirect"`
+	RedirectExpiry Duration `toml:"redirect_expiry"` // optional. Lifetime of presigned URLs. Default 5m
 }
 
 type SwiftConfig struct {
-	APIUser          string `toml:"api_user"`
-	APIKey           string `toml:"api_key"`
-	AuthURL          string `toml:"auth_url"`
-	Tenant           string `toml:"tenant"`
-	TenantID         string `toml:"tenant_id"`
-	Region           string `toml:"region"`
+	APIUser     string `toml:"api_user"`
+	APIKey      string `toml:"api_key"`
+	AuthURL     string `toml:"auth_url"`
+	AuthVersion int    `toml:"auth_version"` // optional. 1, 2 or 3. Default detected from auth_url
+	Tenant      string `toml:"tenant"`       // optional. Project name with v3 auth
+	TenantID    string `toml:"tenant_id"`    // optional. Project ID with v3 auth
+	Region      string `toml:"region"`
+	// optional. public or internal. Default public
+	EndpointType string `toml:"endpoint_type"`
+
+	// Keystone v3 only. The user's domain, and the project's domain
+	// when it differs from the user's.
+	Domain          string `toml:"domain"`
+	DomainID        string `toml:"domain_id"`
+	ProjectDomain   string `toml:"project_domain"`
+	ProjectDomainID string `toml:"project_domain_id"`
+
+	// Keystone v3 only. Authenticate with an application credential
+	// instead of api_user and api_key. A credential referenced by name
+	// also needs api_user and its domain.
+	ApplicationCredentialID     string `toml:"application_credential_id"`
+	ApplicationCredentialName   string `toml:"application_credential_name"`
+	ApplicationCredentialSecret string `toml:"application_credential_secret"`
+
 	Container        string `toml:"container"`
 	ContainerReadACL string `toml:"container_read_acl"`
 	CDNUrl           string `toml:"cdn_url"`
 	Shard            bool   `toml:"shard"`
+	ShardCount       int    `toml:"shard_count"` // optional. Default 1024
+	ShardHash        string `toml:"shard_hash"`  // optional. md5, sha1 or fnv. Default md5
 	CheckInit        bool   `toml:"check_init"`
+	MaxConns         int    `toml:"max_conns"` // optional. Concurrent requests to the host. Default 20
+
+	// optional. Redirect downloads to a TempURL signed with
+	// temp_url_key with "tempurl", or to cdn_url with "cdn", instead of
+	// serving them. The key must be set as the account's
+	// X-Account-Meta-Temp-URL-Key.
+	Redirect       string   `toml:"redirect"`
+	RedirectExpiry Duration `toml:"redirect_expiry"` // optional. Lifetime of TempURLs. Default 5m
+	TempURLKey     string   `toml:"temp_url_key"`
 }
 
 func (c *Config) StorageType() string {
@@ -0,0 +1,30 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package config
+
+import "testing"
+
+func TestNamespace(t *testing.T) {
+	conf := &Config{S3: &S3Config{Bucket: "root", CDNUrl: "https://cdn.example.com/"}}
+	own := &NamespaceConfig{Name: "a", Bucket: "a", ACL: "public-read", S3: &S3Config{Bucket: "own"}}
+	shared := &NamespaceConfig{Name: "b", Bucket: "b"}
+
+	if s3 := conf.Namespace(own).S3; s3.Bucket != "a" || s3.DefaultACL != "public-read" || s3.CDNUrl != "" {
+		t.Errorf("namespace a: got %+v", s3)
+	}
+
+	if s3 := conf.Namespace(shared).S3; s3.Bucket != "b" || s3.CDNUrl != "https://cdn.example.com/" {
+		t.Errorf("namespace b: got %+v", s3)
+	}
+
+	// resolving a namespace doesn't change the config it's read from.
+	if own.S3.Bucket != "own" || own.S3.DefaultACL != "" {
+		t.Errorf("namespace section changed: %+v", own.S3)
+	}
+
+	if conf.S3.Bucket != "root" {
+		t.Errorf("root section changed: %+v", conf.S3)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package blobserver
+
+import (
+	"context"
+	"io"
+
+	"github.com/simonz05/blobserver/blob"
+)
+
+// ContextFetcher is like blob.Fetcher but the fetch is cancelled
+// when ctx is done.
+type ContextFetcher interface {
+	FetchContext(ctx context.Context, br blob.Ref) (blob io.ReadCloser, size uint32, err error)
+}
+
+// ContextBlobReceiver is like BlobReceiver but the blob is not
+// stored if ctx is done before it was committed.
+type ContextBlobReceiver interface {
+	ReceiveBlobContext(ctx context.Context, br blob.Ref, source io.Reader) (blob.SizedRef, error)
+}
+
+// ContextBlobStatter is like BlobStatter but stops statting and
+// sending to dest when ctx is done.
+type ContextBlobStatter interface {
+	StatBlobsContext(ctx context.Context, dest chan<- blob.SizedInfoRef, blobs []blob.Ref) error
+}
+
+// ContextBlobRemover is like BlobRemover but stops removing when ctx
+// is done.
+type ContextBlobRemover interface {
+	RemoveBlobsContext(ctx context.Context, blobs []blob.Ref) error
+}
+
+// ContextStorage is a Storage which also accepts a context.Context
+// for cancellation and deadlines. When ctx is done the methods return
+// ctx.Err().
+type ContextStorage interface {
+	Storage
+	ContextFetcher
+	ContextBlobReceiver
+	ContextBlobStatter
+	ContextBlobRemover
+}
+
+// NewContextStorage returns sto as a ContextStorage. Storage types
+// without native context support are adapted: the context is checked
+// before each call, blob sources stop reading once it is done, and
+// stats stop being waited for. A call already issued to the backend
+// can't be interrupted by the adapter.
+func NewContextStorage(sto Storage) ContextStorage {
+	if cs, ok := sto.(ContextStorage); ok {
+		return cs
+	}
+	return contextStorage{sto}
+}
+
+type contextStorage struct {
+	Storage
+}
+
+func (s contextStorage) FetchContext(ctx context.Context, br blob.Ref) (io.ReadCloser, uint32, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	return s.Fetch(br)
+}
+
+func (s contextStorage) ReceiveBlobContext(ctx context.Context, br blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	if err := ctx.Err(); err != nil {
+		return blob.SizedRef{}, err
+	}
+	return s.ReceiveBlob(br, NewContextReader(ctx, source))
+}
+
+func (s contextStorage) StatBlobsContext(ctx context.Context, dest chan<- blob.SizedInfoRef, blobs []blob.Ref) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c := make(chan blob.SizedInfoRef)
+	errc := make(chan error, 1)
+
+	go func() {
+		errc <- s.StatBlobs(c, blobs)
+		close(c)
+	}()
+
+	for {
+		select {
+		case sb, ok := <-c:
+			if !ok {
+				return <-errc
+			}
+			select {
+			case dest <- sb:
+			case <-ctx.Done():
+				go drain(c)
+				return ctx.Err()
+			}
+		case <-ctx.Done():
+			go drain(c)
+			return ctx.Err()
+		}
+	}
+}
+
+func (s contextStorage) RemoveBlobsContext(ctx context.Context, blobs []blob.Ref) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.RemoveBlobs(blobs)
+}
+
+// drain discards the remaining stat results of an abandoned call.
+func drain(c <-chan blob.SizedInfoRef) {
+	for range c {
+	}
+}
+
+// StatBlobContext is like StatBlob but cancelled when ctx is done.
+func StatBlobContext(ctx context.Context, bs ContextBlobStatter, br blob.Ref) (sb blob.SizedInfoRef, err error) {
+	c := make(chan blob.SizedInfoRef, 1)
+	err = bs.StatBlobsContext(ctx, c, []blob.Ref{br})
+	if err != nil {
+		return
+	}
+	select {
+	case sb = <-c:
+	default:
+		err = ErrNotFound
+	}
+	return
+}
+
+// NewContextReader returns a Reader which reads from r until ctx is
+// done, after which Read returns ctx.Err().
+func NewContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
@@ -0,0 +1,46 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package blobserver
+
+import (
+	"errors"
+)
+
+// Errors returned by storage implementations. Backends translate
+// their provider specific errors into these so that callers, and the
+// HTTP server in particular, can act on them without knowing the
+// backend.
+var (
+	// ErrNotFound is returned when a blob does not exist.
+	ErrNotFound = errors.New("blob not found")
+
+	// ErrAlreadyExists is returned when a blob may not be
+	// overwritten.
+	ErrAlreadyExists = errors.New("blob already exists")
+
+	// ErrTooLarge is returned when a blob is over MaxBlobSize or
+	// over a limit imposed by the backend.
+	ErrTooLarge = errors.New("blob too large")
+
+	// ErrPreconditionFailed is returned when a conditional request
+	// or an integrity check, such as a digest mismatch, fails.
+	ErrPreconditionFailed = errors.New("precondition failed")
+
+	// ErrQuotaExceeded is returned when storing a blob would exceed
+	// a storage quota.
+	ErrQuotaExceeded = errors.New("quota exceeded")
+
+	// ErrBackendUnavailable is returned when the storage backend
+	// can't be reached or is temporarily failing.
+	ErrBackendUnavailable = errors.New("storage backend unavailable")
+
+	// ErrInvalidOptions is returned when a blob is received with
+	// options the storage doesn't accept.
+	ErrInvalidOptions = errors.New("invalid blob options")
+
+	// ErrNoSignedURL is returned by a URLSigner which doesn't hand
+	// out URLs. The blob is served by the server then.
+	ErrNoSignedURL = errors.New("no signed URL")
+)
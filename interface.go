@@ -20,8 +20,8 @@ limitations under the License.
 package blobserver
 
 import (
+	"context"
 	"io"
-	"os"
 
 	"github.com/simonz05/blobserver/blob"
 )
@@ -38,6 +38,24 @@ type BlobReceiver interface {
 	ReceiveBlob(br blob.Ref, source io.Reader) (blob.SizedRef, error)
 }
 
+// OptionsBlobReceiver is implemented by storage which can store a blob
+// with Options.
+type OptionsBlobReceiver interface {
+	// ReceiveBlobOptions is like ReceiveBlobContext but stores the
+	// blob with opts. ErrInvalidOptions is returned for options the
+	// storage can't apply.
+	ReceiveBlobOptions(ctx context.Context, br blob.Ref, source io.Reader, opts blob.Options) (blob.SizedRef, error)
+}
+
+// ReceiveBlobOptions stores a blob with opts if bs implements
+// OptionsBlobReceiver. Otherwise opts are ignored.
+func ReceiveBlobOptions(ctx context.Context, bs ContextBlobReceiver, br blob.Ref, source io.Reader, opts blob.Options) (blob.SizedRef, error) {
+	if obs, ok := bs.(OptionsBlobReceiver); ok {
+		return obs.ReceiveBlobOptions(ctx, br, source, opts)
+	}
+	return bs.ReceiveBlobContext(ctx, br, source)
+}
+
 type BlobStatter interface {
 	// Stat checks for the existence of blobs, writing their sizes
 	// (if found back to the dest channel), and returning an error
@@ -56,7 +74,7 @@ func StatBlob(bs BlobStatter, br blob.Ref) (sb blob.SizedInfoRef, err error) {
 	select {
 	case sb = <-c:
 	default:
-		err = os.ErrNotExist
+		err = ErrNotFound
 	}
 	return
 }
@@ -74,6 +92,14 @@ type BlobRemover interface {
 	RemoveBlobs(blobs []blob.Ref) error
 }
 
+// BlobEnumerator is implemented by storage which can list its blobs.
+type BlobEnumerator interface {
+	// EnumerateBlobs calls fn with every blob of the storage, in no
+	// particular order. It stops at the first error of fn, which is
+	// returned, or when ctx is done.
+	EnumerateBlobs(ctx context.Context, fn func(blob.SizedRef) error) error
+}
+
 // Storage is the interface that must be implemented by a blobserver
 // storage type. (e.g. localdisk, s3, encrypt, shard, replica, remote)
 type Storage interface {
@@ -97,14 +123,34 @@ type ShutdownStorage interface {
 //}
 
 type Config struct {
-	CDNUrl string
-	Name   string
+	CDNUrl    string
+	Name      string
+	Namespace string `json:",omitempty"`
 }
 
 type Configer interface {
 	Config() *Config
 }
 
+// URLSigner is implemented by storage which can serve blobs to clients
+// directly. The server redirects downloads to the URL it returns
+// instead of streaming the blob.
+type URLSigner interface {
+	// SignedURL returns a URL the blob br can be fetched from with a
+	// GET request. The URL may expire. ErrNoSignedURL is returned if
+	// the storage isn't configured to hand out URLs.
+	SignedURL(ctx context.Context, br blob.Ref) (string, error)
+}
+
+// HealthChecker is implemented by storage which can check that its
+// backend is reachable, such as by authenticating or looking up its
+// bucket.
+type HealthChecker interface {
+	// CheckHealth returns an error if the storage can't serve
+	// requests.
+	CheckHealth(ctx context.Context) error
+}
+
 type StorageConfiger interface {
 	Storage
 	Configer
@@ -0,0 +1,301 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package metrics implements counters, gauges and histograms served in
+// the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are the upper bounds of histogram buckets suited to
+// request latencies in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// series is the value of a metric with a set of label values.
+type series struct {
+	labels []string
+	value  float64
+
+	// histograms only
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// family is the metric of a name.
+type family struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+	funcs  []gaugeFunc
+}
+
+type gaugeFunc struct {
+	labels []string
+	fn     func() float64
+}
+
+// with returns the series of values, locked.
+func (f *family) with(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s has labels %v, got values %v", f.name, f.labels, values))
+	}
+
+	key := strings.Join(values, "\xff")
+	f.mu.Lock()
+	s, ok := f.series[key]
+
+	if !ok {
+		s = &series{labels: append([]string(nil), values...)}
+
+		if f.buckets != nil {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+
+		f.series[key] = s
+	}
+
+	return s
+}
+
+// Registry is a set of metrics. It serves them over HTTP.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+func (r *Registry) register(name, help, typ string, labels []string, buckets []float64) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if f, ok := r.families[name]; ok {
+		if f.typ != typ {
+			panic(fmt.Sprintf("metrics: %s registered as %s and %s", name, f.typ, typ))
+		}
+		return f
+	}
+
+	f := &family{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	r.families[name] = f
+	return f
+}
+
+// Counter is a metric which only goes up.
+type Counter struct {
+	f *family
+}
+
+// NewCounter returns the counter name with the given label names.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(name, help, "counter", labels, nil)}
+}
+
+// Add adds v, which must not be negative, to the counter of the label
+// values.
+func (c *Counter) Add(v float64, values ...string) {
+	s := c.f.with(values)
+	s.value += v
+	c.f.mu.Unlock()
+}
+
+// Inc adds one to the counter of the label values.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Gauge is a metric which goes up and down.
+type Gauge struct {
+	f *family
+}
+
+// NewGauge returns the gauge name with the given label names.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(name, help, "gauge", labels, nil)}
+}
+
+// Add adds v to the gauge of the label values.
+func (g *Gauge) Add(v float64, values ...string) {
+	s := g.f.with(values)
+	s.value += v
+	g.f.mu.Unlock()
+}
+
+// Set sets the gauge of the label values to v.
+func (g *Gauge) Set(v float64, values ...string) {
+	s := g.f.with(values)
+	s.value = v
+	g.f.mu.Unlock()
+}
+
+// GaugeFunc adds a gauge name whose value is fn called when the
+// metrics are read. labels are pairs of label names and values.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64, labels ...string) {
+	if len(labels)%2 != 0 {
+		panic("metrics: odd label pairs for " + name)
+	}
+
+	f := r.register(name, help, "gauge", nil, nil)
+	f.mu.Lock()
+	f.funcs = append(f.funcs, gaugeFunc{labels, fn})
+	f.mu.Unlock()
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	f *family
+}
+
+// NewHistogram returns the histogram name with the given bucket upper
+// bounds, in increasing order, and label names.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{r.register(name, help, "histogram", labels, buckets)}
+}
+
+// Observe adds v to the histogram of the label values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	s := h.f.with(values)
+
+	if i := sort.SearchFloat64s(h.f.buckets, v); i < len(s.counts) {
+		s.counts[i]++
+	}
+
+	s.sum += v
+	s.count++
+	h.f.mu.Unlock()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelString formats label pairs with extra pairs appended.
+func labelString(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+
+	write := func(name, value string) {
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		labelEscaper.WriteString(&b, value)
+		b.WriteByte('"')
+	}
+
+	for i, name := range names {
+		write(name, values[i])
+	}
+
+	for i := 0; i < len(extra); i += 2 {
+		write(extra[i], extra[i+1])
+	}
+
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (f *family) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, strings.Replace(f.help, "\n", `\n`, -1))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.series))
+
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+
+		if f.typ != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, labelString(f.labels, s.labels), formatFloat(s.value))
+			continue
+		}
+
+		var n uint64
+
+		for i, le := range f.buckets {
+			n += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, labelString(f.labels, s.labels, "le", formatFloat(le)), n)
+		}
+
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, labelString(f.labels, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, labelString(f.labels, s.labels), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, labelString(f.labels, s.labels), s.count)
+	}
+
+	funcs := f.funcs
+	f.mu.Unlock()
+
+	for _, g := range funcs {
+		fmt.Fprintf(w, "%s%s %s\n", f.name, labelString(nil, nil, g.labels...), formatFloat(g.fn()))
+	}
+}
+
+// Write writes the metrics in the Prometheus text format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	families := make([]*family, 0, len(r.families))
+
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+
+	r.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+	bw := bufio.NewWriter(w)
+
+	for _, f := range families {
+		f.write(bw)
+	}
+
+	return bw.Flush()
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Write(w)
+}
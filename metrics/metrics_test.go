@@ -0,0 +1,54 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/simonz05/util/assert"
+)
+
+func TestWrite(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestWrite")
+	r := NewRegistry()
+	c := r.NewCounter("requests_total", "Requests.", "route", "code")
+	c.Inc("get", "200")
+	c.Add(2, "get", "200")
+	c.Inc("up\"load", "500")
+
+	h := r.NewHistogram("latency_seconds", "Latency.", []float64{.1, 1}, "route")
+	h.Observe(.1, "get")
+	h.Observe(.5, "get")
+	h.Observe(5, "get")
+
+	g := r.NewGauge("in_flight", "In flight.")
+	g.Add(2)
+	g.Add(-1)
+
+	n := 3
+	r.GaugeFunc("gate", "Gate.", func() float64 { return float64(n) }, "gate", "stat")
+
+	var b bytes.Buffer
+	ast.Nil(r.Write(&b))
+	ast.Equal(`# HELP gate Gate.
+# TYPE gate gauge
+gate{gate="stat"} 3
+# HELP in_flight In flight.
+# TYPE in_flight gauge
+in_flight 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="get",le="0.1"} 1
+latency_seconds_bucket{route="get",le="1"} 2
+latency_seconds_bucket{route="get",le="+Inf"} 3
+latency_seconds_sum{route="get"} 5.6
+latency_seconds_count{route="get"} 3
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{route="get",code="200"} 3
+requests_total{route="up\"load",code="500"} 1
+`, b.String())
+}
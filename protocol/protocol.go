@@ -20,6 +20,7 @@ package protocol
 
 import (
 	"encoding/json"
+	"time"
 
 	"github.com/simonz05/blobserver"
 	"github.com/simonz05/blobserver/blob"
@@ -27,15 +28,57 @@ import (
 
 type RefInfo struct {
 	blob.Ref
-	Size uint32
-	MD5  string `json:"MD5,omitempty"`
+	Size                 uint32
+	MD5                  string     `json:"MD5,omitempty"`
+	ModTime              *time.Time `json:"ModTime,omitempty"`
+	ContentType          string     `json:"ContentType,omitempty"`
+	CacheControl         string     `json:"CacheControl,omitempty"`
+	ContentDisposition   string     `json:"ContentDisposition,omitempty"`
+	StorageClass         string     `json:"StorageClass,omitempty"`
+	ServerSideEncryption string     `json:"ServerSideEncryption,omitempty"`
+	KMSKeyID             string     `json:"KMSKeyID,omitempty"`
+}
+
+// NewRefInfo returns the RefInfo for a statted blob.
+func NewRefInfo(sb blob.SizedInfoRef) RefInfo {
+	ri := RefInfo{
+		Ref:                  sb.Ref,
+		Size:                 sb.Size,
+		MD5:                  sb.MD5,
+		ContentType:          sb.ContentType,
+		CacheControl:         sb.CacheControl,
+		ContentDisposition:   sb.ContentDisposition,
+		StorageClass:         sb.StorageClass,
+		ServerSideEncryption: sb.ServerSideEncryption,
+		KMSKeyID:             sb.KMSKeyID,
+	}
+	if !sb.ModTime.IsZero() {
+		t := sb.ModTime
+		ri.ModTime = &t
+	}
+	return ri
 }
 
 // UploadResponse is the JSON document returned from the blob batch
 // upload handler.
 type UploadResponse struct {
-	Received []RefInfo         `json:"Data"`
-	Error    map[string]string `json:"Error,omitempty"`
+	Received []RefInfo `json:"Data"`
+
+	// Failed lists every file which wasn't stored, in the order of the
+	// request.
+	Failed []UploadError `json:"Failed,omitempty"`
+
+	// Error is the error of each failed file by its name. Files of the
+	// same name share an entry, so it's kept for existing clients only.
+	Error map[string]string `json:"Error,omitempty"`
+}
+
+// UploadError is why a file of an upload wasn't stored. Part is the
+// index of its multipart section, starting at 1.
+type UploadError struct {
+	Part  int
+	Name  string
+	Error string
 }
 
 func (p *UploadResponse) MarshalJSON() ([]byte, error) {
@@ -46,8 +89,16 @@ func (p *UploadResponse) MarshalJSON() ([]byte, error) {
 	return json.Marshal(v)
 }
 
+// BatchRequest is the JSON document accepted by the blob batch stat
+// and remove handlers as an alternative to form values. At most 1000
+// blobs may be given per request.
+type BatchRequest struct {
+	Blobs []string `json:"blobs"`
+}
+
 // RemoveResponse is the JSON document returned from the blob batch
-// remove handler.
+// remove handler. Blobs that failed to be removed are listed in Error,
+// keyed by ref.
 type RemoveResponse struct {
 	Removed []blob.Ref        `json:"Data"`
 	Error   map[string]string `json:"Error,omitempty"`
@@ -67,11 +118,29 @@ type ConfigResponse struct {
 	Error map[string]string  `json:"Error,omitempty"`
 }
 
+// Usage is the usage and quota of a namespace. A zero quota is no
+// limit.
+type Usage struct {
+	Namespace  string `json:"Namespace"`
+	Bytes      int64  `json:"Bytes"`
+	Objects    int64  `json:"Objects"`
+	MaxBytes   int64  `json:"MaxBytes"`
+	MaxObjects int64  `json:"MaxObjects"`
+}
+
+// UsageResponse is the JSON document returned from the usage handler.
+type UsageResponse struct {
+	Data  *Usage            `json:"Data"`
+	Error map[string]string `json:"Error,omitempty"`
+}
+
 // StatResponse is the JSON document returned from the blob batch
-// stat handler.
+// stat handler. Blobs that don't exist are listed in Missing; blobs
+// that could not be statted are listed in Error, keyed by ref.
 type StatResponse struct {
-	Stat  []RefInfo         `json:"Data"`
-	Error map[string]string `json:"Error,omitempty"`
+	Stat    []RefInfo         `json:"Data"`
+	Missing []blob.Ref        `json:"Missing"`
+	Error   map[string]string `json:"Error,omitempty"`
 }
 
 func (p *StatResponse) MarshalJSON() ([]byte, error) {
@@ -79,5 +148,8 @@ func (p *StatResponse) MarshalJSON() ([]byte, error) {
 	if v.Stat == nil {
 		v.Stat = []RefInfo{}
 	}
+	if v.Missing == nil {
+		v.Missing = []blob.Ref{}
+	}
 	return json.Marshal(v)
 }
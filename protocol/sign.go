@@ -0,0 +1,66 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/simonz05/blobserver/blob"
+)
+
+// Query parameters of signed URLs. Every parameter of a signed URL but
+// the signature itself is covered by it.
+const (
+	SignKey         = "key"          // id of the key the URL is signed with
+	SignExpires     = "expires"      // unix time the URL expires at
+	SignRef         = "ref"          // upload: the ref the blob is stored as
+	SignPrefix      = "prefix"       // upload: prefix of the refs blobs are stored as
+	SignMaxSize     = "max-size"     // upload: max size of each blob in bytes
+	SignContentType = "content-type" // upload: Content-Type of each part, such as image/*
+	SignSignature   = "signature"
+)
+
+// Signature returns the signature of a request with method for the URL
+// path and query, signed with secret. It's the hex encoded HMAC-SHA256
+// of the method, path and the sorted query without the signature,
+// separated by newlines.
+func Signature(secret []byte, method, path string, query url.Values) string {
+	q := make(url.Values, len(query))
+
+	for k, v := range query {
+		if k != SignSignature {
+			q[k] = v
+		}
+	}
+
+	if method == "HEAD" {
+		method = "GET"
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + path + "\n" + q.Encode()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ErrUploadPath is returned for the ref or prefix of a signed upload
+// with a slash. Uploaded files are named by their base name only, so
+// it could never match.
+var ErrUploadPath = errors.New("signed upload ref and prefix can't contain /")
+
+// UploadRef returns the ref a file named name is stored as by a signed
+// upload, which adds .bin if it has no extension. It's the form the ref
+// of an upload policy is signed and checked in.
+func UploadRef(name string) (string, error) {
+	if strings.Contains(name, "/") {
+		return "", ErrUploadPath
+	}
+
+	return blob.NewRefFilename(name).Path, nil
+}
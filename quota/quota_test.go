@@ -0,0 +1,172 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/simonz05/blobserver"
+	"github.com/simonz05/blobserver/blob"
+	"github.com/simonz05/blobserver/config"
+	"github.com/simonz05/blobserver/storagetest"
+	"github.com/simonz05/util/assert"
+)
+
+func tempStore(t *testing.T) (Store, string, func()) {
+	dir, err := ioutil.TempDir("", "quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "usage.json")
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store, path, func() { os.RemoveAll(dir) }
+}
+
+func TestFileStore(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestFileStore")
+	store, path, cleanup := tempStore(t)
+	defer cleanup()
+
+	ast.Nil(store.Add("a", Usage{Bytes: 10, Objects: 1}))
+	ast.Nil(store.Add("a", Usage{Bytes: -4, Objects: 1}))
+	ast.Nil(store.Set("", Usage{Bytes: 7, Objects: 3}))
+
+	// the file is locked while the store is open.
+	_, err := NewFileStore(path)
+	ast.True(err != nil)
+	ast.Nil(store.(io.Closer).Close())
+
+	// the usage survives a restart.
+	store, err = NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := store.Usage("a")
+	ast.Nil(err)
+	ast.Equal(Usage{Bytes: 6, Objects: 2}, u)
+	u, err = store.Usage("")
+	ast.Nil(err)
+	ast.Equal(Usage{Bytes: 7, Objects: 3}, u)
+	u, err = store.Usage("b")
+	ast.Nil(err)
+	ast.Equal(Usage{}, u)
+}
+
+func TestFileStoreFlush(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestFileStoreFlush")
+	store, path, cleanup := tempStore(t)
+	defer cleanup()
+
+	// the file is read directly since the store has it locked.
+	stored := func() Usage {
+		var usage map[string]Usage
+		data, _ := ioutil.ReadFile(path)
+		json.Unmarshal(data, &usage)
+		return usage["a"]
+	}
+
+	fs := store.(*fileStore)
+	fs.interval = 10 * time.Millisecond
+	ast.Nil(store.Add("a", Usage{Bytes: 1, Objects: 1}))
+
+	for deadline := time.Now().Add(time.Second); stored() != (Usage{Bytes: 1, Objects: 1}); {
+		if time.Now().After(deadline) {
+			t.Fatalf("usage not written: %+v", stored())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// adds are written together later, or on Close.
+	fs.interval = time.Hour
+	ast.Nil(store.Add("a", Usage{Bytes: 10, Objects: 1}))
+	ast.Nil(store.Add("a", Usage{Bytes: 5, Objects: 1}))
+	ast.Equal(Usage{Bytes: 1, Objects: 1}, stored())
+	ast.Nil(store.(io.Closer).Close())
+	ast.Equal(Usage{Bytes: 16, Objects: 3}, stored())
+}
+
+func receive(s *Storage, name, contents string) error {
+	_, err := s.ReceiveBlob(blob.NewRefFilename(name), strings.NewReader(contents))
+	return err
+}
+
+func TestStorage(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestStorage")
+	store, _, cleanup := tempStore(t)
+	defer cleanup()
+
+	sto := blobserver.NewContextStorage(storagetest.NewFakeStorage())
+	s := NewStorage(sto, store, "a", &config.QuotaConfig{Bytes: 10, Objects: 3})
+	usage := func() Usage {
+		u, err := s.Usage()
+		ast.Nil(err)
+		return u
+	}
+
+	ast.Nil(receive(s, "a.txt", "1234"))
+	ast.Equal(Usage{Bytes: 4, Objects: 1}, usage())
+
+	// replacing a blob counts the difference only.
+	ast.Nil(receive(s, "a.txt", "12"))
+	ast.Equal(Usage{Bytes: 2, Objects: 1}, usage())
+
+	// a blob larger than the room left fails and isn't stored.
+	ast.Equal(blobserver.ErrTooLarge, receive(s, "b.txt", "123456789"))
+	ast.Equal(Usage{Bytes: 2, Objects: 1}, usage())
+	_, err := blobserver.StatBlob(sto, blob.NewRefFilename("b.txt"))
+	ast.Equal(blobserver.ErrNotFound, err)
+
+	// exactly the room left fits.
+	ast.Nil(receive(s, "b.txt", "12345678"))
+	ast.Equal(Usage{Bytes: 10, Objects: 2}, usage())
+	ast.Equal(blobserver.ErrQuotaExceeded, receive(s, "c.txt", "1"))
+
+	ast.Nil(s.RemoveBlobs([]blob.Ref{blob.NewRefFilename("b.txt"), blob.NewRefFilename("missing.txt")}))
+	ast.Equal(Usage{Bytes: 2, Objects: 1}, usage())
+
+	ast.Nil(receive(s, "c.txt", "1"))
+	ast.Nil(receive(s, "d.txt", "1"))
+	ast.Equal(blobserver.ErrQuotaExceeded, receive(s, "e.txt", "1"))
+
+	// a replaced blob isn't a new object.
+	ast.Nil(receive(s, "d.txt", "12"))
+	ast.Equal(Usage{Bytes: 5, Objects: 3}, usage())
+}
+
+func TestReconcile(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestReconcile")
+	store, _, cleanup := tempStore(t)
+	defer cleanup()
+
+	sto := storagetest.NewFakeStorage()
+	ast.Nil(store.Set("a", Usage{Bytes: 100, Objects: 100}))
+
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		_, err := sto.ReceiveBlob(blob.NewRefFilename(name), strings.NewReader(name))
+		ast.Nil(err)
+	}
+
+	u, err := Reconcile(context.Background(), sto.(blobserver.BlobEnumerator), store, "a")
+	ast.Nil(err)
+	ast.Equal(Usage{Bytes: 15, Objects: 3}, u)
+
+	u, err = store.Usage("a")
+	ast.Nil(err)
+	ast.Equal(Usage{Bytes: 15, Objects: 3}, u)
+}
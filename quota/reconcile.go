@@ -0,0 +1,29 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package quota
+
+import (
+	"context"
+
+	"github.com/simonz05/blobserver"
+	"github.com/simonz05/blobserver/blob"
+)
+
+// Reconcile recomputes the usage of the namespace ns from the blobs
+// sto enumerates and replaces the usage in store with it. Blobs stored
+// or removed while it runs may be miscounted until the next run.
+func Reconcile(ctx context.Context, sto blobserver.BlobEnumerator, store Store, ns string) (u Usage, err error) {
+	err = sto.EnumerateBlobs(ctx, func(sb blob.SizedRef) error {
+		u.Bytes += int64(sb.Size)
+		u.Objects++
+		return nil
+	})
+
+	if err != nil {
+		return u, err
+	}
+
+	return u, store.Set(ns, u)
+}
@@ -0,0 +1,274 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package quota
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/simonz05/blobserver"
+	"github.com/simonz05/blobserver/blob"
+	"github.com/simonz05/blobserver/config"
+	"github.com/simonz05/util/log"
+	"github.com/simonz05/util/syncutil"
+)
+
+// Storage tracks the usage of the storage of a namespace as blobs are
+// received and removed, and enforces its quota. Uploads which would
+// take the namespace over its byte quota fail with ErrTooLarge, and
+// once it's used up, or the object quota is, with ErrQuotaExceeded.
+//
+// Uploads running at the same time are checked against the same usage,
+// so together they may go over the byte quota by up to their size.
+type Storage struct {
+	blobserver.ContextStorage
+	store Store
+	ns    string
+	quota config.QuotaConfig
+}
+
+// NewStorage returns sto with usage kept in store as the namespace ns.
+// The quota is optional.
+func NewStorage(sto blobserver.ContextStorage, store Store, ns string, quota *config.QuotaConfig) *Storage {
+	s := &Storage{ContextStorage: sto, store: store, ns: ns}
+
+	if quota != nil {
+		s.quota = *quota
+	}
+
+	return s
+}
+
+// Namespace returns the name of the namespace of s.
+func (s *Storage) Namespace() string {
+	return s.ns
+}
+
+// Quota returns the quota of s.
+func (s *Storage) Quota() config.QuotaConfig {
+	return s.quota
+}
+
+// Usage returns the current usage of s.
+func (s *Storage) Usage() (Usage, error) {
+	return s.store.Usage(s.ns)
+}
+
+func (s *Storage) ReceiveBlob(br blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	return s.ReceiveBlobContext(context.Background(), br, source)
+}
+
+func (s *Storage) ReceiveBlobContext(ctx context.Context, br blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	return s.receive(ctx, br, source, func(r io.Reader) (blob.SizedRef, error) {
+		return s.ContextStorage.ReceiveBlobContext(ctx, br, r)
+	})
+}
+
+func (s *Storage) ReceiveBlobOptions(ctx context.Context, br blob.Ref, source io.Reader, opts blob.Options) (blob.SizedRef, error) {
+	return s.receive(ctx, br, source, func(r io.Reader) (blob.SizedRef, error) {
+		return blobserver.ReceiveBlobOptions(ctx, s.ContextStorage, br, r, opts)
+	})
+}
+
+var errOverQuota = errors.New("over quota")
+
+// quotaReader reads up to n bytes and fails if the source has more.
+type quotaReader struct {
+	r    io.Reader
+	n    int64
+	over bool
+}
+
+func (r *quotaReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		var b [1]byte
+		n, err := r.r.Read(b[:])
+
+		if n > 0 {
+			r.over = true
+			return 0, errOverQuota
+		}
+
+		return 0, err
+	}
+
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+
+	n, err := r.r.Read(p)
+	r.n -= int64(n)
+	return n, err
+}
+
+func (s *Storage) receive(ctx context.Context, br blob.Ref, source io.Reader, put func(io.Reader) (blob.SizedRef, error)) (sb blob.SizedRef, err error) {
+	u, err := s.store.Usage(s.ns)
+
+	if err != nil {
+		log.Errorf("quota: usage of namespace %q: %v", s.ns, err)
+		return sb, blobserver.ErrBackendUnavailable
+	}
+
+	// a blob which is replaced frees its size.
+	old, exists, err := s.size(ctx, br)
+
+	if err != nil {
+		return sb, err
+	}
+
+	if !exists && s.quota.Objects > 0 && u.Objects >= s.quota.Objects {
+		return sb, blobserver.ErrQuotaExceeded
+	}
+
+	var qr *quotaReader
+
+	if s.quota.Bytes > 0 {
+		room := s.quota.Bytes - u.Bytes + old
+
+		if room <= 0 {
+			return sb, blobserver.ErrQuotaExceeded
+		}
+
+		qr = &quotaReader{r: source, n: room}
+		source = qr
+	}
+
+	sb, err = put(source)
+
+	if qr != nil && qr.over {
+		return sb, blobserver.ErrTooLarge
+	}
+
+	if err != nil {
+		return sb, err
+	}
+
+	d := Usage{Bytes: int64(sb.Size) - old}
+
+	if !exists {
+		d.Objects = 1
+	}
+
+	s.add(d)
+	return sb, nil
+}
+
+// add adds d to the usage. A failure is logged only, since the blobs
+// are stored or removed already. Reconcile corrects the usage then.
+func (s *Storage) add(d Usage) {
+	if d == (Usage{}) {
+		return
+	}
+
+	if err := s.store.Add(s.ns, d); err != nil {
+		log.Errorf("quota: add %+v to namespace %q: %v", d, s.ns, err)
+	}
+}
+
+// size returns the size of the blob br and whether it exists.
+func (s *Storage) size(ctx context.Context, br blob.Ref) (int64, bool, error) {
+	dest := make(chan blob.SizedInfoRef, 1)
+
+	if err := s.StatBlobsContext(ctx, dest, []blob.Ref{br}); err != nil {
+		return 0, false, err
+	}
+
+	select {
+	case sb := <-dest:
+		return int64(sb.Size), true, nil
+	default:
+		return 0, false, nil
+	}
+}
+
+// statGate limits the stats made to find the sizes of removed blobs.
+var statGate = syncutil.NewGate(20) // arbitrary
+
+// sizes returns the sizes of the blobs which exist, keyed by their
+// index in blobs.
+func (s *Storage) sizes(ctx context.Context, blobs []blob.Ref) (map[int]int64, error) {
+	var (
+		wg    syncutil.Group
+		mu    sync.Mutex
+		sizes = make(map[int]int64)
+	)
+
+	for i, br := range blobs {
+		i, br := i, br
+
+		if err := statGate.StartContext(ctx); err != nil {
+			wg.Go(func() error { return err })
+			break
+		}
+
+		wg.Go(func() error {
+			defer statGate.Done()
+			size, ok, err := s.size(ctx, br)
+
+			if ok {
+				mu.Lock()
+				sizes[i] = size
+				mu.Unlock()
+			}
+
+			return err
+		})
+	}
+
+	return sizes, wg.Err()
+}
+
+func (s *Storage) RemoveBlobs(blobs []blob.Ref) error {
+	return s.RemoveBlobsContext(context.Background(), blobs)
+}
+
+func (s *Storage) RemoveBlobsContext(ctx context.Context, blobs []blob.Ref) error {
+	before, err := s.sizes(ctx, blobs)
+
+	if err != nil {
+		return err
+	}
+
+	err = s.ContextStorage.RemoveBlobsContext(ctx, blobs)
+	removed := before
+
+	// some blobs may be removed. Those still there are kept counted.
+	if err != nil && len(before) > 0 {
+		existing := make([]blob.Ref, 0, len(before))
+		index := make([]int, 0, len(before))
+
+		for i := range before {
+			existing = append(existing, blobs[i])
+			index = append(index, i)
+		}
+
+		after, serr := s.sizes(context.Background(), existing)
+
+		if serr != nil {
+			log.Errorf("quota: stat removed blobs: %v", serr)
+			return err
+		}
+
+		removed = make(map[int]int64)
+
+		for j, i := range index {
+			if _, ok := after[j]; !ok {
+				removed[i] = before[i]
+			}
+		}
+	}
+
+	var d Usage
+
+	for _, size := range removed {
+		d.Bytes -= size
+		d.Objects--
+	}
+
+	s.add(d)
+	return err
+}
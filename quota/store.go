@@ -0,0 +1,286 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package quota tracks the usage of the storages of a blobserver and
+// enforces their quotas.
+package quota
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/simonz05/blobserver/config"
+	"github.com/simonz05/util/kvstore"
+	"github.com/simonz05/util/log"
+)
+
+// Usage is what a namespace stores.
+type Usage struct {
+	Bytes   int64 `json:"bytes"`
+	Objects int64 `json:"objects"`
+}
+
+// Store keeps the usage of namespaces. The namespace at the API root
+// is named "".
+type Store interface {
+	Usage(ns string) (Usage, error)
+	// Add adds d, which may be negative, to the usage of ns.
+	Add(ns string, d Usage) error
+	Set(ns string, u Usage) error
+}
+
+const defaultPrefix = "blobserver:usage"
+
+// NewStore returns the store configured by conf.
+func NewStore(conf *config.UsageConfig) (Store, error) {
+	switch {
+	case conf.Redis != "":
+		prefix := conf.Prefix
+
+		if prefix == "" {
+			prefix = defaultPrefix
+		}
+
+		db, err := kvstore.Open(conf.Redis)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &redisStore{db: db, prefix: prefix}, nil
+	case conf.File != "":
+		return NewFileStore(conf.File)
+	}
+
+	return nil, fmt.Errorf("quota: usage needs redis or file")
+}
+
+// redisStore keeps usage in a Redis hash per namespace.
+type redisStore struct {
+	db     *kvstore.KVStore
+	prefix string
+}
+
+func (s *redisStore) key(ns string) string {
+	if ns == "" {
+		return s.prefix
+	}
+	return s.prefix + ":" + ns
+}
+
+func (s *redisStore) Usage(ns string) (u Usage, err error) {
+	conn := s.db.Get()
+	defer conn.Close()
+	m, err := redis.Int64Map(conn.Do("HGETALL", s.key(ns)))
+
+	if err != nil {
+		return u, err
+	}
+
+	return Usage{Bytes: m["bytes"], Objects: m["objects"]}, nil
+}
+
+func (s *redisStore) Add(ns string, d Usage) error {
+	conn := s.db.Get()
+	defer conn.Close()
+	key := s.key(ns)
+	conn.Send("MULTI")
+	conn.Send("HINCRBY", key, "bytes", d.Bytes)
+	conn.Send("HINCRBY", key, "objects", d.Objects)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+func (s *redisStore) Set(ns string, u Usage) error {
+	conn := s.db.Get()
+	defer conn.Close()
+	_, err := conn.Do("HMSET", s.key(ns), "bytes", u.Bytes, "objects", u.Objects)
+	return err
+}
+
+// defaultFlushInterval is how long changes added to a file store may
+// wait to be written.
+const defaultFlushInterval = time.Second
+
+// fileStore keeps usage in memory and writes it to a JSON file. Added
+// usage is written at most once per interval, so uploads don't each
+// rewrite the file, and set usage at once. Close writes what's left.
+//
+// The usage in memory is written over the file, so only one store may
+// have the file open. It's locked until Close.
+type fileStore struct {
+	path     string
+	interval time.Duration
+	lock     *os.File // nil once closed
+
+	mu      sync.Mutex
+	usage   map[string]Usage
+	pending *time.Timer // nil unless there are changes to write
+}
+
+// NewFileStore returns a store kept in the file at path, which is
+// created if it doesn't exist. It fails if another store, such as the
+// one of a running server, has the file open.
+func NewFileStore(path string) (Store, error) {
+	lock, err := lockFile(path + ".lock")
+
+	if err != nil {
+		return nil, err
+	}
+
+	s := &fileStore{path: path, interval: defaultFlushInterval, lock: lock, usage: make(map[string]Usage)}
+	data, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+
+	if err == nil {
+		if err = json.Unmarshal(data, &s.usage); err != nil {
+			err = fmt.Errorf("quota: %s: %v", path, err)
+		}
+	}
+
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// lockFile opens the file at path and locks it, or fails if it's
+// locked already.
+func lockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("quota: %s is locked; is the server running?", path)
+		}
+
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (s *fileStore) Usage(ns string) (Usage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.usage[ns], nil
+}
+
+func (s *fileStore) Add(ns string, d Usage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.usage[ns]
+	u.Bytes += d.Bytes
+	u.Objects += d.Objects
+	s.usage[ns] = u
+
+	if s.pending == nil {
+		s.pending = time.AfterFunc(s.interval, s.flush)
+	}
+
+	return nil
+}
+
+func (s *fileStore) Set(ns string, u Usage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.usage[ns] = u
+	s.stop()
+	return s.save()
+}
+
+// Close writes the changes which are pending and unlocks the file.
+func (s *fileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+
+	if s.pending != nil {
+		s.stop()
+		err = s.save()
+	}
+
+	if s.lock != nil {
+		s.lock.Close()
+		s.lock = nil
+	}
+
+	return err
+}
+
+// flush writes the changes which are pending. It's retried until the
+// write succeeds.
+func (s *fileStore) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// written by Set or Close in the meantime.
+	if s.pending == nil {
+		return
+	}
+
+	s.pending = nil
+
+	if err := s.save(); err != nil {
+		log.Errorf("quota: write usage to %s: %v", s.path, err)
+		s.pending = time.AfterFunc(s.interval, s.flush)
+	}
+}
+
+func (s *fileStore) stop() {
+	if s.pending != nil {
+		s.pending.Stop()
+		s.pending = nil
+	}
+}
+
+// save writes the usage to a temporary file which replaces the store
+// file, so a crash leaves either the old or the new usage.
+func (s *fileStore) save() error {
+	data, err := json.Marshal(s.usage)
+
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(data); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), s.path)
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
@@ -48,3 +48,27 @@ func CreateStorage(config *config.Config) (Storage, error) {
 	}
 	return ctor(config)
 }
+
+// CreateNamespaceStorages returns the storages of the namespaces of
+// config, keyed by name.
+func CreateNamespaceStorages(config *config.Config) (map[string]Storage, error) {
+	storages := make(map[string]Storage, len(config.Namespaces))
+
+	for i := range config.Namespaces {
+		ns := &config.Namespaces[i]
+
+		if _, ok := storages[ns.Name]; ok {
+			return nil, fmt.Errorf("Namespace %s configured twice", ns.Name)
+		}
+
+		sto, err := CreateStorage(config.Namespace(ns))
+
+		if err != nil {
+			return nil, fmt.Errorf("Namespace %s: %v", ns.Name, err)
+		}
+
+		storages[ns.Name] = sto
+	}
+
+	return storages, nil
+}
@@ -0,0 +1,46 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package s3
+
+import (
+	"context"
+
+	"github.com/simonz05/blobserver/blob"
+)
+
+// listPage is how many keys are listed per request.
+const listPage = 1000
+
+func (sto *s3Storage) EnumerateBlobs(ctx context.Context, fn func(blob.SizedRef) error) error {
+	var after string
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		items, err := sto.s3Client.ListBucket(sto.bucket, after, listPage)
+
+		if err != nil {
+			return translateError(err)
+		}
+
+		for _, it := range items {
+			if it.Key == after {
+				continue
+			}
+
+			if err := fn(blob.SizedRef{Ref: blob.Ref{Path: it.Key}, Size: uint32(it.Size)}); err != nil {
+				return err
+			}
+
+			after = it.Key
+		}
+
+		if len(items) < listPage {
+			return nil
+		}
+	}
+}
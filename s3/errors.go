@@ -0,0 +1,56 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package s3
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/simonz05/blobserver"
+	"github.com/simonz05/util/amazon/s3"
+	"github.com/simonz05/util/log"
+)
+
+// translateError maps errors from the S3 client to the blobserver
+// error vocabulary. Errors without a counterpart are returned as is.
+func translateError(err error) error {
+	switch err := err.(type) {
+	case nil:
+		return nil
+	case *url.Error:
+		// the request was cancelled through its context
+		if err.Err == context.Canceled || err.Err == context.DeadlineExceeded {
+			return err.Err
+		}
+		log.Errorf("s3: %v", err)
+		return blobserver.ErrBackendUnavailable
+	case *s3.Error:
+		switch err.StatusCode {
+		case http.StatusNotFound:
+			return blobserver.ErrNotFound
+		case http.StatusConflict:
+			return blobserver.ErrAlreadyExists
+		case http.StatusRequestEntityTooLarge:
+			return blobserver.ErrTooLarge
+		case http.StatusPreconditionFailed:
+			return blobserver.ErrPreconditionFailed
+		case http.StatusInternalServerError, http.StatusServiceUnavailable:
+			log.Errorf("s3: %v", err)
+			return blobserver.ErrBackendUnavailable
+		}
+	case net.Error:
+		log.Errorf("s3: %v", err)
+		return blobserver.ErrBackendUnavailable
+	}
+
+	if err == os.ErrNotExist {
+		return blobserver.ErrNotFound
+	}
+
+	return err
+}
@@ -18,12 +18,31 @@ limitations under the License.
 package s3
 
 import (
+	"context"
 	"io"
+	"time"
 
+	"github.com/simonz05/blobserver"
 	"github.com/simonz05/blobserver/blob"
 )
 
 func (sto *s3Storage) Fetch(blob blob.Ref) (file io.ReadCloser, size uint32, err error) {
-	file, sz, err := sto.s3Client.Get(sto.bucket, blob.String())
-	return file, uint32(sz), err
+	return sto.FetchContext(context.Background(), blob)
+}
+
+func (sto *s3Storage) FetchContext(ctx context.Context, blob blob.Ref) (file io.ReadCloser, size uint32, err error) {
+	file, sz, err := sto.s3Client.GetContext(ctx, sto.bucket, blob.String())
+	return file, uint32(sz), translateError(err)
+}
+
+// SignedURL returns a presigned GET URL of the blob, or its CDN URL,
+// as configured by redirect.
+func (sto *s3Storage) SignedURL(ctx context.Context, blob blob.Ref) (string, error) {
+	switch sto.redirect {
+	case redirectPresign:
+		return sto.s3Client.PresignedGetURL(sto.bucket, blob.String(), time.Now().Add(sto.redirectExpiry)), nil
+	case redirectCDN:
+		return sto.cdnUrl + blob.Path, nil
+	}
+	return "", blobserver.ErrNoSignedURL
 }
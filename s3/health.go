@@ -0,0 +1,19 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package s3
+
+import (
+	"context"
+	"fmt"
+)
+
+// CheckHealth checks that the bucket can be reached with the
+// configured credentials.
+func (sto *s3Storage) CheckHealth(ctx context.Context) error {
+	if err := sto.s3Client.HeadBucket(ctx, sto.bucket); err != nil {
+		return fmt.Errorf("s3: bucket %s: %v", sto.bucket, err)
+	}
+	return nil
+}
@@ -19,6 +19,7 @@ package s3
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"hash"
 	"io"
@@ -96,17 +97,32 @@ func (as *amazonSlurper) Cleanup() {
 }
 
 func (sto *s3Storage) ReceiveBlob(b blob.Ref, source io.Reader) (sr blob.SizedRef, err error) {
+	return sto.ReceiveBlobContext(context.Background(), b, source)
+}
+
+func (sto *s3Storage) ReceiveBlobContext(ctx context.Context, b blob.Ref, source io.Reader) (sr blob.SizedRef, err error) {
+	return sto.ReceiveBlobOptions(ctx, b, source, blob.Options{})
+}
+
+// ReceiveBlobOptions stores the blob with opts applied over the options
+// from the storage config.
+func (sto *s3Storage) ReceiveBlobOptions(ctx context.Context, b blob.Ref, source io.Reader, opts blob.Options) (sr blob.SizedRef, err error) {
+	opts = sto.options.Merge(opts)
+	if err = checkOptions(opts); err != nil {
+		return
+	}
+
 	slurper := newAmazonSlurper(b)
 	defer slurper.Cleanup()
 
-	size, err := io.Copy(slurper, source)
+	size, err := io.Copy(slurper, blobserver.NewContextReader(ctx, source))
 	if err != nil {
 		return sr, err
 	}
 
-	err = sto.s3Client.PutObject(b.String(), sto.bucket, slurper.md5, size, slurper)
+	err = sto.s3Client.PutObjectOptions(ctx, b.String(), sto.bucket, slurper.md5, size, slurper, putOptions(opts))
 	if err != nil {
-		return sr, err
+		return sr, translateError(err)
 	}
 	b.SetHash(slurper.md5)
 	return blob.SizedRef{Ref: b, Size: uint32(size)}, nil
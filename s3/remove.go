@@ -18,6 +18,8 @@ limitations under the License.
 package s3
 
 import (
+	"context"
+
 	"github.com/simonz05/blobserver/blob"
 	"github.com/simonz05/util/syncutil"
 )
@@ -25,16 +27,22 @@ import (
 var removeGate = syncutil.NewGate(20) // arbitrary
 
 func (sto *s3Storage) RemoveBlobs(blobs []blob.Ref) error {
+	return sto.RemoveBlobsContext(context.Background(), blobs)
+}
+
+func (sto *s3Storage) RemoveBlobsContext(ctx context.Context, blobs []blob.Ref) error {
 	var wg syncutil.Group
 
 	for _, blob := range blobs {
 		blob := blob
-		removeGate.Start()
+		if err := removeGate.StartContext(ctx); err != nil {
+			wg.Go(func() error { return err })
+			break
+		}
 		wg.Go(func() error {
 			defer removeGate.Done()
-			return sto.s3Client.Delete(sto.bucket, blob.String())
+			return translateError(sto.s3Client.DeleteContext(ctx, sto.bucket, blob.String()))
 		})
 	}
 	return wg.Err()
-
 }
@@ -23,8 +23,11 @@ package s3
 import (
 	"fmt"
 	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/simonz05/blobserver"
+	"github.com/simonz05/blobserver/blob"
 	"github.com/simonz05/blobserver/config"
 	"github.com/simonz05/util/amazon/s3"
 )
@@ -34,6 +37,57 @@ type s3Storage struct {
 	bucket   string
 	hostname string
 	cdnUrl   string
+	options  blob.Options // defaults for ReceiveBlob
+
+	redirect       string // redirectPresign, redirectCDN or none
+	redirectExpiry time.Duration
+}
+
+const (
+	redirectPresign = "presign"
+	redirectCDN     = "cdn"
+
+	defaultRedirectExpiry = 5 * time.Minute
+)
+
+var storageClasses = map[string]bool{
+	"STANDARD":            true,
+	"REDUCED_REDUNDANCY":  true,
+	"STANDARD_IA":         true,
+	"ONEZONE_IA":          true,
+	"INTELLIGENT_TIERING": true,
+	"GLACIER":             true,
+	"GLACIER_IR":          true,
+	"DEEP_ARCHIVE":        true,
+}
+
+// checkOptions returns ErrInvalidOptions unless S3 accepts opts.
+func checkOptions(opts blob.Options) error {
+	if opts.StorageClass != "" && !storageClasses[opts.StorageClass] {
+		return blobserver.ErrInvalidOptions
+	}
+
+	switch opts.ServerSideEncryption {
+	case "", "AES256":
+		if opts.KMSKeyID != "" {
+			return blobserver.ErrInvalidOptions
+		}
+	case "aws:kms":
+	default:
+		return blobserver.ErrInvalidOptions
+	}
+
+	return nil
+}
+
+func putOptions(opts blob.Options) *s3.PutOptions {
+	return &s3.PutOptions{
+		CacheControl:         opts.CacheControl,
+		ContentDisposition:   opts.ContentDisposition,
+		StorageClass:         opts.StorageClass,
+		ServerSideEncryption: opts.ServerSideEncryption,
+		SSEKMSKeyID:          opts.KMSKeyID,
+	}
 }
 
 func (s *s3Storage) String() string {
@@ -50,26 +104,91 @@ func (s *s3Storage) Config() *blobserver.Config {
 func newFromConfig(config *config.Config) (blobserver.Storage, error) {
 	s3conf := config.S3
 	hostname := s3conf.Hostname
+	scheme := "https"
+
+	if s3conf.DisableTLS {
+		scheme = "http"
+	}
+
+	if s3conf.Endpoint != "" {
+		u, err := url.Parse(s3conf.Endpoint)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("s3: invalid endpoint %q", s3conf.Endpoint)
+		}
+		hostname = u.Host
+		scheme = u.Scheme
+	}
 
 	if hostname == "" {
 		hostname = "s3.amazonaws.com"
+		if s3conf.Region != "" && s3conf.Region != "us-east-1" {
+			hostname = "s3." + s3conf.Region + ".amazonaws.com"
+		}
+	}
+
+	sigVersion := s3conf.SignatureVersion
+
+	switch sigVersion {
+	case 0:
+		// configs written before signature version 4 was supported
+		// name no region, and may name a regional hostname whose
+		// region would be unknown.
+		sigVersion = 2
+
+		if s3conf.Region != "" {
+			sigVersion = 4
+		}
+	case 2, 4:
+	default:
+		return nil, fmt.Errorf("s3: unsupported signature version %d", sigVersion)
 	}
 
 	client := &s3.Client{
 		Auth: &s3.Auth{
-			AccessKey:       s3conf.AccessKey,
-			SecretAccessKey: s3conf.SecretAccessKey,
-			Hostname:        hostname,
+			AccessKey:        s3conf.AccessKey,
+			SecretAccessKey:  s3conf.SecretAccessKey,
+			Hostname:         hostname,
+			Region:           s3conf.Region,
+			SignatureVersion: sigVersion,
 		},
 		HTTPClient: http.DefaultClient,
 		DefaultACL: s3conf.DefaultACL,
+		Scheme:     scheme,
+		PathStyle:  s3conf.PathStyle,
 	}
 	sto := &s3Storage{
 		s3Client: client,
 		bucket:   s3conf.Bucket,
 		hostname: hostname,
 		cdnUrl:   s3conf.CDNUrl,
+		options: blob.Options{
+			CacheControl:         s3conf.CacheControl,
+			ContentDisposition:   s3conf.ContentDisposition,
+			StorageClass:         s3conf.StorageClass,
+			ServerSideEncryption: s3conf.ServerSideEncryption,
+			KMSKeyID:             s3conf.SSEKMSKeyID,
+		},
 	}
+
+	switch sto.redirect = s3conf.Redirect; sto.redirect {
+	case "", redirectPresign:
+	case redirectCDN:
+		if sto.cdnUrl == "" {
+			return nil, fmt.Errorf("s3: redirect %s needs cdn_url", redirectCDN)
+		}
+	default:
+		return nil, fmt.Errorf("s3: redirect must be %s or %s, got %q", redirectPresign, redirectCDN, s3conf.Redirect)
+	}
+
+	if sto.redirectExpiry = s3conf.RedirectExpiry.Duration; sto.redirectExpiry == 0 {
+		sto.redirectExpiry = defaultRedirectExpiry
+	}
+
+	if err := checkOptions(sto.options); err != nil {
+		return nil, fmt.Errorf("s3: %v: storage_class %q, server_side_encryption %q, sse_kms_key_id %q",
+			err, s3conf.StorageClass, s3conf.ServerSideEncryption, s3conf.SSEKMSKeyID)
+	}
+
 	return sto, nil
 }
 
@@ -0,0 +1,713 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package s3test implements a fake S3 server for testing the S3
+// client and storage without Amazon.
+//
+// The server keeps buckets in memory and supports signed PUT, GET,
+// HEAD and DELETE of objects, presigned URLs, bucket creation and
+// listing, and multipart uploads. Buckets are addressed either by
+// subdomain of Hostname or by the first path element.
+package s3test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simonz05/util/amazon/s3"
+)
+
+const (
+	// Hostname is the S3 hostname served by the fake server. Clients
+	// must dial the server through Server.Client.
+	Hostname = "s3.test"
+
+	// AccessKey and SecretAccessKey are the credentials accepted by
+	// the server.
+	AccessKey       = "s3test"
+	SecretAccessKey = "s3test-secret"
+
+	// Region is the region Signature Version 4 requests must be
+	// signed for.
+	Region = "us-east-1"
+)
+
+// Server is a fake S3 server.
+type Server struct {
+	URL string
+
+	srv *httptest.Server
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	uploads map[string]*upload
+	nextID  int
+	status  int
+	delay   time.Duration
+}
+
+type bucket struct {
+	name    string
+	created time.Time
+	objects map[string]*object
+}
+
+type object struct {
+	data    []byte
+	etag    string
+	modTime time.Time
+	header  http.Header // stored request headers returned on GET and HEAD
+}
+
+type upload struct {
+	bucket string
+	key    string
+	header http.Header
+	parts  map[int]*object
+}
+
+// NewServer starts a fake S3 server. The server should be closed with
+// Close when done.
+func NewServer() *Server {
+	s := &Server{
+		buckets: make(map[string]*bucket),
+		uploads: make(map[string]*upload),
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close shuts the server down.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Client returns an http.Client which sends requests for any host to
+// the server, so that bucket subdomains of Hostname reach it.
+func (s *Server) Client() *http.Client {
+	addr := s.srv.Listener.Addr().String()
+	dialer := &net.Dialer{}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+}
+
+// NewClient returns an S3 client for the server which signs requests
+// with Signature Version 4.
+func (s *Server) NewClient() *s3.Client {
+	return &s3.Client{
+		Auth: &s3.Auth{
+			AccessKey:        AccessKey,
+			SecretAccessKey:  SecretAccessKey,
+			Hostname:         Hostname,
+			Region:           Region,
+			SignatureVersion: 4,
+		},
+		HTTPClient: s.Client(),
+	}
+}
+
+// CreateBucket creates an empty bucket.
+func (s *Server) CreateBucket(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.createBucket(name)
+}
+
+func (s *Server) createBucket(name string) {
+	if _, ok := s.buckets[name]; !ok {
+		s.buckets[name] = &bucket{
+			name:    name,
+			created: time.Now().UTC(),
+			objects: make(map[string]*object),
+		}
+	}
+}
+
+// SetStatus makes the server answer every request with the HTTP
+// status code, such as 503, until it is reset with 0.
+func (s *Server) SetStatus(code int) {
+	s.mu.Lock()
+	s.status = code
+	s.mu.Unlock()
+}
+
+// SetDelay makes the server wait d before answering a request. The
+// wait ends early if the client goes away.
+func (s *Server) SetDelay(d time.Duration) {
+	s.mu.Lock()
+	s.delay = d
+	s.mu.Unlock()
+}
+
+// s3Error is an error response in the format used by S3.
+type s3Error struct {
+	XMLName   xml.Name `xml:"Error"`
+	status    int
+	Code      string
+	Message   string
+	Resource  string
+	RequestID string `xml:"RequestId"`
+}
+
+func fail(status int, code, format string, args ...interface{}) *s3Error {
+	return &s3Error{
+		status:  status,
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	status, delay := s.status, s.delay
+	s.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return
+		}
+	}
+
+	var err *s3Error
+
+	if status != 0 {
+		err = fail(status, http.StatusText(status), "injected failure")
+	} else {
+		err = s.handle(w, req)
+	}
+
+	if err != nil {
+		err.Resource = req.URL.Path
+		s.mu.Lock()
+		s.nextID++
+		err.RequestID = fmt.Sprintf("%016X", s.nextID)
+		s.mu.Unlock()
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(err.status)
+		if req.Method != "HEAD" {
+			xml.NewEncoder(w).Encode(err)
+		}
+	}
+}
+
+// bucketKey splits the request into its bucket and object key.
+func bucketKey(req *http.Request) (string, string) {
+	host := req.Host
+	if i := strings.LastIndex(host, ":"); i != -1 {
+		host = host[:i]
+	}
+
+	p := strings.TrimPrefix(req.URL.Path, "/")
+
+	if strings.HasSuffix(host, "."+Hostname) {
+		return strings.TrimSuffix(host, "."+Hostname), p
+	}
+
+	// path-style
+	if i := strings.Index(p, "/"); i != -1 {
+		return p[:i], p[i+1:]
+	}
+
+	return p, ""
+}
+
+// maxSkew is how far the signing time of a Signature Version 4
+// request may be off.
+const maxSkew = 15 * time.Minute
+
+// checkSignature signs a copy of req, with Signature Version 2 or 4
+// as the client did, and compares the result. It signs with the same
+// s3.Auth as the client, so it catches requests which don't match what
+// was signed but not mistakes in signing itself. Those are caught by
+// the tests against the AWS examples in the s3 package.
+func (s *Server) checkSignature(req *http.Request) *s3Error {
+	got := req.Header.Get("Authorization")
+	q := req.URL.Query()
+
+	if got == "" && (q.Get("X-Amz-Signature") != "" || q.Get("Signature") != "") {
+		return checkPresigned(req)
+	}
+
+	if got == "" {
+		return fail(http.StatusForbidden, "AccessDenied", "Anonymous access is forbidden")
+	}
+
+	auth := &s3.Auth{
+		AccessKey:       AccessKey,
+		SecretAccessKey: SecretAccessKey,
+		Hostname:        Hostname,
+	}
+
+	signed := &http.Request{
+		Method: req.Method,
+		URL:    req.URL,
+		Host:   req.Host,
+		Header: make(http.Header),
+	}
+
+	switch {
+	case strings.HasPrefix(got, "AWS4-HMAC-SHA256 "):
+		params := make(map[string]string)
+		for _, p := range strings.Split(strings.TrimPrefix(got, "AWS4-HMAC-SHA256 "), ",") {
+			if kv := strings.SplitN(strings.TrimSpace(p), "=", 2); len(kv) == 2 {
+				params[kv[0]] = kv[1]
+			}
+		}
+
+		scope := strings.Split(params["Credential"], "/")
+
+		if len(scope) != 5 || scope[0] != AccessKey {
+			return fail(http.StatusForbidden, "InvalidAccessKeyId", "The AWS Access Key Id you provided does not exist in our records.")
+		}
+
+		if scope[2] != Region {
+			return fail(http.StatusBadRequest, "AuthorizationHeaderMalformed", "the region '%s' is wrong; expecting '%s'", scope[2], Region)
+		}
+
+		date, err := time.Parse("20060102T150405Z", req.Header.Get("X-Amz-Date"))
+
+		if err != nil || time.Since(date) > maxSkew || time.Until(date) > maxSkew {
+			return fail(http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the current time is too large.")
+		}
+
+		auth.Region = Region
+		auth.SignatureVersion = 4
+
+		for _, k := range strings.Split(params["SignedHeaders"], ";") {
+			if k = http.CanonicalHeaderKey(k); k != "Host" {
+				signed.Header[k] = req.Header[k]
+			}
+		}
+	case strings.HasPrefix(got, "AWS "+AccessKey+":"):
+		// path-style requests are signed without the bucket in the
+		// hostname.
+		if bucket, _ := bucketKey(req); !strings.HasPrefix(req.Host, bucket+"."+Hostname) {
+			auth.Hostname = req.Host
+		}
+
+		for k, v := range req.Header {
+			if k != "Authorization" {
+				signed.Header[k] = v
+			}
+		}
+	default:
+		return fail(http.StatusForbidden, "InvalidAccessKeyId", "The AWS Access Key Id you provided does not exist in our records.")
+	}
+
+	auth.SignRequest(signed)
+
+	if signed.Header.Get("Authorization") != got {
+		return fail(http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided.")
+	}
+
+	return nil
+}
+
+// checkPresigned checks a request authorized by query parameters like
+// checkSignature does for the Authorization header.
+func checkPresigned(req *http.Request) *s3Error {
+	q := req.URL.Query()
+	auth := &s3.Auth{
+		AccessKey:       AccessKey,
+		SecretAccessKey: SecretAccessKey,
+		Hostname:        Hostname,
+	}
+
+	var got string
+	var expires time.Time
+
+	if got = q.Get("X-Amz-Signature"); got != "" {
+		date, err := time.Parse("20060102T150405Z", q.Get("X-Amz-Date"))
+		ttl, _ := strconv.Atoi(q.Get("X-Amz-Expires"))
+
+		if err != nil || !strings.HasPrefix(q.Get("X-Amz-Credential"), AccessKey+"/") {
+			return fail(http.StatusForbidden, "AccessDenied", "Invalid presigned URL")
+		}
+
+		auth.Region = Region
+		auth.SignatureVersion = 4
+		expires = date.Add(time.Duration(ttl) * time.Second)
+	} else {
+		got = q.Get("Signature")
+		sec, err := strconv.ParseInt(q.Get("Expires"), 10, 64)
+
+		if err != nil || q.Get("AWSAccessKeyId") != AccessKey {
+			return fail(http.StatusForbidden, "AccessDenied", "Invalid presigned URL")
+		}
+
+		if bucket, _ := bucketKey(req); !strings.HasPrefix(req.Host, bucket+"."+Hostname) {
+			auth.Hostname = req.Host
+		}
+
+		expires = time.Unix(sec, 0)
+	}
+
+	if time.Now().After(expires) {
+		return fail(http.StatusForbidden, "AccessDenied", "Request has expired")
+	}
+
+	u := *req.URL
+	signed := &http.Request{Method: req.Method, URL: &u, Host: req.Host}
+	auth.PresignRequest(signed, expires)
+
+	if sigParam(signed.URL.Query()) != got {
+		return fail(http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided.")
+	}
+
+	return nil
+}
+
+func sigParam(q map[string][]string) string {
+	if v := q["X-Amz-Signature"]; len(v) > 0 {
+		return v[0]
+	}
+	if v := q["Signature"]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (s *Server) handle(w http.ResponseWriter, req *http.Request) *s3Error {
+	if err := s.checkSignature(req); err != nil {
+		return err
+	}
+
+	bucketName, key := bucketKey(req)
+	q := req.URL.Query()
+
+	if bucketName == "" {
+		return fail(http.StatusNotImplemented, "NotImplemented", "Listing buckets is not implemented")
+	}
+
+	var body []byte
+
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return fail(http.StatusBadRequest, "IncompleteBody", "%v", err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key == "" {
+		switch req.Method {
+		case "PUT":
+			s.createBucket(bucketName)
+			return nil
+		case "GET":
+			b, ok := s.buckets[bucketName]
+			if !ok {
+				return fail(http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+			}
+			return s.listBucket(w, b, q.Get("prefix"), q.Get("marker"), q.Get("max-keys"))
+		case "HEAD":
+			if _, ok := s.buckets[bucketName]; !ok {
+				return fail(http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+			}
+			return nil
+		}
+		return fail(http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+	}
+
+	b, ok := s.buckets[bucketName]
+
+	if !ok {
+		return fail(http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+	}
+
+	switch {
+	case req.Method == "POST" && hasParam(q, "uploads"):
+		return s.initiateUpload(w, b, key, req.Header)
+	case req.Method == "PUT" && q.Get("uploadId") != "":
+		return s.uploadPart(w, q.Get("uploadId"), q.Get("partNumber"), req.Header, body)
+	case req.Method == "POST" && q.Get("uploadId") != "":
+		return s.completeUpload(w, b, key, q.Get("uploadId"), body)
+	case req.Method == "DELETE" && q.Get("uploadId") != "":
+		if _, ok := s.uploads[q.Get("uploadId")]; !ok {
+			return fail(http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		}
+		delete(s.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	switch req.Method {
+	case "PUT":
+		obj, err := newObject(req.Header, body)
+		if err != nil {
+			return err
+		}
+		b.objects[key] = obj
+		w.Header().Set("ETag", `"`+obj.etag+`"`)
+		return nil
+	case "GET", "HEAD":
+		obj, ok := b.objects[key]
+		if !ok {
+			return fail(http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		}
+		h := w.Header()
+		for k, v := range obj.header {
+			h[k] = v
+		}
+		h.Set("ETag", `"`+obj.etag+`"`)
+		h.Set("Last-Modified", obj.modTime.Format(http.TimeFormat))
+		h.Set("Content-Length", strconv.Itoa(len(obj.data)))
+		if req.Method == "GET" {
+			w.Write(obj.data)
+		}
+		return nil
+	case "DELETE":
+		delete(b.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	return fail(http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+}
+
+func hasParam(q map[string][]string, name string) bool {
+	_, ok := q[name]
+	return ok
+}
+
+// storedHeader reports whether the request header is stored with an
+// object and returned when it is read.
+func storedHeader(k string) bool {
+	switch k {
+	case "Content-Type", "Cache-Control", "Content-Disposition", "Content-Encoding":
+		return true
+	}
+	return strings.HasPrefix(k, "X-Amz-") && k != "X-Amz-Date" && k != "X-Amz-Content-Sha256"
+}
+
+func newObject(header http.Header, data []byte) (*object, *s3Error) {
+	sum := md5.Sum(data)
+
+	if want := header.Get("Content-MD5"); want != "" {
+		if want != base64.StdEncoding.EncodeToString(sum[:]) {
+			return nil, fail(http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received.")
+		}
+	}
+
+	obj := &object{
+		data:    data,
+		etag:    hex.EncodeToString(sum[:]),
+		modTime: time.Now().UTC(),
+		header:  make(http.Header),
+	}
+
+	for k, v := range header {
+		if storedHeader(k) {
+			obj.header[k] = v
+		}
+	}
+
+	if obj.header.Get("Content-Type") == "" {
+		obj.header.Set("Content-Type", "binary/octet-stream")
+	}
+
+	return obj, nil
+}
+
+type listContents struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+	StorageClass string
+}
+
+type listBucketResult struct {
+	XMLName     xml.Name `xml:"ListBucketResult"`
+	Name        string
+	Prefix      string
+	Marker      string
+	MaxKeys     int
+	IsTruncated bool
+	Contents    []listContents
+}
+
+func (s *Server) listBucket(w http.ResponseWriter, b *bucket, prefix, marker, maxKeys string) *s3Error {
+	max := 1000
+
+	if maxKeys != "" {
+		n, err := strconv.Atoi(maxKeys)
+		if err != nil || n < 0 {
+			return fail(http.StatusBadRequest, "InvalidArgument", "invalid max-keys %q", maxKeys)
+		}
+		max = n
+	}
+
+	var keys []string
+
+	for k := range b.objects {
+		if strings.HasPrefix(k, prefix) && k > marker {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+
+	res := listBucketResult{
+		Name:    b.name,
+		Prefix:  prefix,
+		Marker:  marker,
+		MaxKeys: max,
+	}
+
+	if len(keys) > max {
+		keys = keys[:max]
+		res.IsTruncated = true
+	}
+
+	for _, k := range keys {
+		obj := b.objects[k]
+		res.Contents = append(res.Contents, listContents{
+			Key:          k,
+			LastModified: obj.modTime.Format("2006-01-02T15:04:05.000Z"),
+			ETag:         `"` + obj.etag + `"`,
+			Size:         len(obj.data),
+			StorageClass: "STANDARD",
+		})
+	}
+
+	return writeXML(w, res)
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) *s3Error {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		return fail(http.StatusInternalServerError, "InternalError", "%v", err)
+	}
+	return nil
+}
+
+type initiateResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Bucket   string
+	Key      string
+	UploadID string `xml:"UploadId"`
+}
+
+func (s *Server) initiateUpload(w http.ResponseWriter, b *bucket, key string, header http.Header) *s3Error {
+	s.nextID++
+	id := fmt.Sprintf("upload-%d", s.nextID)
+	s.uploads[id] = &upload{
+		bucket: b.name,
+		key:    key,
+		header: header,
+		parts:  make(map[int]*object),
+	}
+	return writeXML(w, initiateResult{Bucket: b.name, Key: key, UploadID: id})
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, id, partNumber string, header http.Header, data []byte) *s3Error {
+	u, ok := s.uploads[id]
+
+	if !ok {
+		return fail(http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+	}
+
+	n, err := strconv.Atoi(partNumber)
+
+	if err != nil || n < 1 || n > 10000 {
+		return fail(http.StatusBadRequest, "InvalidArgument", "invalid part number %q", partNumber)
+	}
+
+	part, serr := newObject(header, data)
+
+	if serr != nil {
+		return serr
+	}
+
+	u.parts[n] = part
+	w.Header().Set("ETag", `"`+part.etag+`"`)
+	return nil
+}
+
+type completeRequest struct {
+	Parts []struct {
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+
+type completeResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Bucket  string
+	Key     string
+	ETag    string
+}
+
+func (s *Server) completeUpload(w http.ResponseWriter, b *bucket, key, id string, body []byte) *s3Error {
+	u, ok := s.uploads[id]
+
+	if !ok || u.bucket != b.name || u.key != key {
+		return fail(http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+	}
+
+	var creq completeRequest
+
+	if err := xml.Unmarshal(body, &creq); err != nil || len(creq.Parts) == 0 {
+		return fail(http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed.")
+	}
+
+	var data bytes.Buffer
+	sums := md5.New()
+	last := 0
+
+	for _, p := range creq.Parts {
+		part, ok := u.parts[p.PartNumber]
+
+		if !ok || strings.Trim(p.ETag, `"`) != part.etag {
+			return fail(http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found.")
+		}
+
+		if p.PartNumber <= last {
+			return fail(http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order.")
+		}
+
+		last = p.PartNumber
+		data.Write(part.data)
+		sum, _ := hex.DecodeString(part.etag)
+		sums.Write(sum)
+	}
+
+	obj, err := newObject(u.header, data.Bytes())
+
+	if err != nil {
+		return err
+	}
+
+	// multipart ETags are the MD5 of the part MD5s and the part count
+	obj.etag = fmt.Sprintf("%s-%d", hex.EncodeToString(sums.Sum(nil)), len(creq.Parts))
+	b.objects[key] = obj
+	delete(s.uploads, id)
+	return writeXML(w, completeResult{Bucket: b.name, Key: key, ETag: `"` + obj.etag + `"`})
+}
@@ -0,0 +1,113 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package s3test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func do(t *testing.T, srv *Server, method, url string, body []byte) *http.Response {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.NewClient().Auth.SignRequest(req)
+	res, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	return res
+}
+
+func TestMultipartUpload(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.CreateBucket("bucket")
+
+	base := "http://bucket." + Hostname + "/key"
+
+	res := do(t, srv, "POST", base+"?uploads", nil)
+	var ir initiateResult
+	if err := xml.NewDecoder(res.Body).Decode(&ir); err != nil {
+		t.Fatalf("initiate: %v", err)
+	}
+	res.Body.Close()
+
+	parts := []string{"hello ", "multipart ", "world"}
+	var complete bytes.Buffer
+	complete.WriteString("<CompleteMultipartUpload>")
+
+	for i, p := range parts {
+		res := do(t, srv, "PUT", fmt.Sprintf("%s?partNumber=%d&uploadId=%s", base, i+1, ir.UploadID), []byte(p))
+		res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Fatalf("part %d: status %d", i+1, res.StatusCode)
+		}
+		fmt.Fprintf(&complete, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i+1, res.Header.Get("ETag"))
+	}
+
+	complete.WriteString("</CompleteMultipartUpload>")
+	res = do(t, srv, "POST", base+"?uploadId="+ir.UploadID, complete.Bytes())
+	var cr completeResult
+	if err := xml.NewDecoder(res.Body).Decode(&cr); err != nil {
+		t.Fatalf("complete: %v", err)
+	}
+	res.Body.Close()
+
+	if !strings.HasSuffix(strings.Trim(cr.ETag, `"`), fmt.Sprintf("-%d", len(parts))) {
+		t.Errorf("got multipart ETag %s", cr.ETag)
+	}
+
+	res = do(t, srv, "GET", base, nil)
+	data, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if got, want := string(data), strings.Join(parts, ""); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// the upload is gone once completed
+	res = do(t, srv, "DELETE", base+"?uploadId="+ir.UploadID, nil)
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Errorf("abort of completed upload: status %d, want 404", res.StatusCode)
+	}
+}
+
+func TestSignature(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.CreateBucket("bucket")
+
+	req, _ := http.NewRequest("GET", "http://bucket."+Hostname+"/key", nil)
+	req.Header.Set("Authorization", "AWS "+AccessKey+":bogus")
+	res, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != 403 {
+		t.Errorf("bad signature: status %d, want 403", res.StatusCode)
+	}
+
+	// path-style requests are accepted too
+	res = do(t, srv, "PUT", srv.URL+"/bucket/key", []byte("data"))
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("path-style PUT: status %d, want 200", res.StatusCode)
+	}
+}
@@ -18,7 +18,9 @@ limitations under the License.
 package s3
 
 import (
-	"fmt"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"os"
 
 	"github.com/simonz05/blobserver/blob"
@@ -27,27 +29,67 @@ import (
 
 var statGate = syncutil.NewGate(20) // arbitrary
 
+// etagMD5 returns the MD5 of an object from its ETag, or "" if the ETag
+// isn't one: objects uploaded in parts or encrypted with SSE-KMS have
+// other ETags.
+func etagMD5(etag, sse string) string {
+	if sse == "aws:kms" || len(etag) != hex.EncodedLen(md5.Size) {
+		return ""
+	}
+
+	if _, err := hex.DecodeString(etag); err != nil {
+		return ""
+	}
+
+	return etag
+}
+
 func (sto *s3Storage) StatBlobs(dest chan<- blob.SizedInfoRef, blobs []blob.Ref) error {
+	return sto.StatBlobsContext(context.Background(), dest, blobs)
+}
+
+func (sto *s3Storage) StatBlobsContext(ctx context.Context, dest chan<- blob.SizedInfoRef, blobs []blob.Ref) error {
 	var wg syncutil.Group
 
 	for _, br := range blobs {
 		br := br
-		statGate.Start()
+		if err := statGate.StartContext(ctx); err != nil {
+			wg.Go(func() error { return err })
+			break
+		}
 
 		wg.Go(func() error {
 			defer statGate.Done()
-			size, err := sto.s3Client.Stat(br.String(), sto.bucket)
+			oi, err := sto.s3Client.HeadContext(ctx, br.String(), sto.bucket)
 
 			if err == nil {
-				dest <- blob.SizedInfoRef{Ref: br, Size: uint32(size)}
-				return nil
+				sb := blob.SizedInfoRef{
+					Ref:         br,
+					Size:        uint32(oi.Size),
+					MD5:         etagMD5(oi.ETag, oi.ServerSideEncryption),
+					ModTime:     oi.LastModified,
+					ContentType: oi.ContentType,
+					Options: blob.Options{
+						CacheControl:         oi.CacheControl,
+						ContentDisposition:   oi.ContentDisposition,
+						StorageClass:         oi.StorageClass,
+						ServerSideEncryption: oi.ServerSideEncryption,
+						KMSKeyID:             oi.SSEKMSKeyID,
+					},
+				}
+				select {
+				case dest <- sb:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
 			}
 
 			if err == os.ErrNotExist {
 				return nil
 			}
 
-			return fmt.Errorf("error statting %v: %v", br, err)
+			return translateError(err)
 		})
 	}
 	return wg.Err()
@@ -0,0 +1,214 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/simonz05/blobserver/config"
+	"github.com/simonz05/util/httputil"
+	"github.com/simonz05/util/log"
+	"github.com/simonz05/util/session"
+)
+
+// scope is a set of permissions granted to a token.
+type scope uint8
+
+const (
+	scopeRead scope = 1 << iota
+	scopeUpload
+	scopeRemove
+	scopeAdmin
+
+	scopeAll = scopeRead | scopeUpload | scopeRemove | scopeAdmin
+)
+
+var scopeNames = map[string]scope{
+	"read":   scopeRead,
+	"upload": scopeUpload,
+	"remove": scopeRemove,
+	"admin":  scopeAll,
+}
+
+func parseScopes(names []string) (s scope, err error) {
+	for _, name := range names {
+		v, ok := scopeNames[name]
+
+		if !ok {
+			return 0, fmt.Errorf("auth: unknown scope %q", name)
+		}
+
+		s |= v
+	}
+
+	return s, nil
+}
+
+// has reports whether s includes all of want.
+func (s scope) has(want scope) bool {
+	return s&want == want
+}
+
+const defaultSessionPrefix = "blobserver:token"
+
+var (
+	errUnauthorized = newHTTPError("Unauthorized", http.StatusUnauthorized)
+	errForbidden    = newHTTPError("Forbidden", http.StatusForbidden)
+)
+
+// authenticator resolves the token of a request to its scopes.
+type authenticator struct {
+	// tokens are keyed by their SHA-256 so that looking one up
+	// doesn't leak how much of it matched.
+	tokens        map[[sha256.Size]byte]scope
+	sessions      session.Storage
+	sessionScopes scope
+	anonymous     scope
+}
+
+// newAuthenticator returns the authenticator configured by conf, or
+// nil if authentication is off.
+func newAuthenticator(conf *config.AuthConfig) (*authenticator, error) {
+	if conf == nil {
+		return nil, nil
+	}
+
+	a := &authenticator{tokens: make(map[[sha256.Size]byte]scope)}
+	var err error
+
+	if a.anonymous, err = parseScopes(conf.Anonymous); err != nil {
+		return nil, err
+	}
+
+	for _, tc := range conf.Tokens {
+		if tc.Token == "" {
+			return nil, fmt.Errorf("auth: token %q is empty", tc.Name)
+		}
+
+		s, err := parseScopes(tc.Scopes)
+
+		if err != nil {
+			return nil, fmt.Errorf("auth: token %q: %v", tc.Name, err)
+		}
+
+		a.tokens[sha256.Sum256([]byte(tc.Token))] = s
+	}
+
+	if conf.SessionRedis == "" {
+		return a, nil
+	}
+
+	if a.sessionScopes, err = parseScopes(conf.SessionScopes); err != nil {
+		return nil, err
+	}
+
+	prefix := conf.SessionPrefix
+
+	if prefix == "" {
+		prefix = defaultSessionPrefix
+	}
+
+	if a.sessions, err = session.NewRedisBackend(conf.SessionRedis, prefix, true); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// bearerToken returns the token sent with r, if any.
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+
+	if len(h) > len(prefix) && strings.EqualFold(h[:len(prefix)], prefix) {
+		return strings.TrimSpace(h[len(prefix):])
+	}
+
+	return ""
+}
+
+// scopes returns the scopes of the request r.
+func (a *authenticator) scopes(r *http.Request) (scope, error) {
+	token := bearerToken(r)
+
+	if token == "" {
+		return a.anonymous, nil
+	}
+
+	if s, ok := a.tokens[sha256.Sum256([]byte(token))]; ok {
+		return s, nil
+	}
+
+	if a.sessions == nil {
+		return 0, errUnauthorized
+	}
+
+	ses, err := a.sessions.Read(token)
+
+	switch {
+	case err == redis.ErrNil:
+		return 0, errUnauthorized
+	case err != nil:
+		log.Errorf("auth: session storage: %v", err)
+		return 0, newHTTPError("Session storage unavailable", http.StatusServiceUnavailable)
+	case ses.HasAdmin():
+		return scopeAll, nil
+	}
+
+	return a.sessionScopes, nil
+}
+
+type scopeKey struct{}
+
+// handler authenticates requests before passing them on to h, which
+// may check their scopes with requireScope. Requests with a token that
+// isn't known are rejected. Signed requests have their scope already.
+func (a *authenticator) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(scopeKey{}).(scope); ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		s, err := a.scopes(r)
+
+		if err != nil {
+			serveAuthError(w, err)
+			return
+		}
+
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), scopeKey{}, s)))
+	})
+}
+
+// requireScope returns a handler which serves requests with the scope
+// want by h. Requests not passed by an authenticator are always
+// served, authentication is off then.
+func requireScope(want scope, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, ok := r.Context().Value(scopeKey{}).(scope)
+
+		switch {
+		case !ok, s.has(want):
+			h.ServeHTTP(w, r)
+		case bearerToken(r) == "":
+			serveAuthError(w, errUnauthorized)
+		default:
+			serveAuthError(w, errForbidden)
+		}
+	})
+}
+
+func serveAuthError(w http.ResponseWriter, err error) {
+	if err == errUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="blobserver"`)
+	}
+	httputil.ServeJSONError(w, err)
+}
@@ -13,20 +13,23 @@ import (
 	"github.com/simonz05/util/log"
 )
 
-// createBatchRemoveHandler returns the handler that removes blobs
-func createConfigHandler(storage blobserver.Storage) http.Handler {
+// createConfigHandler returns the handler that serves the config of
+// the storage of namespace ns.
+func createConfigHandler(storage blobserver.Storage, ns string) http.Handler {
 	sc, ok := storage.(blobserver.StorageConfiger)
 	if !ok {
 		return http.HandlerFunc(notImplementedHandler)
 	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		handleConfig(w, r, sc)
+		handleConfig(w, r, sc, ns)
 	})
 }
 
-func handleConfig(w http.ResponseWriter, req *http.Request, storage blobserver.StorageConfiger) {
+func handleConfig(w http.ResponseWriter, req *http.Request, storage blobserver.StorageConfiger, ns string) {
 	res := new(protocol.ConfigResponse)
-	res.Data = storage.Config()
+	conf := *storage.Config()
+	conf.Namespace = ns
+	res.Data = &conf
 	log.Println("config:", res)
 	httputil.ReturnJSON(w, res)
 }
@@ -0,0 +1,189 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/simonz05/blobserver/config"
+)
+
+var (
+	defaultCORSMethods = []string{"GET", "HEAD", "POST", "DELETE"}
+	defaultCORSHeaders = []string{"Authorization", "Content-Type"}
+)
+
+// cors answers preflight requests for the routes of a router and adds
+// the CORS headers to requests from allowed origins.
+type cors struct {
+	routes      *mux.Router
+	origins     []string
+	methods     map[string]bool
+	allowMethod string
+	allowHeader string
+	headers     map[string]bool
+	maxAge      string
+	credentials bool
+}
+
+// newCORS returns the CORS handling configured by conf for the routes
+// of router, or nil if CORS is off.
+func newCORS(conf *config.CORSConfig, router *mux.Router) (*cors, error) {
+	if conf == nil {
+		return nil, nil
+	}
+
+	if len(conf.Origins) == 0 {
+		return nil, fmt.Errorf("cors: no origins")
+	}
+
+	for _, o := range conf.Origins {
+		if strings.Count(o, "*") > 1 {
+			return nil, fmt.Errorf("cors: invalid origin %q", o)
+		}
+
+		// any website could make requests with the credentials of
+		// its visitors.
+		if o == "*" && conf.Credentials {
+			return nil, fmt.Errorf("cors: origin \"*\" can't allow credentials")
+		}
+	}
+
+	methods, headers := conf.Methods, conf.Headers
+
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+
+	if len(headers) == 0 {
+		headers = defaultCORSHeaders
+	}
+
+	c := &cors{
+		routes:      router,
+		origins:     conf.Origins,
+		methods:     make(map[string]bool),
+		headers:     make(map[string]bool),
+		credentials: conf.Credentials,
+	}
+
+	upper := make([]string, len(methods))
+
+	for i, m := range methods {
+		upper[i] = strings.ToUpper(m)
+		c.methods[upper[i]] = true
+	}
+
+	for _, h := range headers {
+		c.headers[http.CanonicalHeaderKey(h)] = true
+	}
+
+	c.allowMethod = strings.Join(upper, ", ")
+	c.allowHeader = strings.Join(headers, ", ")
+
+	if conf.MaxAge.Duration > 0 {
+		c.maxAge = strconv.Itoa(int(conf.MaxAge.Seconds()))
+	}
+
+	return c, nil
+}
+
+// allowOrigin reports whether origin may use the API.
+func (c *cors) allowOrigin(origin string) bool {
+	for _, o := range c.origins {
+		if o == "*" || o == origin {
+			return true
+		}
+
+		if i := strings.IndexByte(o, '*'); i >= 0 {
+			prefix, suffix := o[:i], o[i+1:]
+
+			if len(origin) > len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// allowHeaders reports whether the comma separated request headers
+// of a preflight request are all allowed.
+func (c *cors) allowHeaders(list string) bool {
+	for _, h := range strings.Split(list, ",") {
+		if h = strings.TrimSpace(h); h != "" && !c.headers[http.CanonicalHeaderKey(h)] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// preflight reports whether req is a preflight request for a route.
+func (c *cors) preflight(req *http.Request) bool {
+	method := req.Header.Get("Access-Control-Request-Method")
+
+	if req.Method != "OPTIONS" || method == "" {
+		return false
+	}
+
+	r := *req
+	r.Method = method
+	return c.routes.Match(&r, &mux.RouteMatch{})
+}
+
+func (c *cors) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get("Origin")
+
+		if origin == "" {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		hdr := w.Header()
+		hdr.Add("Vary", "Origin")
+		preflight := c.preflight(req)
+
+		if !c.allowOrigin(origin) {
+			if preflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		// the origin is echoed as it may have matched a pattern.
+		hdr.Set("Access-Control-Allow-Origin", origin)
+
+		if c.credentials {
+			hdr.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		if !c.methods[req.Header.Get("Access-Control-Request-Method")] || !c.allowHeaders(req.Header.Get("Access-Control-Request-Headers")) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		hdr.Set("Access-Control-Allow-Methods", c.allowMethod)
+		hdr.Set("Access-Control-Allow-Headers", c.allowHeader)
+
+		if c.maxAge != "" {
+			hdr.Set("Access-Control-Max-Age", c.maxAge)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,83 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/simonz05/blobserver"
+	"github.com/simonz05/blobserver/blob"
+	"github.com/simonz05/util/httputil"
+	"github.com/simonz05/util/log"
+)
+
+// createFetchHandler returns the handler that serves the blob at path
+// from the storage. Unlike the CDN it serves private blobs too, to
+// requests with the read scope or a signed URL. If sto is a
+// blobserver.URLSigner GET requests are redirected to the URL it
+// signs instead.
+func createFetchHandler(storage blobserver.ContextFetcher, sto blobserver.Storage) http.Handler {
+	signer, _ := sto.(blobserver.URLSigner)
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ref, ok := blob.Parse(mux.Vars(req)["blobRef"])
+
+		if !ok {
+			httputil.ServeJSONError(rw, newHTTPError("Invalid blob ref", http.StatusBadRequest))
+			return
+		}
+
+		if signer != nil && req.Method == "GET" {
+			u, err := signer.SignedURL(req.Context(), ref)
+
+			switch err {
+			case nil:
+				rw.Header().Set("Cache-Control", "no-store")
+				http.Redirect(rw, req, u, http.StatusFound)
+				return
+			case blobserver.ErrNoSignedURL:
+			default:
+				log.Errorf("fetch %v: signed URL: %v", ref, err)
+				httputil.ServeJSONError(rw, newStorageError(err))
+				return
+			}
+		}
+
+		rc, size, err := storage.FetchContext(req.Context(), ref)
+
+		if err != nil {
+			if err != blobserver.ErrNotFound {
+				log.Errorf("fetch %v: %v", ref, err)
+			}
+			httputil.ServeJSONError(rw, newStorageError(err))
+			return
+		}
+
+		defer rc.Close()
+		ct := mime.TypeByExtension(filepath.Ext(ref.Path))
+
+		if ct == "" {
+			ct = "application/octet-stream"
+		}
+
+		h := rw.Header()
+		h.Set("Content-Type", ct)
+		h.Set("Content-Length", strconv.FormatUint(uint64(size), 10))
+		h.Set("Cache-Control", "private")
+
+		if req.Method == "HEAD" {
+			return
+		}
+
+		if _, err := io.Copy(rw, rc); err != nil {
+			log.Errorf("fetch %v: %v", ref, err)
+		}
+	})
+}
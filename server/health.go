@@ -0,0 +1,156 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/simonz05/blobserver"
+	"github.com/simonz05/blobserver/blob"
+	"github.com/simonz05/blobserver/config"
+	"github.com/simonz05/util/httputil"
+	"github.com/simonz05/util/log"
+)
+
+const (
+	defaultHealthCacheTTL = 5 * time.Second
+	defaultHealthTimeout  = 5 * time.Second
+)
+
+var errDraining = errors.New("draining")
+
+// sentinelRef matches the refs the API serves.
+var sentinelRef = regexp.MustCompile(`^[[:alnum:]_/.-]+$`)
+
+// health checks whether the storages are ready to serve requests.
+// Results are cached so probes don't load the backends.
+type health struct {
+	storages map[string]blobserver.Storage // keyed by namespace
+	sentinel blob.Ref                      // optional. Checked in the default storage
+	ttl      time.Duration
+	timeout  time.Duration
+	draining int32 // atomic
+
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// newHealth returns the health of storages, keyed by namespace.
+func newHealth(conf *config.HealthConfig, storages map[string]blobserver.Storage) (*health, error) {
+	h := &health{
+		storages: storages,
+		ttl:      defaultHealthCacheTTL,
+		timeout:  defaultHealthTimeout,
+	}
+
+	if conf == nil {
+		return h, nil
+	}
+
+	if conf.Sentinel != "" {
+		if !sentinelRef.MatchString(conf.Sentinel) {
+			return nil, fmt.Errorf("health: invalid sentinel %q", conf.Sentinel)
+		}
+
+		h.sentinel, _ = blob.Parse(conf.Sentinel)
+	}
+
+	if conf.CacheTTL.Duration > 0 {
+		h.ttl = conf.CacheTTL.Duration
+	}
+
+	if conf.Timeout.Duration > 0 {
+		h.timeout = conf.Timeout.Duration
+	}
+
+	return h, nil
+}
+
+// drain marks the server as shutting down. It isn't ready from then
+// on, so load balancers stop sending it requests.
+func (h *health) drain() {
+	atomic.StoreInt32(&h.draining, 1)
+}
+
+// ready returns why the server isn't ready, or nil if it is.
+func (h *health) ready() error {
+	if atomic.LoadInt32(&h.draining) != 0 {
+		return errDraining
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if time.Since(h.checked) >= h.ttl {
+		h.err = h.check()
+		h.checked = time.Now()
+	}
+
+	return h.err
+}
+
+func (h *health) check() error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	names := make([]string, 0, len(h.storages))
+
+	for name := range h.storages {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		hc, ok := h.storages[name].(blobserver.HealthChecker)
+
+		if !ok {
+			continue
+		}
+
+		if err := hc.CheckHealth(ctx); err != nil {
+			if name != "" {
+				return fmt.Errorf("namespace %s: %v", name, err)
+			}
+			return err
+		}
+	}
+
+	if h.sentinel.Path != "" {
+		cs := blobserver.NewContextStorage(h.storages[""])
+
+		if _, err := blobserver.StatBlobContext(ctx, cs, h.sentinel); err != nil {
+			return fmt.Errorf("sentinel %v: %v", h.sentinel, err)
+		}
+	}
+
+	return nil
+}
+
+// serveHealthz reports that the process is up.
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	httputil.ReturnJSON(w, map[string]string{"status": "ok"})
+}
+
+// serveReadyz reports whether the storages can serve requests.
+func (h *health) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	if err := h.ready(); err != nil {
+		if err != errDraining {
+			log.Errorf("readyz: %v", err)
+		}
+		httputil.ServeJSONError(w, newHTTPError("Not ready: "+err.Error(), http.StatusServiceUnavailable))
+		return
+	}
+
+	httputil.ReturnJSON(w, map[string]string{"status": "ok"})
+}
@@ -5,10 +5,21 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
+
+	"github.com/simonz05/blobserver"
+	"github.com/simonz05/blobserver/protocol"
 )
 
+// maxBatchRequestSize is the max size of a JSON batch request body.
+const maxBatchRequestSize = 1 << 20
+
 func newRateLimitError(max int) error {
 	msg := fmt.Sprintf("Max per request is %d", max)
 	return newHTTPError(msg, http.StatusBadRequest)
@@ -31,6 +42,62 @@ func newHTTPError(message string, code int) httpError {
 	return httpError{code: code, message: message}
 }
 
+// newStorageError returns the httpError for an error returned by a
+// storage. Errors outside of the blobserver error vocabulary become a
+// generic 500 so backend details don't leak to the client.
+func newStorageError(err error) httpError {
+	var code int
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		code = http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled):
+		code = http.StatusServiceUnavailable
+	case errors.Is(err, blobserver.ErrNotFound):
+		code = http.StatusNotFound
+	case errors.Is(err, blobserver.ErrAlreadyExists):
+		code = http.StatusConflict
+	case errors.Is(err, blobserver.ErrTooLarge):
+		code = http.StatusRequestEntityTooLarge
+	case errors.Is(err, blobserver.ErrPreconditionFailed):
+		code = http.StatusPreconditionFailed
+	case errors.Is(err, blobserver.ErrQuotaExceeded):
+		code = http.StatusInsufficientStorage
+	case errors.Is(err, blobserver.ErrBackendUnavailable):
+		code = http.StatusServiceUnavailable
+	case errors.Is(err, blobserver.ErrInvalidOptions):
+		code = http.StatusBadRequest
+	default:
+		return newHTTPError("Server error", http.StatusInternalServerError)
+	}
+
+	return newHTTPError(err.Error(), code)
+}
+
+// isJSONRequest reports whether the request body is a JSON document.
+func isJSONRequest(req *http.Request) bool {
+	ct, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return ct == "application/json"
+}
+
+// parseBatchRequest decodes a protocol.BatchRequest from the request
+// body and returns the blobs in it, or an error if there are more than
+// max.
+func parseBatchRequest(req *http.Request, max int) ([]string, error) {
+	var br protocol.BatchRequest
+	err := json.NewDecoder(io.LimitReader(req.Body, maxBatchRequestSize)).Decode(&br)
+
+	if err != nil {
+		return nil, newHTTPError(fmt.Sprintf("Invalid JSON request body: %v", err), http.StatusBadRequest)
+	}
+
+	if len(br.Blobs) > max {
+		return nil, newRateLimitError(max)
+	}
+
+	return br.Blobs, nil
+}
+
 func notImplementedHandler(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "501 Not Implemented", http.StatusNotImplemented)
 }
@@ -0,0 +1,333 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/simonz05/blobserver/config"
+	"github.com/simonz05/util/httputil"
+)
+
+// bucket is a token bucket. It holds up to burst tokens and gains rate
+// tokens a second.
+type bucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) fill(now time.Time, rate, burst float64) {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else if d := now.Sub(b.last); d > 0 {
+		b.tokens = math.Min(burst, b.tokens+d.Seconds()*rate)
+	}
+	b.last = now
+}
+
+// take takes n tokens if there are that many. Otherwise it returns how
+// long until there are.
+func (b *bucket) take(now time.Time, rate, burst, n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fill(now, rate, burst)
+
+	if b.tokens >= n {
+		b.tokens -= n
+		return 0
+	}
+
+	return seconds((n - b.tokens) / rate)
+}
+
+// debit takes n tokens, going into debt if there aren't that many, and
+// returns how long until the debt is paid.
+func (b *bucket) debit(now time.Time, rate, burst, n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fill(now, rate, burst)
+	b.tokens -= n
+
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return seconds(-b.tokens / rate)
+}
+
+// idle returns how long the bucket hasn't been used.
+func (b *bucket) idle(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return now.Sub(b.last)
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// clientLimits is what a client has used of its limits.
+type clientLimits struct {
+	requests bucket
+	upload   bucket
+	uploads  int32 // atomic. Uploads in progress
+}
+
+// limiter limits the request rate and upload bandwidth of each client,
+// and the uploads of all clients at once.
+type limiter struct {
+	requestRate, requestBurst float64
+	uploadRate, uploadBurst   float64
+	ipHeader                  string
+	trustedProxies            int
+	uploads                   chan struct{} // nil if not limited
+
+	now func() time.Time
+
+	mu      sync.Mutex
+	clients map[string]*clientLimits
+	swept   time.Time
+}
+
+// newLimiter returns the limiter configured by conf, or nil if there
+// are no limits.
+func newLimiter(conf *config.RateLimitConfig) (*limiter, error) {
+	if conf == nil {
+		return nil, nil
+	}
+
+	if conf.Requests < 0 || conf.Burst < 0 || conf.UploadBytes < 0 || conf.UploadBurst < 0 || conf.MaxUploads < 0 || conf.TrustedProxies < 0 {
+		return nil, fmt.Errorf("rate_limit: negative limit")
+	}
+
+	l := &limiter{
+		requestRate:    conf.Requests,
+		requestBurst:   float64(conf.Burst),
+		uploadRate:     float64(conf.UploadBytes),
+		uploadBurst:    float64(conf.UploadBurst),
+		ipHeader:       conf.IPHeader,
+		trustedProxies: conf.TrustedProxies,
+		now:            time.Now,
+		clients:        make(map[string]*clientLimits),
+	}
+
+	if l.requestBurst == 0 {
+		l.requestBurst = math.Max(1, math.Ceil(l.requestRate))
+	}
+
+	if l.uploadBurst == 0 {
+		l.uploadBurst = l.uploadRate
+	}
+
+	if l.trustedProxies == 0 {
+		l.trustedProxies = 1
+	}
+
+	if conf.MaxUploads > 0 {
+		l.uploads = make(chan struct{}, conf.MaxUploads)
+	}
+
+	return l, nil
+}
+
+// clientKey returns the key of the client of r: its token if it was
+// authenticated by one, or else its IP address. Behind proxies it's the
+// address the outermost trusted proxy added to the IP header. Entries
+// left of it were sent by the client, which may make them up.
+func (l *limiter) clientKey(r *http.Request) string {
+	if token := bearerToken(r); token != "" {
+		if _, ok := r.Context().Value(scopeKey{}).(scope); ok {
+			sum := sha256.Sum256([]byte(token))
+			return "token:" + string(sum[:])
+		}
+	}
+
+	if l.ipHeader != "" {
+		if h := strings.Join(r.Header[http.CanonicalHeaderKey(l.ipHeader)], ","); h != "" {
+			ips := strings.Split(h, ",")
+			i := len(ips) - l.trustedProxies
+
+			if i < 0 {
+				i = 0
+			}
+
+			return "ip:" + strings.TrimSpace(ips[i])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return "ip:" + host
+}
+
+// client returns the limits of the client of r. With upload set, the
+// client is counted as uploading until uploadDone is called. Clients
+// which have been idle long enough to have their buckets full again are
+// forgotten, unless they're uploading.
+func (l *limiter) client(r *http.Request, now time.Time, upload bool) *clientLimits {
+	key := l.clientKey(r)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.swept) > time.Minute {
+		l.sweep(now)
+	}
+
+	c, ok := l.clients[key]
+
+	if !ok {
+		c = new(clientLimits)
+		l.clients[key] = c
+	}
+
+	if upload {
+		atomic.AddInt32(&c.uploads, 1)
+	}
+
+	return c
+}
+
+func (l *limiter) uploadDone(c *clientLimits) {
+	atomic.AddInt32(&c.uploads, -1)
+}
+
+func (l *limiter) sweep(now time.Time) {
+	idle := time.Minute
+
+	if l.requestRate > 0 {
+		idle = maxDuration(idle, seconds(l.requestBurst/l.requestRate))
+	}
+
+	if l.uploadRate > 0 {
+		idle = maxDuration(idle, seconds(l.uploadBurst/l.uploadRate))
+	}
+
+	for key, c := range l.clients {
+		if atomic.LoadInt32(&c.uploads) == 0 && c.requests.idle(now) > idle && c.upload.idle(now) > idle {
+			delete(l.clients, key)
+		}
+	}
+
+	l.swept = now
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// serveTooManyRequests tells the client to retry after d.
+func serveTooManyRequests(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+	httputil.ServeJSONError(w, newHTTPError("Too many requests", http.StatusTooManyRequests))
+}
+
+// handler limits the request rate of each client.
+func (l *limiter) handler(h http.Handler) http.Handler {
+	if l.requestRate == 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := l.now()
+		c := l.client(r, now, false)
+		wait := c.requests.take(now, l.requestRate, l.requestBurst, 1)
+
+		if wait > 0 {
+			serveTooManyRequests(w, wait)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// upload limits the bandwidth of the uploads of each client and the
+// uploads of all clients at once. Clients which have used up their
+// bandwidth are turned away until it's back, and uploads in progress
+// are slowed down to it.
+func (l *limiter) upload(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.uploadRate > 0 {
+			now := l.now()
+			c := l.client(r, now, true)
+			defer l.uploadDone(c)
+			wait := c.upload.debit(now, l.uploadRate, l.uploadBurst, 0)
+
+			if wait > 0 {
+				serveTooManyRequests(w, wait)
+				return
+			}
+
+			r.Body = &throttledReader{ReadCloser: r.Body, l: l, c: c, done: r.Context().Done()}
+		}
+
+		if l.uploads != nil {
+			select {
+			case l.uploads <- struct{}{}:
+				defer func() { <-l.uploads }()
+			default:
+				serveTooManyRequests(w, time.Second)
+				return
+			}
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// throttledReader reads no faster than the upload bandwidth of a
+// client, shared by all its uploads.
+type throttledReader struct {
+	io.ReadCloser
+	l    *limiter
+	c    *clientLimits
+	done <-chan struct{}
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	// reads are kept small so the rate is even.
+	if max := int(math.Max(1, r.l.uploadRate/10)); len(p) > max {
+		p = p[:max]
+	}
+
+	n, err := r.ReadCloser.Read(p)
+
+	if n == 0 {
+		return n, err
+	}
+
+	wait := r.c.upload.debit(r.l.now(), r.l.uploadRate, r.l.uploadBurst, float64(n))
+
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+
+		select {
+		case <-t.C:
+		case <-r.done:
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+
+	return n, err
+}
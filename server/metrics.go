@@ -0,0 +1,219 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/simonz05/blobserver"
+	"github.com/simonz05/blobserver/blob"
+	"github.com/simonz05/blobserver/metrics"
+)
+
+// serverMetrics are the metrics served at /metrics.
+type serverMetrics struct {
+	registry   *metrics.Registry
+	routes     *mux.Router
+	namespaces map[*mux.Route]string // namespace served by each route
+
+	requests   *metrics.Counter
+	latency    *metrics.Histogram
+	uploaded   *metrics.Counter
+	downloaded *metrics.Counter
+	uploads    *metrics.Gauge
+
+	storageLatency *metrics.Histogram
+	storageErrors  *metrics.Counter
+}
+
+// newServerMetrics returns the metrics of requests to the routes of
+// router. Gates are reported by how full they are, including the
+// concurrent uploads of limits if they are capped.
+func newServerMetrics(router *mux.Router, limits *limiter) *serverMetrics {
+	r := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry:   r,
+		routes:     router,
+		namespaces: make(map[*mux.Route]string),
+
+		requests:   r.NewCounter("blobserver_http_requests_total", "HTTP requests by route, namespace, method and status code.", "route", "namespace", "method", "code"),
+		latency:    r.NewHistogram("blobserver_http_request_duration_seconds", "HTTP request latency by route, namespace, method and status code.", metrics.DefBuckets, "route", "namespace", "method", "code"),
+		uploaded:   r.NewCounter("blobserver_http_request_bytes_total", "Bytes of HTTP request bodies read by route and namespace.", "route", "namespace"),
+		downloaded: r.NewCounter("blobserver_http_response_bytes_total", "Bytes of HTTP response bodies written by route and namespace.", "route", "namespace"),
+		uploads:    r.NewGauge("blobserver_uploads_in_flight", "Uploads in progress."),
+
+		storageLatency: r.NewHistogram("blobserver_storage_operation_duration_seconds", "Storage backend operation latency.", metrics.DefBuckets, "backend", "namespace", "op"),
+		storageErrors:  r.NewCounter("blobserver_storage_errors_total", "Storage backend operations which failed. Missing blobs aren't failures.", "backend", "namespace", "op"),
+	}
+
+	m.uploads.Set(0)
+
+	gate := func(name string, size, capacity func() int) {
+		r.GaugeFunc("blobserver_gate_in_use", "Operations in progress in a concurrency gate.", func() float64 { return float64(size()) }, "gate", name)
+		r.GaugeFunc("blobserver_gate_capacity", "Operations a concurrency gate permits at once.", func() float64 { return float64(capacity()) }, "gate", name)
+	}
+
+	gate("stat", statGate.Len, statGate.Cap)
+	gate("remove", removeGate.Len, removeGate.Cap)
+
+	if limits != nil && limits.uploads != nil {
+		gate("uploads", func() int { return len(limits.uploads) }, func() int { return cap(limits.uploads) })
+	}
+
+	return m
+}
+
+// name names the route r, which serves the namespace ns.
+func (m *serverMetrics) name(r *mux.Route, name, ns string) {
+	r.Name(name)
+	m.namespaces[r] = ns
+}
+
+// route returns the name of the route of r and the namespace it serves.
+func (m *serverMetrics) route(r *http.Request) (name, ns string) {
+	var match mux.RouteMatch
+
+	if m.routes.Match(r, &match) && match.Route.GetName() != "" {
+		return match.Route.GetName(), m.namespaces[match.Route]
+	}
+
+	return "other", ""
+}
+
+// methodLabel returns the label of the HTTP method m. Clients may send
+// any method, so those the API doesn't serve share one label.
+func methodLabel(m string) string {
+	switch m {
+	case "GET", "HEAD", "POST", "DELETE", "OPTIONS":
+		return m
+	}
+
+	return "other"
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// statusWriter records the status code and counts the bytes of a
+// response.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+	n    int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// handler measures the requests to h.
+func (m *serverMetrics) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		route, ns := m.route(r)
+
+		if route == "upload" {
+			m.uploads.Add(1)
+			defer m.uploads.Add(-1)
+		}
+
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+
+		if sw.code == 0 {
+			sw.code = http.StatusOK
+		}
+
+		code := strconv.Itoa(sw.code)
+		method := methodLabel(r.Method)
+		m.requests.Inc(route, ns, method, code)
+		m.latency.Observe(time.Since(start).Seconds(), route, ns, method, code)
+		m.uploaded.Add(float64(body.n), route, ns)
+		m.downloaded.Add(float64(sw.n), route, ns)
+	})
+}
+
+// storage returns sto with its operations measured.
+func (m *serverMetrics) storage(sto blobserver.ContextStorage, backend, ns string) blobserver.ContextStorage {
+	return &metricsStorage{ContextStorage: sto, m: m, backend: backend, ns: ns}
+}
+
+// metricsStorage measures the latency and errors of storage operations.
+type metricsStorage struct {
+	blobserver.ContextStorage
+	m           *serverMetrics
+	backend, ns string
+}
+
+func (s *metricsStorage) observe(op string, start time.Time, err error) {
+	s.m.storageLatency.Observe(time.Since(start).Seconds(), s.backend, s.ns, op)
+
+	if err != nil && err != blobserver.ErrNotFound {
+		s.m.storageErrors.Inc(s.backend, s.ns, op)
+	}
+}
+
+func (s *metricsStorage) FetchContext(ctx context.Context, br blob.Ref) (io.ReadCloser, uint32, error) {
+	start := time.Now()
+	rc, size, err := s.ContextStorage.FetchContext(ctx, br)
+	s.observe("fetch", start, err)
+	return rc, size, err
+}
+
+func (s *metricsStorage) ReceiveBlobContext(ctx context.Context, br blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	start := time.Now()
+	sb, err := s.ContextStorage.ReceiveBlobContext(ctx, br, source)
+	s.observe("receive", start, err)
+	return sb, err
+}
+
+func (s *metricsStorage) ReceiveBlobOptions(ctx context.Context, br blob.Ref, source io.Reader, opts blob.Options) (blob.SizedRef, error) {
+	start := time.Now()
+	sb, err := blobserver.ReceiveBlobOptions(ctx, s.ContextStorage, br, source, opts)
+	s.observe("receive", start, err)
+	return sb, err
+}
+
+func (s *metricsStorage) StatBlobsContext(ctx context.Context, dest chan<- blob.SizedInfoRef, blobs []blob.Ref) error {
+	start := time.Now()
+	err := s.ContextStorage.StatBlobsContext(ctx, dest, blobs)
+	s.observe("stat", start, err)
+	return err
+}
+
+func (s *metricsStorage) RemoveBlobsContext(ctx context.Context, blobs []blob.Ref) error {
+	start := time.Now()
+	err := s.ContextStorage.RemoveBlobsContext(ctx, blobs)
+	s.observe("remove", start, err)
+	return err
+}
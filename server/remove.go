@@ -18,8 +18,10 @@ limitations under the License.
 package server
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"sync"
 
 	"github.com/gorilla/mux"
 	"github.com/simonz05/blobserver"
@@ -27,16 +29,21 @@ import (
 	"github.com/simonz05/blobserver/protocol"
 	"github.com/simonz05/util/httputil"
 	"github.com/simonz05/util/log"
+	"github.com/simonz05/util/syncutil"
 )
 
 const maxRemovesPerRequest = 1000
 
+var removeGate = syncutil.NewGate(20) // arbitrary
+
 // createBatchRemoveHandler returns the handler that removes blobs
-func createBatchRemoveHandler(storage blobserver.Storage) http.Handler {
+func createBatchRemoveHandler(storage blobserver.ContextBlobRemover) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 		res, err := handleBatchRemove(r, storage)
-		if err != nil {
+		if err != nil && res == nil {
 			httputil.ServeJSONError(rw, err)
+		} else if err != nil {
+			httputil.ReturnJSONCode(rw, err.(httpError).HTTPCode(), res)
 		} else {
 			httputil.ReturnJSON(rw, res)
 		}
@@ -44,7 +51,7 @@ func createBatchRemoveHandler(storage blobserver.Storage) http.Handler {
 }
 
 // createRemoveHandler returns the handler that removes blob a single blob at path
-func createRemoveHandler(storage blobserver.Storage) http.Handler {
+func createRemoveHandler(storage blobserver.ContextBlobRemover) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 		res, err := handleRemove(r, storage)
 		if err != nil {
@@ -55,54 +62,127 @@ func createRemoveHandler(storage blobserver.Storage) http.Handler {
 	})
 }
 
-func handleBatchRemove(req *http.Request, storage blobserver.Storage) (interface{}, error) {
-	res := new(protocol.RemoveResponse)
-	n := 0
-	toRemove := make([]blob.Ref, 0)
+// handleBatchRemove removes the blobs given either as a JSON
+// protocol.BatchRequest body or as form values blob1 to blobN. If any
+// blob failed, the response is returned together with an httpError:
+// 207 if some were removed, or else the most severe status of the
+// failures.
+func handleBatchRemove(req *http.Request, storage blobserver.ContextBlobRemover) (*protocol.RemoveResponse, error) {
+	var values []string
+
+	if isJSONRequest(req) {
+		var err error
+		values, err = parseBatchRequest(req, maxRemovesPerRequest)
+
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for n := 1; ; n++ {
+			if n > maxRemovesPerRequest {
+				return nil, newRateLimitError(maxRemovesPerRequest)
+			}
+
+			value := req.FormValue(fmt.Sprintf("blob%v", n))
+
+			if value == "" {
+				break
+			}
+
+			values = append(values, value)
+		}
+	}
+
+	toRemove := make([]blob.Ref, 0, len(values))
 
-	for {
-		n++
-		if n > maxRemovesPerRequest {
-			return nil, newRateLimitError(maxRemovesPerRequest)
+	for _, value := range values {
+		if value == "" {
+			continue
 		}
 
-		key := fmt.Sprintf("blob%v", n)
-		value := req.FormValue(key)
 		ref, ok := blob.Parse(value)
 
 		if !ok {
-			break
+			return nil, newHTTPError("Bogus blobref for value", http.StatusBadRequest)
 		}
 
 		toRemove = append(toRemove, ref)
 	}
 
-	err := storage.RemoveBlobs(toRemove)
-
-	if err != nil {
-		log.Errorf("Server error during remove: %v", err)
-		return nil, newHTTPError("Server error", http.StatusInternalServerError)
-	}
-
-	res.Removed = toRemove
-	return res, nil
+	return removeBlobs(req.Context(), storage, toRemove)
 }
 
-func handleRemove(req *http.Request, storage blobserver.Storage) (interface{}, error) {
-	res := new(protocol.RemoveResponse)
+func handleRemove(req *http.Request, storage blobserver.ContextBlobRemover) (interface{}, error) {
 	vars := mux.Vars(req)
 	ref, ok := blob.Parse(vars["blobRef"])
 	if !ok {
 		return nil, newHTTPError("Invalid blob ref", http.StatusBadRequest)
 	}
+
+	res := new(protocol.RemoveResponse)
 	toRemove := []blob.Ref{ref}
-	err := storage.RemoveBlobs(toRemove)
 
-	if err != nil {
-		log.Errorf("Server error during remove: %v", err)
-		return nil, newHTTPError("Server error", http.StatusInternalServerError)
+	if err := storage.RemoveBlobsContext(req.Context(), toRemove); err != nil {
+		log.Errorf("Server error during remove %v: %v", ref, err)
+		return nil, newStorageError(err)
 	}
 
 	res.Removed = toRemove
 	return res, nil
 }
+
+// removeBlobs removes each blob on its own so that failures can be
+// reported per ref in RemoveResponse.Error.
+func removeBlobs(ctx context.Context, storage blobserver.ContextBlobRemover, toRemove []blob.Ref) (*protocol.RemoveResponse, error) {
+	res := new(protocol.RemoveResponse)
+	errs := make([]error, len(toRemove))
+	var wg sync.WaitGroup
+
+	for i, br := range toRemove {
+		if err := removeGate.StartContext(ctx); err != nil {
+			errs[i] = err
+			continue
+		}
+		wg.Add(1)
+		go func(i int, br blob.Ref) {
+			defer wg.Done()
+			defer removeGate.Done()
+			errs[i] = storage.RemoveBlobsContext(ctx, []blob.Ref{br})
+		}(i, br)
+	}
+
+	wg.Wait()
+	var failed *httpError
+
+	for i, err := range errs {
+		if err == nil {
+			res.Removed = append(res.Removed, toRemove[i])
+			continue
+		}
+
+		log.Errorf("Server error during remove %v: %v", toRemove[i], err)
+
+		if res.Error == nil {
+			res.Error = make(map[string]string)
+		}
+
+		e := newStorageError(err)
+		res.Error[toRemove[i].String()] = e.message
+
+		if failed == nil || e.code > failed.code {
+			failed = &e
+		}
+	}
+
+	if failed == nil {
+		return res, nil
+	}
+
+	msg := fmt.Sprintf("%d of %d blobs failed", len(res.Error), len(toRemove))
+
+	if len(res.Removed) > 0 {
+		return res, newHTTPError(msg, http.StatusMultiStatus)
+	}
+
+	return res, newHTTPError(msg, failed.code)
+}
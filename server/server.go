@@ -7,41 +7,277 @@
 package server
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/simonz05/blobserver"
+	"github.com/simonz05/blobserver/config"
+	"github.com/simonz05/blobserver/quota"
 	"github.com/simonz05/util/handler"
 	"github.com/simonz05/util/log"
 	"github.com/simonz05/util/pat"
 	"github.com/simonz05/util/sig"
 )
 
-func setupServer(storage blobserver.Storage) (err error) {
+// namespaceName matches the names of namespaces. blob, config and
+// usage are taken by the routes of the default storage.
+var namespaceName = regexp.MustCompile(`^[[:alnum:]_-]+$`)
+
+// apiHandler is the HTTP handler of the blobserver API. Health probes
+// are served before any middleware, so they are neither logged,
+// authenticated nor rate limited.
+type apiHandler struct {
+	http.Handler
+	health   *health
+	storages map[string]blobserver.Storage // keyed by namespace
+	usage    quota.Store                   // optional
+}
+
+func (h *apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/healthz":
+		serveHealthz(w, r)
+	case "/readyz":
+		h.health.serveReadyz(w, r)
+	default:
+		h.Handler.ServeHTTP(w, r)
+	}
+}
+
+// newHandler returns the HTTP handler of the blobserver API. The
+// storage is served at the API root and every storage of namespaces
+// below the root, in a path element of its name.
+func newHandler(conf *config.Config, storage blobserver.Storage, namespaces map[string]blobserver.Storage) (*apiHandler, error) {
+	auth, err := newAuthenticator(conf.Auth)
+
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := newSigner(conf.Signing)
+
+	if err != nil {
+		return nil, err
+	}
+
+	storages := map[string]blobserver.Storage{"": storage}
+
+	for name, sto := range namespaces {
+		storages[name] = sto
+	}
+
+	health, err := newHealth(conf.Health, storages)
+
+	if err != nil {
+		return nil, err
+	}
+
 	router := mux.NewRouter()
+	a, err := newAPI(conf, router)
+
+	if err != nil {
+		return nil, err
+	}
+
+	router.Handle("/metrics", requireScope(scopeAdmin, a.metrics.registry)).Name("metrics")
+	root := router.PathPrefix("/v1/api/blobserver").Subrouter()
 
-	sub := router.PathPrefix("/v1/api/blobserver/blob").Subrouter()
-	pat.Post(sub, "/upload/", createUploadHandler(storage))
-	pat.Delete(sub, `/remove/{blobRef:[[:alnum:]_\/\.-]+}/`, createRemoveHandler(storage))
-	pat.Post(sub, "/remove/", createBatchRemoveHandler(storage))
-	pat.Get(sub, `/stat/{blobRef:[[:alnum:]_\/\.-]+}/`, createStatHandler(storage))
-	pat.Head(sub, `/stat/{blobRef:[[:alnum:]_\/\.-]+}/`, createStatHandler(storage))
-	pat.Get(sub, "/stat/", createBatchStatHandler(storage))
+	for name, sto := range namespaces {
+		if !namespaceName.MatchString(name) || name == "blob" || name == "config" || name == "usage" {
+			return nil, fmt.Errorf("Invalid namespace name %q", name)
+		}
 
-	sub = router.PathPrefix("/v1/api/blobserver").Subrouter()
-	pat.Get(sub, "/config/", createConfigHandler(storage))
+		a.routes(root.PathPrefix("/"+name).Subrouter(), sto, name)
+	}
+
+	a.routes(root, storage, "")
 
 	router.StrictSlash(false)
+	cors, err := newCORS(conf.CORS, router)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// global middleware, the last one runs first.
+	var middleware []func(http.Handler) http.Handler
+
+	// clients are limited by their token once authenticated.
+	if a.limits != nil {
+		middleware = append(middleware, a.limits.handler)
+	}
 
-	// global middleware
-	wrapped := handler.Use(router, handler.LogHandler, handler.RecoveryHandler)
-	http.Handle("/", wrapped)
-	return nil
+	if auth != nil {
+		middleware = append(middleware, auth.handler)
+	}
+
+	if signer != nil {
+		middleware = append(middleware, signer.handler)
+	}
+
+	// preflight requests carry no credentials, so CORS runs before
+	// authentication.
+	if cors != nil {
+		middleware = append(middleware, cors.handler)
+	}
+
+	middleware = append(middleware, a.metrics.handler, handler.LogHandler, handler.RecoveryHandler)
+	return &apiHandler{handler.Use(router, middleware...), health, storages, a.usage}, nil
 }
 
-func ListenAndServe(laddr string, storage blobserver.Storage) error {
-	if err := setupServer(storage); err != nil {
+// newUsageStore returns the store of the usage of namespaces, or nil if
+// usage isn't tracked.
+func newUsageStore(conf *config.Config) (quota.Store, error) {
+	if conf.Usage == nil {
+		if conf.Quota != nil {
+			return nil, fmt.Errorf("quota needs [usage]")
+		}
+
+		for _, ns := range conf.Namespaces {
+			if ns.Quota != nil {
+				return nil, fmt.Errorf("quota of namespace %q needs [usage]", ns.Name)
+			}
+		}
+
+		return nil, nil
+	}
+
+	return quota.NewStore(conf.Usage)
+}
+
+// api serves the storages of namespaces.
+type api struct {
+	conf    *config.Config
+	usage   quota.Store // optional
+	quotas  map[string]*config.QuotaConfig
+	limits  *limiter // optional
+	metrics *serverMetrics
+}
+
+// newAPI returns the API of the routes of router.
+func newAPI(conf *config.Config, router *mux.Router) (*api, error) {
+	usage, err := newUsageStore(conf)
+
+	if err != nil {
+		return nil, err
+	}
+
+	limits, err := newLimiter(conf.RateLimit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	a := &api{
+		conf:    conf,
+		usage:   usage,
+		quotas:  map[string]*config.QuotaConfig{"": conf.Quota},
+		limits:  limits,
+		metrics: newServerMetrics(router, limits),
+	}
+
+	for _, ns := range conf.Namespaces {
+		a.quotas[ns.Name] = ns.Quota
+	}
+
+	return a, nil
+}
+
+// backend returns the storage type of the namespace ns.
+func (a *api) backend(ns string) string {
+	conf := a.conf
+
+	for i := range a.conf.Namespaces {
+		if nc := &a.conf.Namespaces[i]; nc.Name == ns {
+			conf = a.conf.Namespace(nc)
+		}
+	}
+
+	if typ := conf.StorageType(); typ != "" {
+		return typ
+	}
+
+	return "unknown"
+}
+
+// routes registers the API of storage, which serves the namespace ns,
+// on sub.
+func (a *api) routes(sub *mux.Router, storage blobserver.Storage, ns string) {
+	var cs blobserver.ContextStorage = newTimeoutStorage(blobserver.NewContextStorage(storage), a.conf.Timeout)
+	cs = a.metrics.storage(cs, a.backend(ns), ns)
+	var qs *quota.Storage
+
+	if a.usage != nil {
+		qs = quota.NewStorage(cs, a.usage, ns, a.quotas[ns])
+		cs = qs
+	}
+
+	upload := createUploadHandler(cs)
+
+	if a.limits != nil {
+		upload = a.limits.upload(upload)
+	}
+
+	name := func(r *mux.Route, name string) {
+		a.metrics.name(r, name, ns)
+	}
+
+	blob := sub.PathPrefix("/blob").Subrouter()
+	name(pat.Post(blob, "/upload/", requireScope(scopeUpload, upload)), "upload")
+	name(pat.Get(blob, `/get/{blobRef:[[:alnum:]_\/\.-]+}/`, requireScope(scopeRead, createFetchHandler(cs, storage))), "get")
+	name(pat.Head(blob, `/get/{blobRef:[[:alnum:]_\/\.-]+}/`, requireScope(scopeRead, createFetchHandler(cs, storage))), "get")
+	name(pat.Delete(blob, `/remove/{blobRef:[[:alnum:]_\/\.-]+}/`, requireScope(scopeRemove, createRemoveHandler(cs))), "remove")
+	name(pat.Post(blob, "/remove/", requireScope(scopeRemove, createBatchRemoveHandler(cs))), "batch_remove")
+	name(pat.Get(blob, `/stat/{blobRef:[[:alnum:]_\/\.-]+}/`, requireScope(scopeRead, createStatHandler(cs))), "stat")
+	name(pat.Head(blob, `/stat/{blobRef:[[:alnum:]_\/\.-]+}/`, requireScope(scopeRead, createStatHandler(cs))), "stat")
+	name(pat.Get(blob, "/stat/", requireScope(scopeRead, createBatchStatHandler(cs))), "batch_stat")
+	name(pat.Post(blob, "/stat/", requireScope(scopeRead, createBatchStatHandler(cs))), "batch_stat")
+
+	name(pat.Get(sub, "/config/", requireScope(scopeRead, createConfigHandler(storage, ns))), "config")
+	name(pat.Get(sub, "/usage/", requireScope(scopeRead, createUsageHandler(qs))), "usage")
+}
+
+func setupServer(conf *config.Config, storage blobserver.Storage) (*apiHandler, error) {
+	namespaces, err := blobserver.CreateNamespaceStorages(conf)
+
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := newHandler(conf, storage, namespaces)
+
+	if err != nil {
+		return nil, err
+	}
+
+	http.Handle("/", h)
+	return h, nil
+}
+
+const (
+	// defaultDrainDelay is how long connections are still accepted on
+	// shutdown once the server reports it isn't ready, so load balancers
+	// see it and stop sending requests.
+	defaultDrainDelay = 5 * time.Second
+
+	// defaultShutdownTimeout is how long requests in flight are waited
+	// for on shutdown.
+	defaultShutdownTimeout = 30 * time.Second
+)
+
+func ListenAndServe(laddr string, conf *config.Config, storage blobserver.Storage) error {
+	h, err := setupServer(conf, storage)
+
+	if err != nil {
 		return err
 	}
 
@@ -53,8 +289,121 @@ func ListenAndServe(laddr string, storage blobserver.Storage) error {
 
 	log.Printf("Listen on %s", l.Addr())
 
-	sig.TrapCloser(l)
-	err = http.Serve(l, nil)
-	log.Printf("Shutting down ..")
+	delay := defaultDrainDelay
+
+	if conf.DrainDelay.Duration > 0 {
+		delay = conf.DrainDelay.Duration
+	}
+
+	timeout := defaultShutdownTimeout
+
+	if conf.ShutdownTimeout.Duration > 0 {
+		timeout = conf.ShutdownTimeout.Duration
+	}
+
+	return h.serve(&http.Server{}, l, delay, timeout, trapShutdown())
+}
+
+// trapShutdown returns a channel closed on SIGINT or SIGTERM. SIGHUP
+// restarts the process. A second SIGINT or SIGTERM exits at once.
+func trapShutdown() <-chan struct{} {
+	stop := make(chan struct{})
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	go func() {
+		stopping := false
+
+		for s := range c {
+			switch {
+			case s == syscall.SIGHUP:
+				log.Print("SIGHUP: restart process")
+
+				if err := sig.RestartProcess(); err != nil {
+					log.Fatal("failed to restart: " + err.Error())
+				}
+			case stopping:
+				log.Fatalf("%v: exit without waiting for requests in flight", s)
+			default:
+				stopping = true
+				close(stop)
+			}
+		}
+	}()
+
+	return stop
+}
+
+// serve serves srv on l until stop is closed. It then reports it isn't
+// ready, keeps accepting connections for delay so load balancers see
+// that, stops accepting connections and waits up to timeout for the
+// requests in flight, which are cut off after that. The storages which
+// implement io.Closer are closed last.
+func (h *apiHandler) serve(srv *http.Server, l net.Listener, delay, timeout time.Duration, stop <-chan struct{}) error {
+	errc := make(chan error, 1)
+
+	go func() {
+		errc <- srv.Serve(l)
+	}()
+
+	select {
+	case err := <-errc:
+		h.closeStorages()
+		return err
+	case <-stop:
+	}
+
+	log.Printf("Shutting down, draining for %v ..", delay)
+	h.health.drain()
+	time.Sleep(delay)
+
+	log.Printf("Stop accepting connections, waiting up to %v for requests in flight ..", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+
+	if err != nil {
+		log.Errorf("Requests in flight cut off: %v", err)
+		srv.Close()
+	}
+
+	<-errc
+
+	if cerr := h.closeStorages(); err == nil {
+		err = cerr
+	}
+
 	return err
 }
+
+// closeStorages closes the storages which implement io.Closer, and the
+// usage store, which may have changes to write. It returns the first
+// error.
+func (h *apiHandler) closeStorages() error {
+	var first error
+
+	if c, ok := h.usage.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Errorf("Close usage store: %v", err)
+			first = err
+		}
+	}
+
+	for name, sto := range h.storages {
+		c, ok := sto.(io.Closer)
+
+		if !ok {
+			continue
+		}
+
+		if err := c.Close(); err != nil {
+			log.Errorf("Close storage of namespace %q: %v", name, err)
+
+			if first == nil {
+				first = err
+			}
+		}
+	}
+
+	return first
+}
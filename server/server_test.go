@@ -3,36 +3,52 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/md5"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/garyburd/redigo/redis"
+	"github.com/simonz05/blobserver"
 	"github.com/simonz05/blobserver/blob"
+	"github.com/simonz05/blobserver/client"
+	"github.com/simonz05/blobserver/config"
 	"github.com/simonz05/blobserver/protocol"
 	"github.com/simonz05/blobserver/storagetest"
 	"github.com/simonz05/util/assert"
 	"github.com/simonz05/util/log"
+	"github.com/simonz05/util/session"
 )
 
 var (
 	once       sync.Once
 	serverAddr string
 	server     *httptest.Server
+	storage    blobserver.Storage
 )
 
 func startServer() {
-	sto := storagetest.NewFakeStorage()
-	err := setupServer(sto)
+	storage = storagetest.NewFakeStorage()
+	_, err := setupServer(&config.Config{}, storage)
 
 	if err != nil {
 		panic(err)
@@ -153,6 +169,425 @@ func TestServer(t *testing.T) {
 	}
 }
 
+func TestUploadContentMD5(t *testing.T) {
+	once.Do(startServer)
+	ast := assert.NewAssertWithName(t, "TestUploadContentMD5")
+
+	tests := []struct {
+		contents   string
+		contentMD5 string
+		code       int
+	}{
+		{"foo", md5Hash("foo"), 201},
+		{"foo", md5Base64("foo"), 201},
+		{"foo", md5Hash("fo"), 412},
+		{"foo", md5Base64("fo"), 412},
+	}
+
+	for i, tt := range tests {
+		filename := fmt.Sprintf("content-md5-%d.txt", i)
+		req, err := uploadRequestMD5("/blob/upload/", filename, tt.contents, tt.contentMD5)
+
+		if err != nil {
+			t.Fatalf("err creating request #%d - %v", i, err)
+		}
+
+		res, err := doReq(req)
+
+		if err != nil {
+			t.Fatalf("err sending request #%d - %v", i, err)
+		}
+
+		ur := new(protocol.UploadResponse)
+		parseResponse(t, res, ur)
+		ast.Equal(tt.code, res.StatusCode, i)
+
+		if tt.code == 201 {
+			ast.Equal(1, len(ur.Received), i)
+			ast.Equal(0, len(ur.Error), i)
+		} else {
+			ast.Equal(0, len(ur.Received), i)
+			ast.True(ur.Error[filename] != "", i)
+		}
+	}
+}
+
+func TestUploadPerFileResults(t *testing.T) {
+	once.Do(startServer)
+	ast := assert.NewAssertWithName(t, "TestUploadPerFileResults")
+
+	files := []testFile{
+		{"per-file-ok.txt", "foo", md5Hash("foo")},
+		{"per-file-bad.txt", "bar", md5Hash("baz")},
+	}
+
+	tests := []struct {
+		atomic   bool
+		code     int
+		received int
+		errors   int
+	}{
+		{false, 207, 1, 1},
+		{true, 412, 0, 2},
+	}
+
+	for i, tt := range tests {
+		args := url.Values{"use-filename": {"true"}}
+
+		if tt.atomic {
+			args.Set("atomic", "true")
+		}
+
+		req, err := multiUploadRequest("/blob/upload/", args, files)
+
+		if err != nil {
+			t.Fatalf("err creating request #%d - %v", i, err)
+		}
+
+		res, err := doReq(req)
+
+		if err != nil {
+			t.Fatalf("err sending request #%d - %v", i, err)
+		}
+
+		ur := new(protocol.UploadResponse)
+		parseResponse(t, res, ur)
+		ast.Equal(tt.code, res.StatusCode, i)
+		ast.Equal(tt.received, len(ur.Received), i)
+		ast.Equal(tt.errors, len(ur.Error), i)
+		ast.Equal(tt.errors, len(ur.Failed), i)
+
+		_, _, err = storage.Fetch(blob.NewRefFilename(files[0].name))
+		ast.Equal(tt.atomic, err != nil, i)
+		storage.RemoveBlobs([]blob.Ref{blob.NewRefFilename(files[0].name)})
+	}
+}
+
+func TestUploadSameNameErrors(t *testing.T) {
+	once.Do(startServer)
+	ast := assert.NewAssertWithName(t, "TestUploadSameNameErrors")
+
+	files := []testFile{
+		{"same-name.txt", "foo", md5Hash("bar")},
+		{"same-name.txt", "baz", md5Hash("qux")},
+	}
+
+	req, err := multiUploadRequest("/blob/upload/", url.Values{"use-filename": {"true"}}, files)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := doReq(req)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ur := new(protocol.UploadResponse)
+	parseResponse(t, res, ur)
+	ast.Equal(412, res.StatusCode)
+	ast.Equal(2, len(ur.Failed))
+
+	for i, f := range ur.Failed {
+		ast.Equal(i+1, f.Part)
+		ast.Equal("same-name.txt", f.Name)
+		ast.True(f.Error != "")
+	}
+}
+
+func md5Base64(text string) string {
+	sum := md5.Sum([]byte(text))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestStatMissing(t *testing.T) {
+	once.Do(startServer)
+	ast := assert.NewAssertWithName(t, "TestStatMissing")
+
+	req, err := uploadRequest("/blob/upload/", "stat-missing.txt", "foo")
+	ast.Nil(err)
+	res, err := doReq(req)
+	ast.Nil(err)
+	ur := new(protocol.UploadResponse)
+	parseResponse(t, res, ur)
+	ast.Equal(1, len(ur.Received))
+	ref := ur.Received[0].Ref
+
+	statArgs := url.Values{"blob": {"missing-1.txt", ref.String(), "missing-2.txt"}}
+	req, err = http.NewRequest("GET", absURL("/blob/stat/", statArgs), nil)
+	ast.Nil(err)
+	res, err = doReq(req)
+	ast.Nil(err)
+	ast.Equal(200, res.StatusCode)
+	sr := new(protocol.StatResponse)
+	parseResponse(t, res, sr)
+	ast.Equal(1, len(sr.Stat))
+	ast.Equal(ref.String(), sr.Stat[0].Path)
+	ast.Equal(md5Hash("foo"), sr.Stat[0].MD5)
+	ast.True(sr.Stat[0].ModTime != nil)
+	ast.True(strings.HasPrefix(sr.Stat[0].ContentType, "text/plain"))
+	ast.Equal(2, len(sr.Missing))
+	ast.Equal("missing-1.txt", sr.Missing[0].Path)
+	ast.Equal("missing-2.txt", sr.Missing[1].Path)
+
+	for _, method := range []string{"GET", "HEAD"} {
+		req, err = http.NewRequest(method, absURL("/blob/stat/missing-1.txt/", nil), nil)
+		ast.Nil(err)
+		res, err = doReq(req)
+		ast.Nil(err)
+		res.Body.Close()
+		ast.Equal(404, res.StatusCode, method)
+	}
+}
+
+func TestBatchJSON(t *testing.T) {
+	once.Do(startServer)
+	ast := assert.NewAssertWithName(t, "TestBatchJSON")
+
+	var refs []string
+
+	for i, v := range []string{"foo", "bar"} {
+		req, err := uploadRequest("/blob/upload/", fmt.Sprintf("batch-json-%d.txt", i), v)
+		ast.Nil(err)
+		res, err := doReq(req)
+		ast.Nil(err)
+		ur := new(protocol.UploadResponse)
+		parseResponse(t, res, ur)
+		ast.Equal(1, len(ur.Received))
+		refs = append(refs, ur.Received[0].Path)
+	}
+
+	// empty entries are skipped, not the end of the list.
+	body, err := json.Marshal(&protocol.BatchRequest{Blobs: []string{refs[0], "", refs[1], "batch-json-missing.txt"}})
+	ast.Nil(err)
+
+	req, err := http.NewRequest("POST", absURL("/blob/stat/", nil), bytes.NewReader(body))
+	ast.Nil(err)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := doReq(req)
+	ast.Nil(err)
+	ast.Equal(200, res.StatusCode)
+	sr := new(protocol.StatResponse)
+	parseResponse(t, res, sr)
+	ast.Equal(2, len(sr.Stat))
+	ast.Equal(1, len(sr.Missing))
+
+	req, err = http.NewRequest("POST", absURL("/blob/remove/", nil), bytes.NewReader(body))
+	ast.Nil(err)
+	req.Header.Set("Content-Type", "application/json")
+	res, err = doReq(req)
+	ast.Nil(err)
+	ast.Equal(200, res.StatusCode)
+	rr := new(protocol.RemoveResponse)
+	parseResponse(t, res, rr)
+	ast.Equal(3, len(rr.Removed))
+	ast.Equal(0, len(rr.Error))
+
+	body, err = json.Marshal(&protocol.BatchRequest{Blobs: make([]string, maxRemovesPerRequest+1)})
+	ast.Nil(err)
+	req, err = http.NewRequest("POST", absURL("/blob/remove/", nil), bytes.NewReader(body))
+	ast.Nil(err)
+	req.Header.Set("Content-Type", "application/json")
+	res, err = doReq(req)
+	ast.Nil(err)
+	res.Body.Close()
+	ast.Equal(400, res.StatusCode)
+}
+
+func TestStorageError(t *testing.T) {
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{blobserver.ErrNotFound, 404},
+		{blobserver.ErrAlreadyExists, 409},
+		{blobserver.ErrTooLarge, 413},
+		{blobserver.ErrPreconditionFailed, 412},
+		{blobserver.ErrQuotaExceeded, 507},
+		{blobserver.ErrBackendUnavailable, 503},
+		{fmt.Errorf("put object: %w", errDigestMismatch), 412},
+		{fmt.Errorf("secret backend detail"), 500},
+	}
+
+	for i, tt := range tests {
+		e := newStorageError(tt.err)
+		if e.HTTPCode() != tt.code {
+			t.Errorf("%d: exp %d got %d", i, tt.code, e.HTTPCode())
+		}
+		if tt.code == 500 && strings.Contains(e.Error(), "secret") {
+			t.Errorf("%d: backend error leaked: %v", i, e)
+		}
+	}
+}
+
+type failStorage struct {
+	blobserver.Storage
+}
+
+func (failStorage) RemoveBlobs(blobs []blob.Ref) error {
+	for _, br := range blobs {
+		if strings.HasPrefix(br.Path, "fail") {
+			return fmt.Errorf("cannot remove %v", br)
+		}
+	}
+	return nil
+}
+
+func TestRemoveBlobsPerRef(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRemoveBlobsPerRef")
+	refs := []blob.Ref{{Path: "ok-1"}, {Path: "fail-1"}, {Path: "ok-2"}}
+	res, err := removeBlobs(context.Background(), blobserver.NewContextStorage(failStorage{}), refs)
+	ast.Equal(2, len(res.Removed))
+	ast.Equal("ok-1", res.Removed[0].Path)
+	ast.Equal("ok-2", res.Removed[1].Path)
+	ast.Equal(1, len(res.Error))
+	ast.True(res.Error["fail-1"] != "")
+	ast.Equal(http.StatusMultiStatus, err.(httpError).HTTPCode())
+
+	// nothing removed is the status of the failures.
+	res, err = removeBlobs(context.Background(), blobserver.NewContextStorage(failStorage{}), []blob.Ref{{Path: "fail-1"}, {Path: "fail-2"}})
+	ast.Equal(0, len(res.Removed))
+	ast.Equal(2, len(res.Error))
+	ast.Equal(http.StatusInternalServerError, err.(httpError).HTTPCode())
+
+	res, err = removeBlobs(context.Background(), blobserver.NewContextStorage(failStorage{}), []blob.Ref{{Path: "ok-1"}})
+	ast.Equal(1, len(res.Removed))
+	ast.Nil(err)
+}
+
+type slowStorage struct {
+	blobserver.Storage
+}
+
+func (slowStorage) StatBlobs(dest chan<- blob.SizedInfoRef, blobs []blob.Ref) error {
+	time.Sleep(time.Second)
+	return nil
+}
+
+func TestStatTimeout(t *testing.T) {
+	conf := &config.TimeoutConfig{Stat: config.Duration{Duration: 10 * time.Millisecond}}
+	sto := newTimeoutStorage(blobserver.NewContextStorage(slowStorage{}), conf)
+	req := httptest.NewRequest("GET", "/v1/api/blobserver/blob/stat/a/", nil)
+	start := time.Now()
+	res, err := handleStat(req, sto, []string{"a"})
+
+	if err == nil {
+		t.Fatal("expected timeout error")
+	}
+
+	if code := err.(httpError).HTTPCode(); code != http.StatusGatewayTimeout {
+		t.Fatalf("exp %d got %d", http.StatusGatewayTimeout, code)
+	}
+
+	if res.Error["a"] == "" {
+		t.Fatalf("exp error for ref a, got %v", res.Error)
+	}
+
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("stat was not cancelled")
+	}
+}
+
+// optionsStorage records the options blobs are received with.
+type optionsStorage struct {
+	blobserver.ContextStorage
+	opts blob.Options
+}
+
+func (s *optionsStorage) ReceiveBlobOptions(ctx context.Context, br blob.Ref, source io.Reader, opts blob.Options) (blob.SizedRef, error) {
+	s.opts = opts
+	if opts.StorageClass == "bogus" {
+		return blob.SizedRef{}, blobserver.ErrInvalidOptions
+	}
+	return s.ReceiveBlobContext(ctx, br, source)
+}
+
+func TestUploadOptions(t *testing.T) {
+	sto := &optionsStorage{ContextStorage: blobserver.NewContextStorage(storage)}
+	args := url.Values{
+		"cache-control":          {"max-age=3600"},
+		"content-disposition":    {"attachment"},
+		"storage-class":          {"STANDARD_IA"},
+		"server-side-encryption": {"aws:kms"},
+		"kms-key-id":             {"key-1"},
+	}
+	req, err := multiUploadRequest("/blob/upload/", args, []testFile{{"foo.txt", "foo", ""}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := handleMultiPartUpload(req, sto); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+
+	exp := blob.Options{
+		CacheControl:         "max-age=3600",
+		ContentDisposition:   "attachment",
+		StorageClass:         "STANDARD_IA",
+		ServerSideEncryption: "aws:kms",
+		KMSKeyID:             "key-1",
+	}
+	if sto.opts != exp {
+		t.Fatalf("exp options %+v got %+v", exp, sto.opts)
+	}
+
+	args = url.Values{"storage-class": {"bogus"}}
+	req, _ = multiUploadRequest("/blob/upload/", args, []testFile{{"foo.txt", "foo", ""}})
+	_, err = handleMultiPartUpload(req, sto)
+
+	if err == nil || err.(httpError).HTTPCode() != http.StatusBadRequest {
+		t.Fatalf("exp %d got %v", http.StatusBadRequest, err)
+	}
+}
+
+type testFile struct {
+	name       string
+	contents   string
+	contentMD5 string
+}
+
+func uploadRequestMD5(path, name, contents, contentMD5 string) (req *http.Request, err error) {
+	return multiUploadRequest(path, nil, []testFile{{name, contents, contentMD5}})
+}
+
+func multiUploadRequest(path string, args url.Values, files []testFile) (req *http.Request, err error) {
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+
+	for _, f := range files {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, f.name))
+		h.Set("Content-Type", "application/octet-stream")
+
+		if f.contentMD5 != "" {
+			h.Set("Content-MD5", f.contentMD5)
+		}
+
+		part, err := w.CreatePart(h)
+
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+
+		if _, err = io.WriteString(part, f.contents); err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+
+	w.Close()
+	req, err = http.NewRequest("POST", absURL(path, args), &b)
+
+	if err != nil {
+		return
+	}
+
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	return
+}
+
 func uploadRequest(path, name, contents string) (req *http.Request, err error) {
 	var b bytes.Buffer
 	w := multipart.NewWriter(&b)
@@ -235,3 +670,1047 @@ func absURL(endpoint string, args url.Values) string {
 
 	return fmt.Sprintf("http://%s/v1/api/blobserver%s%s", serverAddr, endpoint, params)
 }
+
+// fakeSessions is a session.Storage holding sessions in memory.
+type fakeSessions map[string]*session.Session
+
+func (s fakeSessions) Read(id string) (*session.Session, error) {
+	if ses, ok := s[id]; ok {
+		return ses, nil
+	}
+	return nil, redis.ErrNil
+}
+
+func (s fakeSessions) Write(ses *session.Session) error {
+	s[ses.Id] = ses
+	return nil
+}
+
+func TestAuth(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestAuth")
+	conf := &config.Config{Auth: &config.AuthConfig{
+		Tokens: []config.TokenConfig{
+			{Name: "reader", Token: "reader-token", Scopes: []string{"read"}},
+			{Name: "uploader", Token: "uploader-token", Scopes: []string{"read", "upload"}},
+			{Name: "admin", Token: "admin-token", Scopes: []string{"admin"}},
+		},
+	}}
+
+	h, err := newHandler(conf, storagetest.NewFakeStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	base := srv.URL + "/v1/api/blobserver"
+
+	tests := []struct {
+		method, path, token string
+		code                int
+	}{
+		{"GET", "/config/", "", 401},
+		{"GET", "/blob/stat/?blob=a", "", 401},
+		{"GET", "/blob/stat/?blob=a", "bogus", 401},
+		{"GET", "/blob/stat/?blob=a", "reader-token", 200},
+		{"POST", "/blob/upload/", "reader-token", 403},
+		{"POST", "/blob/upload/", "uploader-token", 201},
+		{"DELETE", "/blob/remove/a/", "uploader-token", 403},
+		{"DELETE", "/blob/remove/a/", "admin-token", 200},
+	}
+
+	for i, tt := range tests {
+		var req *http.Request
+
+		if tt.method == "POST" {
+			// upload requests are made for the shared test server.
+			req, err = uploadRequest("/blob/upload/", fmt.Sprintf("auth-%d.txt", i), "foo")
+			if err == nil {
+				req.URL, _ = url.Parse(base + tt.path)
+				req.Host = req.URL.Host
+			}
+		} else {
+			req, err = http.NewRequest(tt.method, base+tt.path, nil)
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+
+		res, err := doReq(req)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		res.Body.Close()
+
+		ast.Equal(tt.code, res.StatusCode, i)
+
+		if tt.code == 401 {
+			ast.True(res.Header.Get("WWW-Authenticate") != "", i)
+		}
+	}
+}
+
+func TestAuthSessions(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestAuthSessions")
+	a, err := newAuthenticator(&config.AuthConfig{
+		Anonymous: []string{"read"},
+		Tokens:    []config.TokenConfig{{Name: "uploader", Token: "uploader-token", Scopes: []string{"upload"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sessions are looked up when a token isn't configured.
+	a.sessionScopes = scopeRead | scopeUpload
+	a.sessions = fakeSessions{
+		"user":  {Id: "user"},
+		"admin": {Id: "admin", Mask: session.AdminMask, ProfileID: 1},
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		want  scope
+		token string
+		code  int
+	}{
+		{scopeRead, "", 200},
+		{scopeUpload, "", 401},
+		{scopeUpload, "uploader-token", 200},
+		{scopeRead, "uploader-token", 403},
+		{scopeUpload, "user", 200},
+		{scopeRemove, "user", 403},
+		{scopeRemove, "admin", 200},
+		{scopeAdmin, "admin", 200},
+		{scopeRead, "unknown", 401},
+	}
+
+	for i, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+
+		rec := httptest.NewRecorder()
+		a.handler(requireScope(tt.want, ok)).ServeHTTP(rec, req)
+		ast.Equal(tt.code, rec.Code, i)
+	}
+
+	if _, err := newAuthenticator(&config.AuthConfig{Anonymous: []string{"everything"}}); err == nil {
+		t.Error("unknown scope accepted")
+	}
+}
+
+func TestSignedURLs(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestSignedURLs")
+	conf := &config.Config{
+		Auth: &config.AuthConfig{
+			Tokens: []config.TokenConfig{{Name: "reader", Token: "reader-token", Scopes: []string{"read"}}},
+		},
+		Signing: &config.SigningConfig{
+			Keys: []config.SigningKeyConfig{{ID: "k1", Secret: "secret"}},
+		},
+	}
+
+	h, err := newHandler(conf, storagetest.NewFakeStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	base := srv.URL + "/v1/api/blobserver"
+	key := client.SigningKey{ID: "k1", Secret: "secret"}
+	expires := time.Now().Add(time.Hour)
+
+	sign := func(p client.UploadPolicy, expires time.Time) string {
+		u, err := key.UploadURL(base, p, expires)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	upload := func(u, name, contents string) int {
+		req, err := multiUploadRequest("/blob/upload/", nil, []testFile{{name: name, contents: contents}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.URL, _ = url.Parse(u)
+		req.Host = req.URL.Host
+		res, err := doReq(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	policy := client.UploadPolicy{Prefix: "user1-", MaxSize: 10, ContentType: "application/*"}
+	u := sign(policy, expires)
+	ast.Equal(201, upload(u, "user1-a.txt", "foo"))
+	ast.Equal(403, upload(u, "other.txt", "foo"))
+	ast.Equal(413, upload(u, "user1-big.txt", strings.Repeat("x", 11)))
+	ast.Equal(401, upload(base+"/blob/upload/", "user1-b.txt", "foo"))
+	ast.Equal(415, upload(sign(client.UploadPolicy{Prefix: "user1-", ContentType: "image/*"}, expires), "user1-c.txt", "foo"))
+	ast.Equal(403, upload(sign(policy, time.Now().Add(-time.Minute)), "user1-d.txt", "foo"))
+	ast.Equal(403, upload(sign(policy, time.Now().Add(48*time.Hour)), "user1-e.txt", "foo"))
+	ast.Equal(403, upload(strings.Replace(u, "user1-", "user2-", 1), "user2-a.txt", "foo"))
+	ast.Equal(403, upload(strings.Replace(u, "k1", "k2", 1), "user1-f.txt", "foo"))
+
+	// refs are compared as uploads are stored, with .bin added.
+	u = sign(client.UploadPolicy{Ref: "avatar"}, expires)
+	ast.Equal(201, upload(u, "avatar", "foo"))
+	ast.Equal(403, upload(u, "avatar.png", "foo"))
+	ast.Equal(201, upload(sign(client.UploadPolicy{Ref: "avatar.bin"}, expires), "avatar", "foo"))
+
+	// uploads are named by base name, so slashes can't match.
+	_, err = key.UploadURL(base, client.UploadPolicy{Prefix: "user1/"}, expires)
+	ast.Equal(protocol.ErrUploadPath, err)
+	_, err = key.UploadURL(base, client.UploadPolicy{Ref: "user1/a.txt"}, expires)
+	ast.Equal(protocol.ErrUploadPath, err)
+
+	for _, args := range []url.Values{{protocol.SignPrefix: {"user1/"}}, {protocol.SignRef: {"user1/a"}}} {
+		args.Set(protocol.SignKey, "k1")
+		args.Set(protocol.SignExpires, strconv.FormatInt(expires.Unix(), 10))
+		args.Set(protocol.SignSignature, protocol.Signature([]byte("secret"), "POST", "/v1/api/blobserver/blob/upload/", args))
+		ast.Equal(400, upload(base+"/blob/upload/?"+args.Encode(), "a.txt", "foo"))
+	}
+
+	get := func(method, u, token string) (int, string) {
+		req, err := http.NewRequest(method, u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		res, err := doReq(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	d, err := key.DownloadURL(base, "user1-a.txt", expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := get("GET", d, "")
+	ast.Equal(200, code)
+	ast.Equal("foo", body)
+	code, _ = get("HEAD", d, "")
+	ast.Equal(200, code)
+
+	// the signature covers the ref.
+	code, _ = get("GET", strings.Replace(d, "user1-a.txt", "user1-big.txt", 1), "")
+	ast.Equal(403, code)
+	code, _ = get("GET", base+"/blob/get/user1-a.txt/", "")
+	ast.Equal(401, code)
+	code, body = get("GET", base+"/blob/get/user1-a.txt/", "reader-token")
+	ast.Equal(200, code)
+	ast.Equal("foo", body)
+	code, _ = get("GET", base+"/blob/get/missing.txt/", "reader-token")
+	ast.Equal(404, code)
+}
+
+// signingStorage redirects downloads of blobs to url + ref, unless
+// url is empty.
+type signingStorage struct {
+	blobserver.Storage
+	url string
+}
+
+func (s signingStorage) SignedURL(ctx context.Context, br blob.Ref) (string, error) {
+	if s.url == "" {
+		return "", blobserver.ErrNoSignedURL
+	}
+	return s.url + br.Path, nil
+}
+
+func TestFetchRedirect(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestFetchRedirect")
+	noFollow := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	for _, cdn := range []string{"https://cdn.example.com/", ""} {
+		sto := signingStorage{storagetest.NewFakeStorage(), cdn}
+		b := storagetest.NewBlob("foo")
+
+		if _, err := sto.ReceiveBlob(b.BlobRef, b.Reader()); err != nil {
+			t.Fatal(err)
+		}
+
+		h, err := newHandler(&config.Config{}, sto, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		srv := httptest.NewServer(h)
+		u := srv.URL + "/v1/api/blobserver/blob/get/" + b.BlobRef.Path + "/"
+
+		res, err := noFollow.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if cdn != "" {
+			ast.Equal(302, res.StatusCode)
+			ast.Equal(cdn+b.BlobRef.Path, res.Header.Get("Location"))
+		} else {
+			ast.Equal(200, res.StatusCode)
+			ast.Equal("foo", string(body))
+		}
+
+		// HEAD requests are always answered by the server.
+		res, err = noFollow.Head(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		ast.Equal(200, res.StatusCode)
+		ast.Equal("3", res.Header.Get("Content-Length"))
+
+		srv.Close()
+	}
+}
+
+// configStorage is a fake storage with a CDN.
+type configStorage struct {
+	blobserver.Storage
+	cdn string
+}
+
+func (s configStorage) Config() *blobserver.Config {
+	return &blobserver.Config{CDNUrl: s.cdn, Name: "fake"}
+}
+
+func TestNamespaces(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestNamespaces")
+	storages := map[string]blobserver.Storage{
+		"":  configStorage{storagetest.NewFakeStorage(), "https://cdn.example.com/"},
+		"a": configStorage{storagetest.NewFakeStorage(), "https://a.example.com/"},
+		"b": configStorage{storagetest.NewFakeStorage(), "https://b.example.com/"},
+	}
+
+	namespaces := map[string]blobserver.Storage{"a": storages["a"], "b": storages["b"]}
+	h, err := newHandler(&config.Config{}, storages[""], namespaces)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	root := func(ns string) string {
+		if ns == "" {
+			return srv.URL + "/v1/api/blobserver"
+		}
+		return srv.URL + "/v1/api/blobserver/" + ns
+	}
+
+	// the same filename is a different blob in every namespace.
+	for _, ns := range []string{"", "a", "b"} {
+		req, err := multiUploadRequest("/blob/upload/", nil, []testFile{{name: "same.txt", contents: "ns " + ns}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.URL, _ = url.Parse(root(ns) + "/blob/upload/?use-filename=1")
+		req.Host = req.URL.Host
+		res, err := doReq(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		ast.Equal(201, res.StatusCode, ns)
+
+		res, err = http.Get(root(ns) + "/config/")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cr := new(protocol.ConfigResponse)
+		parseResponse(t, res, cr)
+		ast.Equal(ns, cr.Data.Namespace, ns)
+		ast.Equal(storages[ns].(configStorage).cdn, cr.Data.CDNUrl, ns)
+	}
+
+	for _, ns := range []string{"", "a", "b"} {
+		res, err := http.Get(root(ns) + "/blob/get/same.txt/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		ast.Equal("ns "+ns, string(body), ns)
+	}
+
+	res, err := http.Get(root("c") + "/blob/get/same.txt/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	ast.Equal(404, res.StatusCode)
+
+	for _, name := range []string{"blob", "config", "usage", "a/b", ""} {
+		_, err := newHandler(&config.Config{}, storages[""], map[string]blobserver.Storage{name: storages["a"]})
+		ast.True(err != nil, name)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestUsage")
+	dir, err := ioutil.TempDir("", "usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &config.Config{
+		Quota:      &config.QuotaConfig{Bytes: 10},
+		Usage:      &config.UsageConfig{File: filepath.Join(dir, "usage.json")},
+		Namespaces: []config.NamespaceConfig{{Name: "a", Quota: &config.QuotaConfig{Objects: 1}}},
+	}
+	namespaces := map[string]blobserver.Storage{"a": storagetest.NewFakeStorage()}
+	h, err := newHandler(conf, storagetest.NewFakeStorage(), namespaces)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	upload := func(root, name, contents string) int {
+		req, err := multiUploadRequest("/blob/upload/", nil, []testFile{{name: name, contents: contents}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.URL, _ = url.Parse(srv.URL + root + "/blob/upload/?use-filename=1")
+		req.Host = req.URL.Host
+		res, err := doReq(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	usage := func(root string) *protocol.Usage {
+		res, err := http.Get(srv.URL + root + "/usage/")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ur := new(protocol.UsageResponse)
+		parseResponse(t, res, ur)
+		return ur.Data
+	}
+
+	root := "/v1/api/blobserver"
+	ast.Equal(201, upload(root, "a.txt", "12345678"))
+	ast.Equal(413, upload(root, "b.txt", "123"))
+	ast.Equal(201, upload(root, "b.txt", "12"))
+	ast.Equal(507, upload(root, "c.txt", "1"))
+	ast.Equal(protocol.Usage{Bytes: 10, Objects: 2, MaxBytes: 10}, *usage(root))
+
+	ast.Equal(201, upload(root+"/a", "a.txt", "123"))
+	ast.Equal(507, upload(root+"/a", "b.txt", "1"))
+	ast.Equal(protocol.Usage{Namespace: "a", Bytes: 3, Objects: 1, MaxObjects: 1}, *usage(root + "/a"))
+
+	// a quota without usage tracking can't be enforced.
+	conf.Usage = nil
+	_, err = newHandler(conf, storagetest.NewFakeStorage(), nil)
+	ast.True(err != nil)
+}
+
+func TestCORS(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestCORS")
+	conf := &config.Config{
+		Auth: &config.AuthConfig{Tokens: []config.TokenConfig{{Name: "t", Token: "secret", Scopes: []string{"admin"}}}},
+		CORS: &config.CORSConfig{
+			Origins:     []string{"https://app.example.com", "https://*.example.org"},
+			Methods:     []string{"get", "post"},
+			MaxAge:      config.Duration{Duration: time.Hour},
+			Credentials: true,
+		},
+	}
+	h, err := newHandler(conf, storagetest.NewFakeStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	do := func(method, path, origin, reqMethod, reqHeaders string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if reqMethod != "" {
+			req.Header.Set("Access-Control-Request-Method", reqMethod)
+		}
+		if reqHeaders != "" {
+			req.Header.Set("Access-Control-Request-Headers", reqHeaders)
+		}
+		res, err := doReq(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	// preflight requests are answered without a token.
+	res := do("OPTIONS", "/v1/api/blobserver/blob/upload/", "https://app.example.com", "POST", "authorization, content-type")
+	ast.Equal(204, res.StatusCode)
+	ast.Equal("https://app.example.com", res.Header.Get("Access-Control-Allow-Origin"))
+	ast.Equal("GET, POST", res.Header.Get("Access-Control-Allow-Methods"))
+	ast.Equal("Authorization, Content-Type", res.Header.Get("Access-Control-Allow-Headers"))
+	ast.Equal("3600", res.Header.Get("Access-Control-Max-Age"))
+	ast.Equal("true", res.Header.Get("Access-Control-Allow-Credentials"))
+
+	res = do("OPTIONS", "/v1/api/blobserver/blob/get/a.txt/", "https://cdn.example.org", "GET", "")
+	ast.Equal(204, res.StatusCode)
+	ast.Equal("https://cdn.example.org", res.Header.Get("Access-Control-Allow-Origin"))
+
+	for _, tt := range []struct {
+		path, origin, method, headers string
+		code                          int
+	}{
+		{"/v1/api/blobserver/blob/upload/", "https://evil.example.com", "POST", "", 403},
+		{"/v1/api/blobserver/blob/upload/", "https://example.org", "POST", "", 403},
+		{"/v1/api/blobserver/blob/remove/a.txt/", "https://app.example.com", "DELETE", "", 403},
+		{"/v1/api/blobserver/blob/upload/", "https://app.example.com", "POST", "X-Custom", 403},
+		// preflights for unknown routes aren't answered.
+		{"/v1/api/blobserver/nothing/", "https://app.example.com", "GET", "", 404},
+		{"/v1/api/blobserver/blob/upload/", "https://app.example.com", "", "", 404},
+	} {
+		res = do("OPTIONS", tt.path, tt.origin, tt.method, tt.headers)
+		ast.Equal(tt.code, res.StatusCode, tt)
+	}
+
+	// actual requests get the headers and are still authenticated.
+	res = do("GET", "/v1/api/blobserver/config/", "https://app.example.com", "", "")
+	ast.Equal(401, res.StatusCode)
+	ast.Equal("https://app.example.com", res.Header.Get("Access-Control-Allow-Origin"))
+
+	res = do("GET", "/v1/api/blobserver/config/", "https://evil.example.com", "", "")
+	ast.Equal("", res.Header.Get("Access-Control-Allow-Origin"))
+
+	conf.CORS = &config.CORSConfig{Origins: []string{"https://*.*.example.com"}}
+	_, err = newHandler(conf, storagetest.NewFakeStorage(), nil)
+	ast.True(err != nil)
+
+	// any origin can't be allowed to send credentials.
+	conf.CORS = &config.CORSConfig{Origins: []string{"https://app.example.com", "*"}, Credentials: true}
+	_, err = newHandler(conf, storagetest.NewFakeStorage(), nil)
+	ast.True(err != nil)
+
+	conf.CORS.Credentials = false
+	h, err = newHandler(conf, storagetest.NewFakeStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wild := httptest.NewServer(h)
+	defer wild.Close()
+	req, _ := http.NewRequest("GET", wild.URL+"/v1/api/blobserver/config/", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	res, err = doReq(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	ast.Equal("https://evil.example.com", res.Header.Get("Access-Control-Allow-Origin"))
+	ast.Equal("", res.Header.Get("Access-Control-Allow-Credentials"))
+}
+
+func TestRateLimit(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestRateLimit")
+	conf := &config.Config{
+		Auth: &config.AuthConfig{
+			Anonymous: []string{"read"},
+			Tokens:    []config.TokenConfig{{Name: "t", Token: "secret", Scopes: []string{"read"}}},
+		},
+		RateLimit: &config.RateLimitConfig{Requests: 1, Burst: 2},
+	}
+	h, err := newHandler(conf, storagetest.NewFakeStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	get := func(token string) *http.Response {
+		req, _ := http.NewRequest("GET", srv.URL+"/v1/api/blobserver/blob/stat/a.txt/", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := doReq(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	ast.Equal(404, get("").StatusCode)
+	ast.Equal(404, get("").StatusCode)
+	res := get("")
+	ast.Equal(429, res.StatusCode)
+	ast.Equal("1", res.Header.Get("Retry-After"))
+
+	// a token has its own limit. Unknown tokens are turned away first.
+	ast.Equal(404, get("secret").StatusCode)
+	ast.Equal(401, get("other").StatusCode)
+	ast.Equal(429, get("").StatusCode)
+}
+
+func TestClientKey(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestClientKey")
+
+	tests := []struct {
+		proxies int
+		xff     []string
+		want    string
+	}{
+		{0, nil, "ip:192.0.2.1"},
+		{0, []string{"198.51.100.1"}, "ip:198.51.100.1"},
+		// the client may send any entries left of those of proxies.
+		{0, []string{"203.0.113.9, 198.51.100.1"}, "ip:198.51.100.1"},
+		{0, []string{"203.0.113.9", "198.51.100.1"}, "ip:198.51.100.1"},
+		{2, []string{"203.0.113.9, 198.51.100.1, 198.51.100.2"}, "ip:198.51.100.1"},
+		{3, []string{"198.51.100.1, 198.51.100.2"}, "ip:198.51.100.1"},
+	}
+
+	for i, tt := range tests {
+		l, err := newLimiter(&config.RateLimitConfig{Requests: 1, IPHeader: "X-Forwarded-For", TrustedProxies: tt.proxies})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		for _, v := range tt.xff {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+
+		ast.Equal(tt.want, l.clientKey(req), i)
+	}
+}
+
+func TestLimiterSweep(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestLimiterSweep")
+	l, err := newLimiter(&config.RateLimitConfig{Requests: 1, UploadBytes: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	a := httptest.NewRequest("GET", "/", nil)
+	a.RemoteAddr = "192.0.2.1:1234"
+	b := httptest.NewRequest("GET", "/", nil)
+	b.RemoteAddr = "192.0.2.2:1234"
+
+	uploading := l.client(a, now, true)
+	uploading.upload.debit(now, l.uploadRate, l.uploadBurst, 0)
+	idle := l.client(b, now, false)
+	idle.requests.take(now, l.requestRate, l.requestBurst, 1)
+
+	// clients uploading aren't forgotten, however long they're idle.
+	now = now.Add(time.Hour)
+	l.client(b, now, false)
+	ast.True(l.client(a, now, false) == uploading)
+	ast.True(l.client(b, now, false) != idle)
+
+	l.uploadDone(uploading)
+	now = now.Add(time.Hour)
+	l.client(b, now, false)
+	ast.True(l.client(a, now, false) != uploading)
+}
+
+func TestUploadLimit(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestUploadLimit")
+	l, err := newLimiter(&config.RateLimitConfig{UploadBytes: 1000, MaxUploads: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	l.now = func() time.Time { return now }
+	started := make(chan struct{})
+	release := make(chan struct{})
+	h := l.upload(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(ioutil.Discard, r.Body)
+		if n == 1 {
+			started <- struct{}{}
+			<-release
+		}
+		fmt.Fprint(w, n)
+	}))
+
+	upload := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/blob/upload/", strings.NewReader(body))
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		return rw
+	}
+
+	// the upload over the burst is slowed down, and leaves the client in
+	// debt until the bandwidth is back.
+	start := time.Now()
+	rw := upload(strings.Repeat("x", 1100))
+	ast.Equal(200, rw.Code)
+	ast.Equal("1100", rw.Body.String())
+	ast.True(time.Since(start) >= 100*time.Millisecond)
+
+	rw = upload("x")
+	ast.Equal(429, rw.Code)
+	ast.Equal("1", rw.Header().Get("Retry-After"))
+
+	now = now.Add(200 * time.Millisecond)
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- upload("x") }()
+	<-started
+
+	// one upload at once.
+	rw = upload("")
+	ast.Equal(429, rw.Code)
+	close(release)
+	ast.Equal(200, (<-done).Code)
+	ast.Equal(200, upload("").Code)
+}
+
+func TestMetrics(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestMetrics")
+	namespaces := map[string]blobserver.Storage{"a": storagetest.NewFakeStorage()}
+	h, err := newHandler(&config.Config{}, storagetest.NewFakeStorage(), namespaces)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	req, err := multiUploadRequest("/blob/upload/", nil, []testFile{{name: "a.txt", contents: "metrics"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.URL, _ = url.Parse(srv.URL + "/v1/api/blobserver/blob/upload/?use-filename=1")
+	req.Host = req.URL.Host
+	res, err := doReq(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	ast.Equal(201, res.StatusCode)
+
+	for _, path := range []string{"/blob/get/a.txt/", "/blob/get/missing.txt/", "/a/blob/get/missing.txt/"} {
+		res, err = http.Get(srv.URL + "/v1/api/blobserver" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	// methods the API doesn't serve share one label.
+	req, _ = http.NewRequest("BOGUS", srv.URL+"/v1/api/blobserver/blob/get/a.txt/", nil)
+	res, err = doReq(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	res, err = http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	ast.Equal(200, res.StatusCode)
+
+	for _, line := range []string{
+		`blobserver_http_requests_total{route="upload",namespace="",method="POST",code="201"} 1`,
+		`blobserver_http_requests_total{route="get",namespace="",method="GET",code="200"} 1`,
+		`blobserver_http_requests_total{route="get",namespace="",method="GET",code="404"} 1`,
+		`blobserver_http_requests_total{route="get",namespace="a",method="GET",code="404"} 1`,
+		`blobserver_http_requests_total{route="other",namespace="",method="other",code="404"} 1`,
+		`blobserver_http_request_duration_seconds_count{route="get",namespace="",method="GET",code="200"} 1`,
+		`blobserver_http_response_bytes_total{route="get",namespace=""} `,
+		`blobserver_storage_operation_duration_seconds_count{backend="unknown",namespace="",op="fetch"} 2`,
+		`blobserver_uploads_in_flight 0`,
+		`blobserver_gate_capacity{gate="stat"} 20`,
+	} {
+		ast.True(strings.Contains(string(body), line), line)
+	}
+
+	ast.True(!strings.Contains(string(body), "blobserver_storage_errors_total{"))
+	ast.True(!strings.Contains(string(body), `method="BOGUS"`))
+}
+
+// healthStorage is a storage whose health is set by the test.
+type healthStorage struct {
+	blobserver.Storage
+	mu     sync.Mutex
+	err    error
+	checks int
+}
+
+func (s *healthStorage) CheckHealth(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checks++
+	return s.err
+}
+
+func (s *healthStorage) set(err error) {
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+func TestHealth(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestHealth")
+	sto := &healthStorage{Storage: storagetest.NewFakeStorage()}
+	ns := &healthStorage{Storage: storagetest.NewFakeStorage()}
+	conf := &config.Config{
+		Auth:   &config.AuthConfig{Tokens: []config.TokenConfig{{Name: "t", Token: "secret", Scopes: []string{"admin"}}}},
+		Health: &config.HealthConfig{Sentinel: "sentinel.txt", CacheTTL: config.Duration{Duration: time.Hour}},
+	}
+	h, err := newHandler(conf, sto, map[string]blobserver.Storage{"a": ns})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	get := func(path string) int {
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// probes need no token.
+	ast.Equal(200, get("/healthz"))
+	ast.Equal(503, get("/readyz"))
+
+	_, err = sto.ReceiveBlob(blob.NewRefFilename("sentinel.txt"), strings.NewReader("ok"))
+	ast.Nil(err)
+
+	// the result is cached.
+	ast.Equal(503, get("/readyz"))
+	h.health.checked = time.Time{}
+	ast.Equal(200, get("/readyz"))
+	ast.Equal(200, get("/readyz"))
+	ast.Equal(2, sto.checks)
+
+	ns.set(errors.New("unreachable"))
+	h.health.checked = time.Time{}
+	ast.Equal(503, get("/readyz"))
+	ns.set(nil)
+	h.health.checked = time.Time{}
+	ast.Equal(200, get("/readyz"))
+
+	h.health.drain()
+	ast.Equal(503, get("/readyz"))
+	ast.Equal(200, get("/healthz"))
+
+	// a sentinel which can't be a ref doesn't silently skip the check.
+	conf.Health.Sentinel = "sentinel?.txt"
+	_, err = newHandler(conf, sto, nil)
+	ast.True(err != nil)
+}
+
+// closingStorage is a storage whose uploads wait for release and which
+// counts how often it's closed.
+type closingStorage struct {
+	blobserver.Storage
+	started chan struct{}
+	release chan struct{}
+	closed  int32
+}
+
+func newClosingStorage() *closingStorage {
+	return &closingStorage{
+		Storage: storagetest.NewFakeStorage(),
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+}
+
+func (s *closingStorage) ReceiveBlob(br blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	s.started <- struct{}{}
+	<-s.release
+	return s.Storage.ReceiveBlob(br, source)
+}
+
+func (s *closingStorage) Close() error {
+	atomic.AddInt32(&s.closed, 1)
+	return nil
+}
+
+// serveShutdown serves sto until stop is closed. It returns the address
+// served and the result of serve.
+func serveShutdown(t *testing.T, sto blobserver.Storage, delay, timeout time.Duration, stop <-chan struct{}) (string, <-chan error) {
+	h, err := newHandler(&config.Config{}, sto, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+
+	go func() {
+		errc <- h.serve(&http.Server{Handler: h}, l, delay, timeout, stop)
+	}()
+
+	return l.Addr().String(), errc
+}
+
+// uploadTo uploads a blob to addr and returns the status code, or 0 if
+// the request failed.
+func uploadTo(t *testing.T, addr string) <-chan int {
+	req, err := uploadRequest("/blob/upload/", "in-flight.txt", "in flight")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.URL.Host = addr
+	codec := make(chan int, 1)
+
+	go func() {
+		res, err := doReq(req)
+
+		if err != nil {
+			codec <- 0
+			return
+		}
+
+		res.Body.Close()
+		codec <- res.StatusCode
+	}()
+
+	return codec
+}
+
+func TestShutdown(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestShutdown")
+	sto := newClosingStorage()
+	stop := make(chan struct{})
+	addr, errc := serveShutdown(t, sto, 0, 5*time.Second, stop)
+
+	codec := uploadTo(t, addr)
+	<-sto.started
+	close(stop)
+
+	// the upload in flight is waited for.
+	select {
+	case err := <-errc:
+		t.Fatalf("serve returned with a request in flight: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ast.Equal(int32(0), atomic.LoadInt32(&sto.closed))
+	close(sto.release)
+	ast.Equal(201, <-codec)
+	ast.Nil(<-errc)
+	ast.Equal(int32(1), atomic.LoadInt32(&sto.closed))
+
+	// no new connections are accepted.
+	_, err := net.Dial("tcp", addr)
+	ast.True(err != nil)
+}
+
+func TestShutdownDrainDelay(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestShutdownDrainDelay")
+	sto := newClosingStorage()
+	stop := make(chan struct{})
+	addr, errc := serveShutdown(t, sto, 500*time.Millisecond, time.Second, stop)
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	get := func(path string) int {
+		res, err := client.Get("http://" + addr + path)
+
+		if err != nil {
+			return 0
+		}
+
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	ast.Equal(200, get("/readyz"))
+	close(stop)
+
+	// not ready once draining, while new connections are still served.
+	for i := 0; i < 50 && get("/readyz") != 503; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	ast.Equal(503, get("/readyz"))
+	ast.Equal(200, get("/healthz"))
+
+	select {
+	case err := <-errc:
+		t.Fatalf("serve returned while draining: %v", err)
+	default:
+	}
+
+	ast.Nil(<-errc)
+	ast.Equal(0, get("/healthz"))
+	ast.Equal(int32(1), atomic.LoadInt32(&sto.closed))
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	ast := assert.NewAssertWithName(t, "TestShutdownTimeout")
+	sto := newClosingStorage()
+	defer close(sto.release)
+	stop := make(chan struct{})
+	addr, errc := serveShutdown(t, sto, 0, 50*time.Millisecond, stop)
+
+	codec := uploadTo(t, addr)
+	<-sto.started
+	close(stop)
+
+	// the upload is cut off and the storage closed regardless.
+	ast.True(<-errc != nil)
+	ast.Equal(0, <-codec)
+	ast.Equal(int32(1), atomic.LoadInt32(&sto.closed))
+}
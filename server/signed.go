@@ -0,0 +1,205 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/simonz05/blobserver/config"
+	"github.com/simonz05/blobserver/protocol"
+	"github.com/simonz05/util/httputil"
+)
+
+const defaultMaxExpiry = 24 * time.Hour
+
+// signer verifies signed URLs.
+type signer struct {
+	keys      map[string][]byte
+	maxExpiry time.Duration
+}
+
+// newSigner returns the signer configured by conf, or nil if signed
+// URLs are off.
+func newSigner(conf *config.SigningConfig) (*signer, error) {
+	if conf == nil {
+		return nil, nil
+	}
+
+	s := &signer{
+		keys:      make(map[string][]byte),
+		maxExpiry: conf.MaxExpiry.Duration,
+	}
+
+	if s.maxExpiry == 0 {
+		s.maxExpiry = defaultMaxExpiry
+	}
+
+	for _, k := range conf.Keys {
+		if k.ID == "" || k.Secret == "" {
+			return nil, fmt.Errorf("signing: key %q needs an id and a secret", k.ID)
+		}
+
+		if _, ok := s.keys[k.ID]; ok {
+			return nil, fmt.Errorf("signing: duplicate key %q", k.ID)
+		}
+
+		s.keys[k.ID] = []byte(k.Secret)
+	}
+
+	if len(s.keys) == 0 {
+		return nil, fmt.Errorf("signing: no keys")
+	}
+
+	return s, nil
+}
+
+// uploadPolicy restricts the blobs stored by a signed upload.
+type uploadPolicy struct {
+	ref         string
+	prefix      string
+	maxSize     int64
+	contentType string
+}
+
+// allowRef reports whether a blob may be stored as ref.
+func (p *uploadPolicy) allowRef(ref string) bool {
+	switch {
+	case p.ref != "":
+		return ref == p.ref
+	case p.prefix != "":
+		return strings.HasPrefix(ref, p.prefix)
+	}
+	return true
+}
+
+// allowContentType reports whether a part with the Content-Type ct may
+// be stored. A policy type such as image/* matches all image types.
+func (p *uploadPolicy) allowContentType(ct string) bool {
+	if p.contentType == "" {
+		return true
+	}
+
+	ct, _, _ = mime.ParseMediaType(ct)
+
+	if strings.HasSuffix(p.contentType, "/*") {
+		return strings.HasPrefix(ct, strings.TrimSuffix(p.contentType, "*"))
+	}
+
+	return ct == p.contentType
+}
+
+// named reports whether blobs are stored by their filename.
+func (p *uploadPolicy) named() bool {
+	return p.ref != "" || p.prefix != ""
+}
+
+type policyKey struct{}
+
+// uploadPolicyFrom returns the policy of a signed upload, or nil.
+func uploadPolicyFrom(ctx context.Context) *uploadPolicy {
+	p, _ := ctx.Value(policyKey{}).(*uploadPolicy)
+	return p
+}
+
+var errSignature = newHTTPError("Invalid signature", http.StatusForbidden)
+
+// verify checks the signature of r and returns the scope it grants
+// and, for uploads, the policy.
+func (s *signer) verify(r *http.Request) (scope, *uploadPolicy, error) {
+	q := r.URL.Query()
+	secret, ok := s.keys[q.Get(protocol.SignKey)]
+
+	if !ok {
+		return 0, nil, errSignature
+	}
+
+	want := protocol.Signature(secret, r.Method, r.URL.Path, q)
+
+	if !hmac.Equal([]byte(q.Get(protocol.SignSignature)), []byte(want)) {
+		return 0, nil, errSignature
+	}
+
+	expires, err := strconv.ParseInt(q.Get(protocol.SignExpires), 10, 64)
+
+	if err != nil {
+		return 0, nil, newHTTPError("Signed URL without expiry", http.StatusForbidden)
+	}
+
+	now := time.Now()
+
+	switch t := time.Unix(expires, 0); {
+	case now.After(t):
+		return 0, nil, newHTTPError("Signed URL expired", http.StatusForbidden)
+	case t.Sub(now) > s.maxExpiry:
+		return 0, nil, newHTTPError("Signed URL expires too late", http.StatusForbidden)
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		return scopeRead, nil, nil
+	case "POST":
+	default:
+		return 0, nil, newHTTPError(fmt.Sprintf("Method %s can't be signed", r.Method), http.StatusForbidden)
+	}
+
+	p := &uploadPolicy{
+		ref:         q.Get(protocol.SignRef),
+		prefix:      q.Get(protocol.SignPrefix),
+		contentType: q.Get(protocol.SignContentType),
+	}
+
+	// URLs signed by other tools may carry the ref as it was named.
+	if p.ref != "" {
+		if p.ref, err = protocol.UploadRef(p.ref); err != nil {
+			return 0, nil, newHTTPError(err.Error(), http.StatusBadRequest)
+		}
+	}
+
+	if strings.Contains(p.prefix, "/") {
+		return 0, nil, newHTTPError(protocol.ErrUploadPath.Error(), http.StatusBadRequest)
+	}
+
+	if v := q.Get(protocol.SignMaxSize); v != "" {
+		if p.maxSize, err = strconv.ParseInt(v, 10, 64); err != nil || p.maxSize <= 0 {
+			return 0, nil, newHTTPError("Invalid max-size", http.StatusBadRequest)
+		}
+	}
+
+	return scopeUpload, p, nil
+}
+
+// handler verifies requests to signed URLs before passing them on to
+// h. They get the scope of the signed request only, whether or not
+// they also carry a token.
+func (s *signer) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get(protocol.SignSignature) == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		sc, p, err := s.verify(r)
+
+		if err != nil {
+			httputil.ServeJSONError(w, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), scopeKey{}, sc)
+
+		if p != nil {
+			ctx = context.WithValue(ctx, policyKey{}, p)
+		}
+
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -19,6 +19,7 @@ package server
 
 import (
 	"net/http"
+	"sync"
 
 	"github.com/gorilla/mux"
 	"github.com/simonz05/blobserver"
@@ -26,49 +27,78 @@ import (
 	"github.com/simonz05/blobserver/protocol"
 	"github.com/simonz05/util/httputil"
 	"github.com/simonz05/util/log"
+	"github.com/simonz05/util/syncutil"
 )
 
 const maxStatBlobs = 1000
 
-func createBatchStatHandler(storage blobserver.BlobStatter) http.Handler {
+var statGate = syncutil.NewGate(20) // arbitrary
+
+func createBatchStatHandler(storage blobserver.ContextBlobStatter) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-		req.ParseForm()
-		blobs, _ := req.Form["blob"]
-		res, err := handleStat(req, storage, blobs)
+		var blobs []string
+		var err error
+
+		if isJSONRequest(req) {
+			blobs, err = parseBatchRequest(req, maxStatBlobs)
+		} else {
+			req.ParseForm()
+			blobs = req.Form["blob"]
+		}
 
 		if err != nil {
 			httputil.ServeJSONError(rw, err)
+			return
+		}
+
+		res, err := handleStat(req, storage, blobs)
+
+		// per-ref errors are reported in the response
+		if res == nil {
+			httputil.ServeJSONError(rw, err)
 		} else {
 			httputil.ReturnJSON(rw, res)
 		}
 	})
 }
 
-func createStatHandler(storage blobserver.BlobStatter) http.Handler {
+func createStatHandler(storage blobserver.ContextBlobStatter) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		req.ParseForm()
 		vars := mux.Vars(req)
 		res, err := handleStat(req, storage, []string{vars["blobRef"]})
 
-		if err != nil {
+		switch {
+		case res == nil:
 			httputil.ServeJSONError(rw, err)
-		} else {
+		case err != nil:
+			httputil.ReturnJSONCode(rw, err.(httpError).HTTPCode(), res)
+		case len(res.Missing) > 0:
+			httputil.ReturnJSONCode(rw, http.StatusNotFound, res)
+		default:
 			httputil.ReturnJSON(rw, res)
 		}
 	})
 }
 
-func handleStat(req *http.Request, storage blobserver.BlobStatter, blobs []string) (interface{}, error) {
+// handleStat stats each of the requested blobs. Found blobs are
+// returned in StatResponse.Stat, absent ones in StatResponse.Missing
+// and blobs that could not be statted in StatResponse.Error keyed by
+// ref. Results keep the order of the request. If any blob could not be
+// statted, the response is returned together with an httpError
+// carrying the most severe status.
+func handleStat(req *http.Request, storage blobserver.ContextBlobStatter, blobs []string) (*protocol.StatResponse, error) {
 	res := new(protocol.StatResponse)
 	needStat := map[blob.Ref]bool{}
+	toStat := make([]blob.Ref, 0, len(blobs))
 	n := 0
 
 	for _, value := range blobs {
-		n++
+		// empty values, such as a blank blob= form value, are skipped.
 		if value == "" {
-			n--
-			break
+			continue
 		}
+		n++
 		if n > maxStatBlobs {
 			return nil, newRateLimitError(maxStatBlobs)
 		}
@@ -76,39 +106,66 @@ func handleStat(req *http.Request, storage blobserver.BlobStatter, blobs []strin
 		if !ok {
 			return nil, newHTTPError("Bogus blobref for value", http.StatusBadRequest)
 		}
-		needStat[ref] = true
+		if !needStat[ref] {
+			needStat[ref] = true
+			toStat = append(toStat, ref)
+		}
 	}
 
-	toStat := make([]blob.Ref, 0, len(needStat))
+	log.Printf("Need to stat blob cnt: %d, got %d", len(needStat), len(blobs))
 
-	for br := range needStat {
-		toStat = append(toStat, br)
+	// Backends may answer with a different, canonical ref than the
+	// one asked for, so each ref is statted on its own to attribute
+	// missing blobs and errors exactly.
+	type statResult struct {
+		sb  blob.SizedInfoRef
+		err error
 	}
 
-	log.Printf("Need to stat blob cnt: %d, got %d", len(needStat), len(blobs))
-	blobch := make(chan blob.SizedInfoRef)
-	errch := make(chan error, 1)
-
-	go func() {
-		err := storage.StatBlobs(blobch, toStat)
-		close(blobch)
-		errch <- err
-	}()
-
-	for sb := range blobch {
-		res.Stat = append(res.Stat, protocol.RefInfo{
-			Ref:  sb.Ref,
-			Size: uint32(sb.Size),
-			MD5:  sb.MD5,
-		})
-		delete(needStat, sb.Ref)
+	results := make([]statResult, len(toStat))
+	var wg sync.WaitGroup
+
+	ctx := req.Context()
+
+	for i, br := range toStat {
+		if err := statGate.StartContext(ctx); err != nil {
+			results[i].err = err
+			continue
+		}
+		wg.Add(1)
+		go func(i int, br blob.Ref) {
+			defer wg.Done()
+			defer statGate.Done()
+			sb, err := blobserver.StatBlobContext(ctx, storage, br)
+			results[i] = statResult{sb, err}
+		}(i, br)
 	}
 
-	err := <-errch
+	wg.Wait()
+
+	var failed *httpError
+
+	for i, r := range results {
+		switch {
+		case r.err == nil:
+			res.Stat = append(res.Stat, protocol.NewRefInfo(r.sb))
+		case r.err == blobserver.ErrNotFound:
+			res.Missing = append(res.Missing, toStat[i])
+		default:
+			log.Errorf("Stat error %v: %v", toStat[i], r.err)
+			e := newStorageError(r.err)
+			if res.Error == nil {
+				res.Error = make(map[string]string)
+			}
+			res.Error[toStat[i].String()] = e.message
+			if failed == nil || e.code > failed.code {
+				failed = &e
+			}
+		}
+	}
 
-	if err != nil {
-		log.Errorf("Stat error: %v", err)
-		return nil, newHTTPError("Server Error", http.StatusInternalServerError)
+	if failed != nil {
+		return res, *failed
 	}
 
 	return res, nil
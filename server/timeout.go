@@ -0,0 +1,88 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/simonz05/blobserver"
+	"github.com/simonz05/blobserver/blob"
+	"github.com/simonz05/blobserver/config"
+)
+
+// timeoutStorage applies a deadline to each storage operation.
+type timeoutStorage struct {
+	blobserver.ContextStorage
+	fetch, receive, stat, remove time.Duration
+}
+
+// newTimeoutStorage returns sto with the deadlines from conf applied.
+// If conf is nil, sto is returned as is.
+func newTimeoutStorage(sto blobserver.ContextStorage, conf *config.TimeoutConfig) blobserver.ContextStorage {
+	if conf == nil {
+		return sto
+	}
+	return &timeoutStorage{
+		ContextStorage: sto,
+		fetch:          conf.Fetch.Duration,
+		receive:        conf.Receive.Duration,
+		stat:           conf.Stat.Duration,
+		remove:         conf.Remove.Duration,
+	}
+}
+
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// cancelReadCloser releases the fetch deadline once the blob is closed.
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (rc cancelReadCloser) Close() error {
+	defer rc.cancel()
+	return rc.ReadCloser.Close()
+}
+
+func (s *timeoutStorage) FetchContext(ctx context.Context, br blob.Ref) (io.ReadCloser, uint32, error) {
+	ctx, cancel := withTimeout(ctx, s.fetch)
+	rc, size, err := s.ContextStorage.FetchContext(ctx, br)
+	if err != nil {
+		cancel()
+		return nil, 0, err
+	}
+	return cancelReadCloser{rc, cancel}, size, nil
+}
+
+func (s *timeoutStorage) ReceiveBlobContext(ctx context.Context, br blob.Ref, source io.Reader) (blob.SizedRef, error) {
+	ctx, cancel := withTimeout(ctx, s.receive)
+	defer cancel()
+	return s.ContextStorage.ReceiveBlobContext(ctx, br, source)
+}
+
+func (s *timeoutStorage) ReceiveBlobOptions(ctx context.Context, br blob.Ref, source io.Reader, opts blob.Options) (blob.SizedRef, error) {
+	ctx, cancel := withTimeout(ctx, s.receive)
+	defer cancel()
+	return blobserver.ReceiveBlobOptions(ctx, s.ContextStorage, br, source, opts)
+}
+
+func (s *timeoutStorage) StatBlobsContext(ctx context.Context, dest chan<- blob.SizedInfoRef, blobs []blob.Ref) error {
+	ctx, cancel := withTimeout(ctx, s.stat)
+	defer cancel()
+	return s.ContextStorage.StatBlobsContext(ctx, dest, blobs)
+}
+
+func (s *timeoutStorage) RemoveBlobsContext(ctx context.Context, blobs []blob.Ref) error {
+	ctx, cancel := withTimeout(ctx, s.remove)
+	defer cancel()
+	return s.ContextStorage.RemoveBlobsContext(ctx, blobs)
+}
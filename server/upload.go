@@ -18,11 +18,19 @@ limitations under the License.
 package server
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"mime"
 	"net/http"
+	"sort"
+	"strings"
 
 	"github.com/simonz05/blobserver"
 	"github.com/simonz05/blobserver/blob"
@@ -33,21 +41,95 @@ import (
 )
 
 // createUploadHandler returns the handler that receives multi-part form uploads.
-func createUploadHandler(storage blobserver.Storage) http.Handler {
+func createUploadHandler(storage blobserver.ContextStorage) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 		res, err := handleMultiPartUpload(r, storage)
-		if err != nil {
+		if err != nil && res == nil {
 			log.Errorf("upload: %v", err)
 			httputil.ServeJSONError(rw, err)
+		} else if err != nil {
+			log.Errorf("upload: %v", err)
+			httputil.ReturnJSONCode(rw, err.(httpError).HTTPCode(), res)
 		} else {
 			httputil.ReturnJSONCode(rw, http.StatusCreated, res)
 		}
 	})
 }
 
-func handleMultiPartUpload(req *http.Request, blobReceiver blobserver.Storage) (interface{}, error) {
+// errDigestMismatch is returned by md5Reader when the data read does
+// not hash to the digest the client sent. It wraps
+// blobserver.ErrPreconditionFailed so it's still recognized when the
+// storage wraps it in an error of its own.
+var errDigestMismatch = fmt.Errorf("Content-MD5 mismatch: %w", blobserver.ErrPreconditionFailed)
+
+// md5Reader wraps a Reader and verifies at EOF that the MD5 of the data
+// read matches want. On mismatch the final Read returns
+// errDigestMismatch instead of io.EOF, which makes the receiving
+// storage fail before it commits the blob.
+type md5Reader struct {
+	r    io.Reader
+	h    hash.Hash
+	want []byte
+}
+
+func newMD5Reader(r io.Reader, want []byte) *md5Reader {
+	return &md5Reader{r: r, h: md5.New(), want: want}
+}
+
+func (mr *md5Reader) Read(p []byte) (n int, err error) {
+	n, err = mr.r.Read(p)
+	mr.h.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(mr.h.Sum(nil), mr.want) {
+		err = errDigestMismatch
+	}
+	return
+}
+
+// parseContentMD5 decodes a Content-MD5 value. RFC 1864 specifies the
+// base64 encoding of the digest, but the hex encoding is accepted as
+// well since that is what the stat endpoint returns.
+func parseContentMD5(v string) ([]byte, error) {
+	v = strings.TrimSpace(v)
+	var sum []byte
+	var err error
+
+	if len(v) == hex.EncodedLen(md5.Size) {
+		sum, err = hex.DecodeString(v)
+	} else {
+		sum, err = base64.StdEncoding.DecodeString(v)
+	}
+
+	if err != nil || len(sum) != md5.Size {
+		return nil, fmt.Errorf("Invalid Content-MD5 %q", v)
+	}
+
+	return sum, nil
+}
+
+// handleMultiPartUpload stores every file part of a multipart request
+// and reports the outcome per file: stored blobs are listed in
+// UploadResponse.Received and failed ones in UploadResponse.Failed by
+// part, and in UploadResponse.Error by filename. If any part failed, the
+// response is returned together with an httpError: 207 if some parts
+// were stored, or else the most severe status of the failures.
+//
+// A part may carry a Content-MD5 header, or be preceded by a form field
+// named Content-MD5, in which case the blob is only stored if its data
+// matches the digest.
+//
+// With atomic=true the upload is all-or-nothing: if any part fails, the
+// parts already stored are removed again.
+//
+// The cache-control, content-disposition, storage-class,
+// server-side-encryption and kms-key-id query values set blob.Options
+// for every file, overriding the storage's defaults.
+//
+// Signed uploads store blobs by their filename if the URL was signed
+// for a ref or prefix, and only files allowed by its policy.
+func handleMultiPartUpload(req *http.Request, blobReceiver blobserver.ContextStorage) (*protocol.UploadResponse, error) {
 	res := new(protocol.UploadResponse)
 	receivedBlobs := make([]blob.SizedRef, 0, 4)
+	receivedParts := make([]protocol.UploadError, 0, 4)
 	multipart, err := req.MultipartReader()
 
 	if err != nil {
@@ -55,13 +137,54 @@ func handleMultiPartUpload(req *http.Request, blobReceiver blobserver.Storage) (
 	}
 
 	useFilename := false
+	atomic := false
 	req.ParseForm()
 
 	if req.FormValue("use-filename") != "" {
 		useFilename = true
 	}
 
-	for {
+	if req.FormValue("atomic") == "true" {
+		atomic = true
+	}
+
+	policy := uploadPolicyFrom(req.Context())
+	maxSize := int64(blobserver.MaxBlobSize)
+
+	if policy != nil {
+		if policy.named() {
+			useFilename = true
+		}
+		if policy.maxSize > 0 && policy.maxSize < maxSize {
+			maxSize = policy.maxSize
+		}
+	}
+
+	opts := blob.Options{
+		CacheControl:         req.FormValue("cache-control"),
+		ContentDisposition:   req.FormValue("content-disposition"),
+		StorageClass:         req.FormValue("storage-class"),
+		ServerSideEncryption: req.FormValue("server-side-encryption"),
+		KMSKeyID:             req.FormValue("kms-key-id"),
+	}
+
+	var failed *httpError
+
+	fail := func(part int, name string, e httpError) {
+		if res.Error == nil {
+			res.Error = make(map[string]string)
+		}
+		res.Error[name] = e.message
+		res.Failed = append(res.Failed, protocol.UploadError{Part: part, Name: name, Error: e.message})
+
+		if failed == nil || e.code > failed.code {
+			failed = &e
+		}
+	}
+
+	var nextMD5 string
+
+	for n := 1; ; n++ {
 		mimePart, err := multipart.NextPart()
 
 		if err == io.EOF {
@@ -69,56 +192,138 @@ func handleMultiPartUpload(req *http.Request, blobReceiver blobserver.Storage) (
 		}
 
 		if err != nil {
-			return nil, newHTTPError(fmt.Sprintf("Error reading multipart section: %v", err), http.StatusBadRequest)
+			fail(n, fmt.Sprintf("part%d", n), newHTTPError(fmt.Sprintf("Error reading multipart section: %v", err), http.StatusBadRequest))
+			break
+		}
+
+		filename := mimePart.FileName()
+
+		if filename == "" {
+			filename = fmt.Sprintf("part%d", n)
 		}
 
 		contentDisposition, _, err := mime.ParseMediaType(mimePart.Header.Get("Content-Disposition"))
 
 		if err != nil {
-			return nil, newHTTPError("Invalid Content-Disposition", http.StatusBadRequest)
+			fail(n, filename, newHTTPError("Invalid Content-Disposition", http.StatusBadRequest))
+			continue
 		}
 
 		if contentDisposition != "form-data" {
-			return nil, newHTTPError(fmt.Sprintf("Expected Content-Disposition of \"form-data\"; got %q", contentDisposition), http.StatusBadRequest)
+			fail(n, filename, newHTTPError(fmt.Sprintf("Expected Content-Disposition of \"form-data\"; got %q", contentDisposition), http.StatusBadRequest))
+			continue
+		}
+
+		if mimePart.FileName() == "" && mimePart.FormName() == "Content-MD5" {
+			v, err := ioutil.ReadAll(io.LimitReader(mimePart, 128))
+			if err != nil {
+				fail(n, filename, newHTTPError(fmt.Sprintf("Error reading multipart section: %v", err), http.StatusBadRequest))
+				break
+			}
+			nextMD5 = string(v)
+			continue
 		}
 
 		var ref blob.Ref
-		var tooBig int64 = blobserver.MaxBlobSize + 1
+		var tooBig int64 = maxSize + 1
 		var readBytes int64
+		var source io.Reader = mimePart
 
-		filename := mimePart.FileName()
 		log.Println("filename:", filename)
 
+		contentMD5 := mimePart.Header.Get("Content-MD5")
+		if contentMD5 == "" {
+			contentMD5 = nextMD5
+		}
+		nextMD5 = ""
+
+		if contentMD5 != "" {
+			want, err := parseContentMD5(contentMD5)
+			if err != nil {
+				fail(n, filename, newHTTPError(err.Error(), http.StatusBadRequest))
+				continue
+			}
+			source = newMD5Reader(source, want)
+		}
+
 		if useFilename {
 			log.Println("Use filename")
-			ref = blob.NewRefFilename(filename)
+			ref = blob.NewRefFilename(mimePart.FileName())
 		} else {
-			ref = blob.NewRef(filename)
+			ref = blob.NewRef(mimePart.FileName())
+		}
+
+		if policy != nil && !policy.allowRef(ref.Path) {
+			fail(n, filename, newHTTPError(fmt.Sprintf("Ref %v not allowed by signed URL", ref), http.StatusForbidden))
+			continue
+		}
+
+		if policy != nil && !policy.allowContentType(mimePart.Header.Get("Content-Type")) {
+			fail(n, filename, newHTTPError("Content-Type not allowed by signed URL", http.StatusUnsupportedMediaType))
+			continue
 		}
 
-		blobGot, err := blobReceiver.ReceiveBlob(ref, &readerutil.CountingReader{
-			Reader: io.LimitReader(mimePart, tooBig),
+		blobGot, err := blobserver.ReceiveBlobOptions(req.Context(), blobReceiver, ref, &readerutil.CountingReader{
+			Reader: io.LimitReader(source, tooBig),
 			N:      &readBytes,
-		})
+		}, opts)
 
 		if readBytes == tooBig {
-			err = fmt.Errorf("blob over the limit of %d bytes", blobserver.MaxBlobSize)
+			if err == nil {
+				// the limited reader ends in a clean EOF, so the
+				// truncated blob got stored.
+				if rerr := blobReceiver.RemoveBlobsContext(context.Background(), []blob.Ref{blobGot.Ref}); rerr != nil {
+					log.Errorf("Error removing oversized blob %v: %v", blobGot.Ref, rerr)
+				}
+			}
+			e := newStorageError(blobserver.ErrTooLarge)
+			e.message = fmt.Sprintf("blob over the limit of %d bytes", maxSize)
+			fail(n, filename, e)
+			continue
 		}
 
 		if err != nil {
-			var errmsg string
+			e := newStorageError(err)
 
 			if log.Severity >= log.LevelInfo {
-				errmsg = fmt.Sprintf("Error receiving blob (read bytes: %d) %v: %v\n", readBytes, ref, err)
-			} else {
-				errmsg = fmt.Sprintf("Error receiving blob: %v\n", err)
+				e.message = fmt.Sprintf("Error receiving blob (read bytes: %d) %v: %v", readBytes, ref, err)
+			} else if e.code == http.StatusInternalServerError {
+				e.message = fmt.Sprintf("Error receiving blob: %v", err)
 			}
 
-			return nil, newHTTPError(errmsg, http.StatusInternalServerError)
+			fail(n, filename, e)
+			continue
 		}
 
 		log.Printf("Received blob %v\n", blobGot)
 		receivedBlobs = append(receivedBlobs, blobGot)
+		receivedParts = append(receivedParts, protocol.UploadError{Part: n, Name: filename})
+	}
+
+	if failed != nil && atomic && len(receivedBlobs) > 0 {
+		toRemove := make([]blob.Ref, 0, len(receivedBlobs))
+
+		for _, got := range receivedBlobs {
+			toRemove = append(toRemove, got.Ref)
+		}
+
+		msg := "Not stored; atomic upload failed"
+
+		// roll back even if the client went away
+		if err := blobReceiver.RemoveBlobsContext(context.Background(), toRemove); err != nil {
+			log.Errorf("Error rolling back atomic upload: %v", err)
+			msg = fmt.Sprintf("Atomic upload failed and rollback failed: %v", err)
+		}
+
+		for _, p := range receivedParts {
+			res.Error[p.Name] = msg
+			p.Error = msg
+			res.Failed = append(res.Failed, p)
+		}
+
+		sort.Slice(res.Failed, func(i, j int) bool { return res.Failed[i].Part < res.Failed[j].Part })
+
+		receivedBlobs = nil
 	}
 
 	for _, got := range receivedBlobs {
@@ -131,5 +336,16 @@ func handleMultiPartUpload(req *http.Request, blobReceiver blobserver.Storage) (
 		}
 		res.Received = append(res.Received, rv)
 	}
+
+	if failed != nil {
+		msg := fmt.Sprintf("%d of %d files failed", len(res.Failed), len(res.Failed)+len(res.Received))
+
+		if len(res.Received) > 0 {
+			return res, newHTTPError(msg, http.StatusMultiStatus)
+		}
+
+		return res, newHTTPError(msg, failed.code)
+	}
+
 	return res, nil
 }
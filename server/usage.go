@@ -0,0 +1,46 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"net/http"
+
+	"github.com/simonz05/blobserver"
+	"github.com/simonz05/blobserver/protocol"
+	"github.com/simonz05/blobserver/quota"
+	"github.com/simonz05/util/httputil"
+	"github.com/simonz05/util/log"
+)
+
+// createUsageHandler returns the handler that serves the usage and
+// quota of the namespace of qs.
+func createUsageHandler(qs *quota.Storage) http.Handler {
+	if qs == nil {
+		return http.HandlerFunc(notImplementedHandler)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleUsage(w, r, qs)
+	})
+}
+
+func handleUsage(w http.ResponseWriter, req *http.Request, qs *quota.Storage) {
+	u, err := qs.Usage()
+
+	if err != nil {
+		log.Errorf("usage of namespace %q: %v", qs.Namespace(), err)
+		httputil.ServeJSONError(w, newStorageError(blobserver.ErrBackendUnavailable))
+		return
+	}
+
+	q := qs.Quota()
+	res := &protocol.UsageResponse{Data: &protocol.Usage{
+		Namespace:  qs.Namespace(),
+		Bytes:      u.Bytes,
+		Objects:    u.Objects,
+		MaxBytes:   q.Bytes,
+		MaxObjects: q.Objects,
+	}}
+	httputil.ReturnJSON(w, res)
+}
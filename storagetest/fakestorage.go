@@ -6,29 +6,43 @@ package storagetest
 
 import (
 	"bytes"
-	"errors"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"io"
 	"io/ioutil"
+	"mime"
+	"path"
+	"sync"
+	"time"
 
 	"github.com/simonz05/blobserver"
 	"github.com/simonz05/blobserver/blob"
 )
 
+type fakeBlob struct {
+	blob.Blob
+	info blob.SizedInfoRef
+}
+
 type fakeStorage struct {
-	blobs map[string]blob.Blob
+	mu    sync.RWMutex // guards blobs
+	blobs map[string]fakeBlob
 }
 
 func NewFakeStorage() blobserver.Storage {
 	return &fakeStorage{
-		blobs: make(map[string]blob.Blob),
+		blobs: make(map[string]fakeBlob),
 	}
 }
 
 func (sto *fakeStorage) Fetch(b blob.Ref) (file io.ReadCloser, size uint32, err error) {
+	sto.mu.RLock()
 	bb, ok := sto.blobs[b.String()]
+	sto.mu.RUnlock()
 
 	if !ok {
-		return file, size, errors.New("Blob not found")
+		return file, size, blobserver.ErrNotFound
 	}
 
 	return bb.Open(), bb.Size(), err
@@ -37,25 +51,40 @@ func (sto *fakeStorage) Fetch(b blob.Ref) (file io.ReadCloser, size uint32, err
 //func NewBlob(ref Ref, size uint32, newReader func() io.ReadCloser) Blob {
 func (sto *fakeStorage) ReceiveBlob(b blob.Ref, source io.Reader) (sb blob.SizedRef, err error) {
 	buf := &bytes.Buffer{}
-	size, err := io.Copy(buf, source)
+	h := md5.New()
+	size, err := io.Copy(io.MultiWriter(buf, h), source)
 
 	if err != nil {
 		return sb, err
 	}
 
+	b.SetHash(h)
 	newBlob := blob.NewBlob(b, uint32(size), func() io.ReadCloser {
 		return ioutil.NopCloser(bytes.NewReader(buf.Bytes()))
 	})
 
-	sto.blobs[b.String()] = newBlob
+	contentType := mime.TypeByExtension(path.Ext(b.String()))
+
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	info := newBlob.SizedInfoRef()
+	info.MD5 = hex.EncodeToString(h.Sum(nil))
+	info.ModTime = time.Now()
+	info.ContentType = contentType
+
+	sto.mu.Lock()
+	sto.blobs[b.String()] = fakeBlob{newBlob, info}
+	sto.mu.Unlock()
 	return newBlob.SizedRef(), err
 }
 
 func (sto *fakeStorage) RemoveBlobs(blobs []blob.Ref) error {
+	sto.mu.Lock()
+	defer sto.mu.Unlock()
+
 	for _, b := range blobs {
-		if _, ok := sto.blobs[b.String()]; !ok {
-			return errors.New("Blob not found")
-		}
 		delete(sto.blobs, b.String())
 	}
 	return nil
@@ -63,11 +92,31 @@ func (sto *fakeStorage) RemoveBlobs(blobs []blob.Ref) error {
 
 func (sto *fakeStorage) StatBlobs(dest chan<- blob.SizedInfoRef, blobs []blob.Ref) error {
 	for _, ref := range blobs {
+		sto.mu.RLock()
 		b, ok := sto.blobs[ref.String()]
-		if !ok {
-			return errors.New("Blob not found")
+		sto.mu.RUnlock()
+		if ok {
+			dest <- b.info
+		}
+	}
+	return nil
+}
+
+func (sto *fakeStorage) EnumerateBlobs(ctx context.Context, fn func(blob.SizedRef) error) error {
+	sto.mu.RLock()
+	refs := make([]blob.SizedRef, 0, len(sto.blobs))
+	for _, b := range sto.blobs {
+		refs = append(refs, b.SizedRef())
+	}
+	sto.mu.RUnlock()
+
+	for _, sb := range refs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(sb); err != nil {
+			return err
 		}
-		dest <- b.SizedInfoRef()
 	}
 	return nil
 }
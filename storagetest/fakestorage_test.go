@@ -0,0 +1,17 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package storagetest
+
+import (
+	"testing"
+
+	"github.com/simonz05/blobserver"
+)
+
+func TestFakeStorage(t *testing.T) {
+	Test(t, func(t *testing.T) (sto blobserver.Storage, cleanup func()) {
+		return NewFakeStorage(), func() {}
+	})
+}
@@ -87,11 +87,16 @@ func Test(t *testing.T, fn func(*testing.T) (sto blobserver.Storage, cleanup fun
 	dest := make(chan blob.SizedInfoRef)
 	go func() {
 		if err := sto.StatBlobs(dest, blobRefs); err != nil {
-			t.Fatalf("error stating blobs %s: %v", blobRefs, err)
+			t.Errorf("error stating blobs %s: %v", blobRefs, err)
 		}
 	}()
 	testStat(t, dest, blobSizedRefs)
 
+	t.Logf("Testing Stat metadata")
+	for i, b2 := range blobs {
+		testStatMetadata(t, sto, b2.BlobRef, md5s[i])
+	}
+
 	t.Logf("Testing Remove")
 	if err := sto.RemoveBlobs(blobRefs); err != nil {
 		if strings.Contains(err.Error(), "not implemented") {
@@ -151,6 +156,24 @@ func testStat(t *testing.T, enum <-chan blob.SizedInfoRef, want []blob.SizedRef)
 	}
 }
 
+// testStatMetadata verifies that a stat reports the MD5, last modified
+// time and content type of a blob.
+func testStatMetadata(t *testing.T, sto blobserver.BlobStatter, br blob.Ref, hash string) {
+	sb, err := blobserver.StatBlob(sto, br)
+	if err != nil {
+		t.Fatalf("error stating %s: %v", br, err)
+	}
+	if sb.MD5 != hash {
+		t.Fatalf("stat of %s: MD5 is %q, wanted %q", br, sb.MD5, hash)
+	}
+	if sb.ModTime.IsZero() {
+		t.Fatalf("stat of %s: missing last modified time", br)
+	}
+	if sb.ContentType == "" {
+		t.Fatalf("stat of %s: missing content type", br)
+	}
+}
+
 // Blob is a utility class for unit tests.
 type Blob struct {
 	Contents string // the contents of the blob
@@ -0,0 +1,293 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package swift
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ncw/swift"
+	"github.com/simonz05/blobserver/config"
+)
+
+const (
+	endpointPublic   = "public"
+	endpointInternal = "internal"
+)
+
+// authVersion returns the auth API version to use. Unless it's set
+// it's detected from the auth URL like swift.Connection does.
+func authVersion(conf *config.SwiftConfig) (int, error) {
+	switch v := conf.AuthVersion; {
+	case v == 1, v == 2, v == 3:
+		return v, nil
+	case v != 0:
+		return 0, fmt.Errorf("swift: unsupported auth_version %d", v)
+	case strings.Contains(conf.AuthURL, "v3"):
+		return 3, nil
+	case strings.Contains(conf.AuthURL, "v2"):
+		return 2, nil
+	case strings.Contains(conf.AuthURL, "v1"):
+		return 1, nil
+	}
+	return 0, fmt.Errorf("swift: can't detect auth version from auth_url %q, set auth_version", conf.AuthURL)
+}
+
+// newAuth validates the auth settings of conf and returns a function
+// making unauthenticated connections with them.
+func newAuth(conf *config.SwiftConfig, transport http.RoundTripper) (func() *swift.Connection, error) {
+	version, err := authVersion(conf)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var internal bool
+
+	switch conf.EndpointType {
+	case "", endpointPublic:
+	case endpointInternal:
+		internal = true
+	default:
+		return nil, fmt.Errorf("swift: endpoint_type must be %s or %s, got %q", endpointPublic, endpointInternal, conf.EndpointType)
+	}
+
+	appCred := conf.ApplicationCredentialID != "" || conf.ApplicationCredentialName != ""
+
+	if appCred {
+		if version != 3 {
+			return nil, fmt.Errorf("swift: application credentials need auth_version 3")
+		}
+		if conf.ApplicationCredentialSecret == "" {
+			return nil, fmt.Errorf("swift: application_credential_secret missing")
+		}
+		if conf.ApplicationCredentialID == "" && conf.APIUser == "" {
+			return nil, fmt.Errorf("swift: application_credential_name needs api_user")
+		}
+	}
+
+	return func() *swift.Connection {
+		c := &swift.Connection{
+			UserName:    conf.APIUser,
+			ApiKey:      conf.APIKey,
+			AuthUrl:     conf.AuthURL,
+			AuthVersion: version,
+			Region:      conf.Region,
+			Internal:    internal,
+			Tenant:      conf.Tenant,
+			TenantId:    conf.TenantID,
+			Domain:      conf.Domain,
+			DomainId:    conf.DomainID,
+			Transport:   transport,
+		}
+
+		if version == 3 {
+			c.Auth = &v3Auth{conf: conf}
+		}
+
+		return c
+	}, nil
+}
+
+// v3Auth authenticates against the Keystone v3 API. Unlike the
+// authenticator in ncw/swift it supports application credentials,
+// projects outside the user's domain and picks the endpoint of the
+// configured region.
+type v3Auth struct {
+	conf    *config.SwiftConfig
+	token   string
+	catalog []v3Service
+}
+
+type v3Domain struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+type v3User struct {
+	Name     string    `json:"name,omitempty"`
+	Password string    `json:"password,omitempty"`
+	Domain   *v3Domain `json:"domain,omitempty"`
+}
+
+type v3AppCred struct {
+	ID     string  `json:"id,omitempty"`
+	Name   string  `json:"name,omitempty"`
+	Secret string  `json:"secret"`
+	User   *v3User `json:"user,omitempty"`
+}
+
+type v3Project struct {
+	ID     string    `json:"id,omitempty"`
+	Name   string    `json:"name,omitempty"`
+	Domain *v3Domain `json:"domain,omitempty"`
+}
+
+type v3Password struct {
+	User *v3User `json:"user"`
+}
+
+type v3Scope struct {
+	Project *v3Project `json:"project"`
+}
+
+type v3AuthRequest struct {
+	Auth struct {
+		Identity struct {
+			Methods  []string    `json:"methods"`
+			Password *v3Password `json:"password,omitempty"`
+			AppCred  *v3AppCred  `json:"application_credential,omitempty"`
+		} `json:"identity"`
+		Scope *v3Scope `json:"scope,omitempty"`
+	} `json:"auth"`
+}
+
+type v3Service struct {
+	Type      string `json:"type"`
+	Endpoints []struct {
+		Interface string `json:"interface"`
+		Region    string `json:"region"`
+		RegionID  string `json:"region_id"`
+		URL       string `json:"url"`
+	} `json:"endpoints"`
+}
+
+type v3AuthResponse struct {
+	Token struct {
+		Catalog []v3Service `json:"catalog"`
+	} `json:"token"`
+}
+
+// domain returns the domain given by name or id, or nil if neither
+// is set.
+func domain(name, id string) *v3Domain {
+	switch {
+	case id != "":
+		return &v3Domain{ID: id}
+	case name != "":
+		return &v3Domain{Name: name}
+	}
+	return nil
+}
+
+func (a *v3Auth) body() *v3AuthRequest {
+	conf := a.conf
+	r := new(v3AuthRequest)
+	id := &r.Auth.Identity
+	user := &v3User{
+		Name:   conf.APIUser,
+		Domain: domain(conf.Domain, conf.DomainID),
+	}
+
+	if conf.ApplicationCredentialID != "" || conf.ApplicationCredentialName != "" {
+		// application credentials are bound to a project already.
+		id.Methods = []string{"application_credential"}
+		id.AppCred = &v3AppCred{
+			ID:     conf.ApplicationCredentialID,
+			Secret: conf.ApplicationCredentialSecret,
+		}
+
+		if conf.ApplicationCredentialID == "" {
+			id.AppCred.Name = conf.ApplicationCredentialName
+			id.AppCred.User = user
+		}
+
+		return r
+	}
+
+	user.Password = conf.APIKey
+	id.Methods = []string{"password"}
+	id.Password = &v3Password{User: user}
+
+	if conf.TenantID == "" && conf.Tenant == "" {
+		return r
+	}
+
+	project := &v3Project{ID: conf.TenantID}
+
+	if project.ID == "" {
+		project.Name = conf.Tenant
+		project.Domain = domain(conf.ProjectDomain, conf.ProjectDomainID)
+
+		if project.Domain == nil {
+			project.Domain = user.Domain
+		}
+	}
+
+	r.Auth.Scope = &v3Scope{Project: project}
+
+	return r
+}
+
+func (a *v3Auth) Request(c *swift.Connection) (*http.Request, error) {
+	body, err := json.Marshal(a.body())
+
+	if err != nil {
+		return nil, err
+	}
+
+	url := strings.TrimSuffix(c.AuthUrl, "/") + "/auth/tokens"
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", c.UserAgent)
+	return req, nil
+}
+
+func (a *v3Auth) Response(resp *http.Response) error {
+	var r v3AuthResponse
+
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return err
+	}
+
+	a.token = resp.Header.Get("X-Subject-Token")
+	a.catalog = r.Token.Catalog
+	return nil
+}
+
+// StorageUrl returns the object-store endpoint of the configured
+// region, or of the first region listed if none is configured.
+func (a *v3Auth) StorageUrl(internal bool) string {
+	iface := endpointPublic
+
+	if internal {
+		iface = endpointInternal
+	}
+
+	region := a.conf.Region
+
+	for _, s := range a.catalog {
+		if s.Type != "object-store" {
+			continue
+		}
+
+		for _, e := range s.Endpoints {
+			if e.Interface != iface {
+				continue
+			}
+			if region == "" || region == e.Region || region == e.RegionID {
+				return e.URL
+			}
+		}
+	}
+
+	return ""
+}
+
+func (a *v3Auth) Token() string {
+	return a.token
+}
+
+func (a *v3Auth) CdnUrl() string {
+	return ""
+}
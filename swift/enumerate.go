@@ -0,0 +1,65 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package swift
+
+import (
+	"context"
+
+	"github.com/ncw/swift"
+	"github.com/simonz05/blobserver/blob"
+)
+
+// EnumerateBlobs lists the containers of the storage one by one. While
+// a reshard is in progress the containers of the other layout are
+// listed too, so a blob may be seen twice.
+func (sto *swiftStorage) EnumerateBlobs(ctx context.Context, fn func(blob.SizedRef) error) error {
+	conts := sto.containers()
+
+	if sto.prevShards != nil {
+		conts = append(conts, sto.prevShards.containers(sto.containerName)...)
+	}
+
+	seen := make(map[string]bool, len(conts))
+
+	for _, cont := range conts {
+		if seen[cont] {
+			continue
+		}
+
+		seen[cont] = true
+		var objects []swift.Object
+
+		err := sto.pool.do(ctx, func(c *poolConn) (err error) {
+			objects, err = c.ObjectsAll(cont, nil)
+			return
+		})
+
+		if err == swift.ContainerNotFound {
+			continue
+		}
+
+		if err != nil {
+			return translateError(err)
+		}
+
+		for _, o := range objects {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			ref := blob.Ref{Path: o.Name}
+
+			if sto.shard {
+				ref.Path = cont + "/" + o.Name
+			}
+
+			if err := fn(blob.SizedRef{Ref: ref, Size: uint32(o.Bytes)}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
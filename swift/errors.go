@@ -0,0 +1,45 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package swift
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/ncw/swift"
+	"github.com/simonz05/blobserver"
+	"github.com/simonz05/util/log"
+)
+
+// translateError maps errors from the swift client to the blobserver
+// error vocabulary. Errors without a counterpart are returned as is.
+func translateError(err error) error {
+	switch err := err.(type) {
+	case nil:
+		return nil
+	case *swift.Error:
+		switch err.StatusCode {
+		case http.StatusNotFound:
+			return blobserver.ErrNotFound
+		case http.StatusConflict:
+			return blobserver.ErrAlreadyExists
+		case http.StatusRequestEntityTooLarge:
+			return blobserver.ErrTooLarge
+		case http.StatusPreconditionFailed, http.StatusUnprocessableEntity:
+			return blobserver.ErrPreconditionFailed
+		case http.StatusInsufficientStorage:
+			return blobserver.ErrQuotaExceeded
+		case http.StatusRequestTimeout, http.StatusInternalServerError,
+			http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			log.Errorf("swift: %v", err)
+			return blobserver.ErrBackendUnavailable
+		}
+	case net.Error:
+		log.Errorf("swift: %v", err)
+		return blobserver.ErrBackendUnavailable
+	}
+
+	return err
+}
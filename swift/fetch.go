@@ -5,14 +5,25 @@
 package swift
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"strconv"
+	"time"
 
+	"github.com/ncw/swift"
+	"github.com/simonz05/blobserver"
 	"github.com/simonz05/blobserver/blob"
 	"github.com/simonz05/util/log"
 )
 
+// contextReadCloser reads through a context aware Reader and closes
+// the underlying object.
+type contextReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
 // getInt64FromHeader is a helper function to decode int64 from header.
 func getInt64FromHeader(headers map[string]string, header string) (result int64, err error) {
 	value := headers[header]
@@ -24,15 +35,95 @@ func getInt64FromHeader(headers map[string]string, header string) (result int64,
 }
 
 func (sto *swiftStorage) Fetch(br blob.Ref) (file io.ReadCloser, size uint32, err error) {
-	ref, cont := sto.refContainer(br)
-	log.Println("Fetch: ", ref, cont)
-	f, h, err := sto.conn.ObjectOpen(cont, ref, true, nil)
+	return sto.FetchContext(context.Background(), br)
+}
+
+// FetchContext is like Fetch. The swift client can't cancel a request
+// in flight, so ctx is checked before the request and while reading
+// the blob.
+func (sto *swiftStorage) FetchContext(ctx context.Context, br blob.Ref) (file io.ReadCloser, size uint32, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	ref, conts := sto.refContainers(br)
+	log.Println("Fetch: ", ref, conts)
+	var f io.ReadCloser
+	var h swift.Headers
+	// reading the object doesn't use the connection, so it goes back
+	// to the pool once the response headers are in.
+	err = sto.pool.do(ctx, func(c *poolConn) (err error) {
+		for _, cont := range conts {
+			f, h, err = c.ObjectOpen(cont, ref, true, nil)
+
+			if err != swift.ObjectNotFound {
+				break
+			}
+		}
+		return
+	})
 	if err != nil {
+		err = translateError(err)
 		return
 	}
 	n, err := getInt64FromHeader(h, "Content-Length")
 	if err != nil {
+		f.Close()
 		return
 	}
-	return f, uint32(n), err
+	return contextReadCloser{blobserver.NewContextReader(ctx, f), f}, uint32(n), err
+}
+
+// SignedURL returns a TempURL of the blob, or its CDN URL, as
+// configured by redirect. Either names the container the blob is in,
+// which is looked up if it may be in more than one.
+func (sto *swiftStorage) SignedURL(ctx context.Context, br blob.Ref) (u string, err error) {
+	if sto.redirect != redirectTempURL && sto.redirect != redirectCDN {
+		return "", blobserver.ErrNoSignedURL
+	}
+
+	ref, conts := sto.refContainers(br)
+	cont := conts[0]
+
+	if len(conts) == 1 && sto.redirect == redirectCDN {
+		return sto.cdnUrl + cont + "/" + ref, nil
+	}
+
+	expires := time.Now().Add(sto.redirectExpiry)
+
+	err = sto.pool.do(ctx, func(c *poolConn) error {
+		if !c.Authenticated() {
+			if err := c.Authenticate(); err != nil {
+				return err
+			}
+		}
+
+		// while resharding, or after it, the blob may be in another
+		// container than the first.
+		if len(conts) > 1 {
+			for _, cand := range conts {
+				_, _, err := c.Object(cand, ref)
+
+				if err == swift.ObjectNotFound {
+					continue
+				}
+
+				if err != nil {
+					return err
+				}
+
+				cont = cand
+				break
+			}
+		}
+
+		if sto.redirect == redirectCDN {
+			u = sto.cdnUrl + cont + "/" + ref
+		} else {
+			u = c.ObjectTempUrl(cont, ref, sto.tempURLKey, "GET", expires)
+		}
+
+		return nil
+	})
+
+	return u, translateError(err)
 }
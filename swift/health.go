@@ -0,0 +1,27 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package swift
+
+import (
+	"context"
+	"fmt"
+)
+
+// CheckHealth checks that the account can be reached with a valid
+// token. An expired token is renewed, so the credentials are checked
+// too.
+func (sto *swiftStorage) CheckHealth(ctx context.Context) error {
+	return sto.pool.do(ctx, func(c *poolConn) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if _, _, err := c.Account(); err != nil {
+			return fmt.Errorf("swift: account: %v", err)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,113 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package swift
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ncw/swift"
+)
+
+// defaultMaxConns is the number of concurrent requests made to the
+// Swift host when SwiftConfig.MaxConns isn't set.
+const defaultMaxConns = 20
+
+// connPool hands out swift Connections for exclusive use by one
+// goroutine at a time, and at most size of them at once.
+//
+// A swift.Connection re-authenticates while holding its auth lock,
+// which blocks every request sharing it. Pooled connections instead
+// refresh their token independently: the connection which sees the
+// token expire authenticates, and the new token is handed to the
+// other connections as they are checked out.
+type connPool struct {
+	sem     chan struct{}
+	newConn func() *swift.Connection
+
+	mu         sync.Mutex
+	idle       []*poolConn
+	storageURL string
+	token      string
+}
+
+// poolConn is a connection checked out of a connPool.
+type poolConn struct {
+	*swift.Connection
+	token string // token given by the pool at checkout
+}
+
+// maxConns returns the configured number of concurrent requests, or
+// the default if n isn't set.
+func maxConns(n int) int {
+	if n <= 0 {
+		return defaultMaxConns
+	}
+	return n
+}
+
+func newConnPool(size int, newConn func() *swift.Connection) *connPool {
+	return &connPool{
+		sem:     make(chan struct{}, maxConns(size)),
+		newConn: newConn,
+	}
+}
+
+// get waits for a free connection. The connection must be returned
+// with put.
+func (p *connPool) get(ctx context.Context) (*poolConn, error) {
+	select {
+	case p.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var c *poolConn
+
+	if n := len(p.idle); n > 0 {
+		c = p.idle[n-1]
+		p.idle = p.idle[:n-1]
+	} else {
+		c = &poolConn{Connection: p.newConn()}
+	}
+
+	if p.token != "" && c.AuthToken != p.token {
+		c.StorageUrl = p.storageURL
+		c.AuthToken = p.token
+	}
+
+	c.token = c.AuthToken
+	return c, nil
+}
+
+// put returns c to the pool. If c authenticated while it was checked
+// out its token is shared with the rest of the pool.
+func (p *connPool) put(c *poolConn) {
+	p.mu.Lock()
+
+	if c.AuthToken != "" && c.AuthToken != c.token {
+		p.storageURL = c.StorageUrl
+		p.token = c.AuthToken
+	}
+
+	p.idle = append(p.idle, c)
+	p.mu.Unlock()
+	<-p.sem
+}
+
+// do runs fn with a connection from the pool.
+func (p *connPool) do(ctx context.Context, fn func(c *poolConn) error) error {
+	c, err := p.get(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer p.put(c)
+	return fn(c)
+}
@@ -0,0 +1,194 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package swift
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ncw/swift"
+	"github.com/simonz05/blobserver/config"
+	"github.com/simonz05/util/log"
+)
+
+// provisioned is what ensureContainer did to a container.
+type provisioned int
+
+const (
+	containerOK provisioned = iota
+	containerCreated
+	containerRepaired
+)
+
+// ensureContainer makes sure the container name exists and has the
+// read ACL of the storage. Containers which are fine are left alone.
+func (sto *swiftStorage) ensureContainer(c *poolConn, name string) (provisioned, error) {
+	h := swift.Headers{"X-Container-Read": sto.containerReadACL}
+	_, headers, err := c.Container(name)
+	state := containerOK
+
+	switch {
+	case err == swift.ContainerNotFound:
+		state = containerCreated
+		err = c.ContainerCreate(name, h)
+	case err != nil:
+	case headers["X-Container-Read"] != sto.containerReadACL:
+		state = containerRepaired
+		err = c.ContainerUpdate(name, h)
+	}
+
+	if err != nil || state == containerOK {
+		return state, err
+	}
+
+	if _, headers, err = c.Container(name); err != nil {
+		return state, err
+	}
+
+	if r := headers["X-Container-Read"]; r != sto.containerReadACL {
+		return state, fmt.Errorf("container %s has X-Container-Read %q, exp %q", name, r, sto.containerReadACL)
+	}
+
+	return state, nil
+}
+
+// ProvisionStats counts the containers handled by Provision.
+type ProvisionStats struct {
+	Created  int64
+	Repaired int64 // read ACL changed
+	OK       int64
+}
+
+// ProvisionError is returned when some containers failed to provision.
+type ProvisionError struct {
+	Errs []error
+}
+
+func (e *ProvisionError) Error() string {
+	const max = 3
+	msgs := make([]string, 0, max)
+
+	for i := 0; i < len(e.Errs) && i < max; i++ {
+		msgs = append(msgs, e.Errs[i].Error())
+	}
+
+	if len(e.Errs) > max {
+		msgs = append(msgs, fmt.Sprintf("and %d more", len(e.Errs)-max))
+	}
+
+	return fmt.Sprintf("swift: %d containers failed: %s", len(e.Errs), strings.Join(msgs, "; "))
+}
+
+// progressEvery is how many containers are provisioned between
+// progress log lines.
+const progressEvery = 256
+
+// provision runs ensureContainer on the containers conts with as many
+// workers as the pool has connections. A container which fails doesn't
+// stop the others; their errors are returned as a *ProvisionError.
+// Provisioning stops once ctx is done.
+func (sto *swiftStorage) provision(ctx context.Context, conts []string) (stats ProvisionStats, err error) {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+		done int64
+	)
+
+	work := make(chan string)
+
+	for i := 0; i < cap(sto.pool.sem); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for cont := range work {
+				var state provisioned
+				err := sto.pool.do(ctx, func(c *poolConn) (err error) {
+					state, err = sto.ensureContainer(c, cont)
+					return
+				})
+
+				switch {
+				case err != nil:
+					mu.Lock()
+					errs = append(errs, fmt.Errorf("%s: %v", cont, err))
+					mu.Unlock()
+				case state == containerCreated:
+					atomic.AddInt64(&stats.Created, 1)
+				case state == containerRepaired:
+					atomic.AddInt64(&stats.Repaired, 1)
+				default:
+					atomic.AddInt64(&stats.OK, 1)
+				}
+
+				if n := atomic.AddInt64(&done, 1); n%progressEvery == 0 {
+					log.Printf("swift: provisioned %d/%d containers", n, len(conts))
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, cont := range conts {
+		select {
+		case work <- cont:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+
+	close(work)
+	wg.Wait()
+
+	if err = ctx.Err(); err != nil {
+		return stats, err
+	}
+
+	log.Printf("swift: provisioned %d containers: %d created, %d repaired, %d failed",
+		len(conts), stats.Created, stats.Repaired, len(errs))
+
+	if len(errs) > 0 {
+		return stats, &ProvisionError{errs}
+	}
+
+	return stats, nil
+}
+
+// containers returns the names of all containers of the storage.
+func (sto *swiftStorage) containers() []string {
+	if !sto.shard {
+		return []string{sto.containerName}
+	}
+	return sto.shards.containers(sto.containerName)
+}
+
+// checkInit creates the containers of the storage and repairs their
+// read ACL.
+func (sto *swiftStorage) checkInit() error {
+	_, err := sto.provision(context.Background(), sto.containers())
+	return err
+}
+
+// Provision creates the containers of the storage configured by conf
+// and repairs their read ACL.
+func Provision(ctx context.Context, conf *config.SwiftConfig) (ProvisionStats, error) {
+	sto, err := newStorage(conf)
+
+	if err != nil {
+		return ProvisionStats{}, err
+	}
+
+	if sto.shard {
+		if err = sto.initShards(configShardScheme(conf)); err != nil {
+			return ProvisionStats{}, err
+		}
+	}
+
+	return sto.provision(ctx, sto.containers())
+}
@@ -6,6 +6,7 @@ package swift
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"hash"
@@ -98,10 +99,51 @@ func (ss *swiftSlurper) Cleanup() {
 }
 
 func (sto *swiftStorage) ReceiveBlob(b blob.Ref, source io.Reader) (sr blob.SizedRef, err error) {
+	return sto.ReceiveBlobContext(context.Background(), b, source)
+}
+
+// ReceiveBlobContext is like ReceiveBlob. The upload to swift reads
+// through ctx, so a cancel aborts the request before it completes.
+func (sto *swiftStorage) ReceiveBlobContext(ctx context.Context, b blob.Ref, source io.Reader) (sr blob.SizedRef, err error) {
+	return sto.ReceiveBlobOptions(ctx, b, source, blob.Options{})
+}
+
+// checkOptions returns ErrInvalidOptions unless swift can apply opts.
+// Swift has neither storage classes nor per-object encryption.
+func checkOptions(opts blob.Options) error {
+	if opts.StorageClass != "" || opts.ServerSideEncryption != "" || opts.KMSKeyID != "" {
+		return blobserver.ErrInvalidOptions
+	}
+
+	return nil
+}
+
+// objectHeaders returns the headers which store opts with an object.
+func objectHeaders(opts blob.Options) swift.Headers {
+	h := swift.Headers{}
+
+	if opts.CacheControl != "" {
+		h["Cache-Control"] = opts.CacheControl
+	}
+
+	if opts.ContentDisposition != "" {
+		h["Content-Disposition"] = opts.ContentDisposition
+	}
+
+	return h
+}
+
+// ReceiveBlobOptions is like ReceiveBlobContext but stores the blob
+// with the cache-control and content-disposition of opts.
+func (sto *swiftStorage) ReceiveBlobOptions(ctx context.Context, b blob.Ref, source io.Reader, opts blob.Options) (sr blob.SizedRef, err error) {
+	if err = checkOptions(opts); err != nil {
+		return
+	}
+
 	slurper := newSwiftSlurper(b)
 	defer slurper.Cleanup()
 
-	size, err := io.Copy(slurper, source)
+	size, err := io.Copy(slurper, blobserver.NewContextReader(ctx, source))
 
 	if err != nil {
 		return sr, err
@@ -109,23 +151,44 @@ func (sto *swiftStorage) ReceiveBlob(b blob.Ref, source io.Reader) (sr blob.Size
 
 	hash := hex.EncodeToString(slurper.md5.Sum(nil))
 	name, cont := sto.refContainer(b)
+	c, err := sto.pool.get(ctx)
+
+	if err != nil {
+		return sr, err
+	}
+
+	defer sto.pool.put(c)
 	retries := 1
+	reauthRetries := 3
 retry:
-	_, err = sto.conn.ObjectPut(cont, name, slurper, false, hash, "", nil)
+	token := c.AuthToken
+	_, err = c.ObjectPut(cont, name, blobserver.NewContextReader(ctx, slurper), false, hash, "", objectHeaders(opts))
+
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		return sr, ctxErr
+	}
+
+	// the swift client retries a request rejected for an expired
+	// token, but the body has been consumed by then. Resend it.
+	if err != nil && reauthRetries > 0 && c.AuthToken != token {
+		reauthRetries--
+		slurper.Seek(0, 0)
+		goto retry
+	}
 
 	if err != nil {
 		// assume both of these mean container not found in this context. Create the container first
 		if retries > 0 && (err == swift.ObjectNotFound || err == swift.ContainerNotFound) {
 			retries--
 
-			if err = sto.createContainer(cont); err != nil {
-				return sr, err
+			if _, err = sto.ensureContainer(c, cont); err != nil {
+				return sr, translateError(err)
 			}
 
 			slurper.Seek(0, 0)
 			goto retry
 		}
-		return sr, err
+		return sr, translateError(err)
 	}
 	ref := sto.createPathRef(b)
 	ref.SetHash(slurper.md5)
@@ -5,24 +5,48 @@
 package swift
 
 import (
+	"context"
+
+	"github.com/ncw/swift"
 	"github.com/simonz05/blobserver/blob"
 	"github.com/simonz05/util/log"
 	"github.com/simonz05/util/syncutil"
 )
 
-var removeGate = syncutil.NewGate(20) // arbitrary
-
 func (sto *swiftStorage) RemoveBlobs(blobs []blob.Ref) error {
+	return sto.RemoveBlobsContext(context.Background(), blobs)
+}
+
+// RemoveBlobsContext is like RemoveBlobs but stops issuing deletes once
+// ctx is done. Deletes already in flight are not interrupted.
+func (sto *swiftStorage) RemoveBlobsContext(ctx context.Context, blobs []blob.Ref) error {
 	var wg syncutil.Group
 
 	for _, br := range blobs {
 		br := br
-		removeGate.Start()
+		c, err := sto.pool.get(ctx)
+		if err != nil {
+			wg.Go(func() error { return err })
+			break
+		}
 		wg.Go(func() error {
-			defer removeGate.Done()
-			ref, cont := sto.refContainer(br)
-			log.Println("Remove: ", cont, ref)
-			return sto.conn.ObjectDelete(cont, ref)
+			defer sto.pool.put(c)
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			ref, conts := sto.refContainers(br)
+			log.Println("Remove: ", conts, ref)
+
+			for _, cont := range conts {
+				err := c.ObjectDelete(cont, ref)
+
+				// removal of non-existent blobs isn't an error
+				if err != nil && err != swift.ObjectNotFound && err != swift.ContainerNotFound {
+					return translateError(err)
+				}
+			}
+
+			return nil
 		})
 	}
 	return wg.Err()
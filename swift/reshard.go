@@ -0,0 +1,358 @@
+// Copyright 2014 Simon Zimmermann. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package swift
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ncw/swift"
+	"github.com/simonz05/blobserver/config"
+	"github.com/simonz05/util/log"
+	"github.com/simonz05/util/syncutil"
+)
+
+// markerName is the object in the base container which records the
+// shard scheme of a sharded storage.
+const markerName = "blobserver-shards.json"
+
+type shardMarker struct {
+	ShardScheme
+	// Next is the scheme a reshard is moving blobs to.
+	Next *ShardScheme `json:"next,omitempty"`
+	// Old is the scheme a finished reshard kept the copies of, since
+	// refs and CDN URLs issued before may name its containers.
+	Old *ShardScheme `json:"old,omitempty"`
+}
+
+// readMarker returns the shard marker of the storage, or nil if it has
+// none.
+func (sto *swiftStorage) readMarker(ctx context.Context) (m *shardMarker, err error) {
+	var data []byte
+
+	err = sto.pool.do(ctx, func(c *poolConn) (err error) {
+		data, err = c.ObjectGetBytes(sto.containerName, markerName)
+		return
+	})
+
+	if err == swift.ObjectNotFound || err == swift.ContainerNotFound {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	m = new(shardMarker)
+
+	if err = json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("swift: shard marker %s/%s: %v", sto.containerName, markerName, err)
+	}
+
+	return m, nil
+}
+
+func (sto *swiftStorage) writeMarker(ctx context.Context, m *shardMarker) error {
+	data, err := json.Marshal(m)
+
+	if err != nil {
+		return err
+	}
+
+	return sto.pool.do(ctx, func(c *poolConn) error {
+		// the base container isn't read by clients, it's created
+		// without the read ACL.
+		if err := c.ContainerCreate(sto.containerName, nil); err != nil {
+			return err
+		}
+		return c.ObjectPutBytes(sto.containerName, markerName, data, "application/json")
+	})
+}
+
+// initShards sets up the layout of a sharded storage configured with
+// scheme. It's checked against the marker, which is written if the
+// storage has none. While a reshard is in progress either scheme of
+// it may be configured, and blobs are also looked up in the other.
+// Once it's finished, blobs are removed from the old layout too until
+// it's pruned.
+func (sto *swiftStorage) initShards(scheme ShardScheme) (err error) {
+	if sto.shards, err = newSharder(scheme); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	m, err := sto.readMarker(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	if m == nil {
+		log.Printf("swift: container %s sharded by %s", sto.containerName, scheme)
+		return sto.writeMarker(ctx, &shardMarker{ShardScheme: scheme})
+	}
+
+	var prev ShardScheme
+
+	switch {
+	case m.ShardScheme == scheme && m.Next != nil:
+		prev = *m.Next
+	case m.ShardScheme == scheme:
+		if m.Old != nil {
+			sto.oldShards, err = newSharder(*m.Old)
+		}
+		return err
+	case m.Next != nil && *m.Next == scheme:
+		prev = m.ShardScheme
+	default:
+		return fmt.Errorf("swift: container %s is sharded by %s, not %s. Use blobserver-admin reshard to change it",
+			sto.containerName, m.ShardScheme, scheme)
+	}
+
+	sto.prevShards, err = newSharder(prev)
+	return err
+}
+
+// ReshardStats counts the blobs handled by Reshard.
+type ReshardStats struct {
+	Copied  int64 // copied to their new container
+	Present int64 // already in their new container
+	Removed int64 // removed from their old container
+}
+
+// Reshard moves the blobs of the sharded storage configured by conf to
+// the shard scheme conf sets, from the scheme recorded in the marker.
+//
+// Blobs are moved in two runs so servers keep finding them. The first
+// run records the new scheme in the marker and copies the blobs. Servers
+// started after that look up blobs in both layouts, and may be
+// configured with either scheme. Once every server has been restarted,
+// a run with finish set copies blobs stored in the old layout since and
+// records the new scheme as the current.
+//
+// The old copies are kept, since refs and CDN URLs issued before the
+// reshard name their containers. Servers resolve such refs in the new
+// layout, but CDN URLs point at the old copies. A run with prune set
+// removes them once those URLs are no longer used. prune may be given
+// with finish to remove them right away.
+func Reshard(ctx context.Context, conf *config.SwiftConfig, finish, prune bool) (stats ReshardStats, err error) {
+	if !conf.Shard {
+		return stats, fmt.Errorf("swift: container %s isn't sharded", conf.Container)
+	}
+
+	sto, err := newStorage(conf)
+
+	if err != nil {
+		return stats, err
+	}
+
+	to := configShardScheme(conf)
+	next, err := newSharder(to)
+
+	if err != nil {
+		return stats, err
+	}
+
+	m, err := sto.readMarker(ctx)
+
+	if err != nil {
+		return stats, err
+	}
+
+	if m == nil {
+		return stats, fmt.Errorf("swift: container %s has no shard marker. Start a server with its current scheme first", conf.Container)
+	}
+
+	if m.Next != nil && *m.Next != to {
+		return stats, fmt.Errorf("swift: container %s is being resharded to %s", conf.Container, *m.Next)
+	}
+
+	var from ShardScheme
+
+	switch {
+	case m.ShardScheme != to && m.Old != nil:
+		return stats, fmt.Errorf("swift: container %s keeps copies sharded by %s. Prune them first", conf.Container, *m.Old)
+	case m.ShardScheme != to:
+		if prune && !finish {
+			return stats, fmt.Errorf("swift: container %s is being resharded. Prune with finish", conf.Container)
+		}
+
+		from = m.ShardScheme
+		m.Next = &to
+
+		if err = sto.writeMarker(ctx, m); err != nil {
+			return stats, err
+		}
+	case m.Old != nil && prune:
+		from = *m.Old
+		finish = true
+	default:
+		log.Printf("swift: container %s is sharded by %s already", conf.Container, to)
+		return stats, nil
+	}
+
+	prev, err := newSharder(from)
+
+	if err != nil {
+		return stats, err
+	}
+
+	log.Printf("swift: reshard container %s from %s to %s", conf.Container, from, to)
+	r := &resharder{sto: sto, next: next, remove: finish && prune, created: make(map[string]bool)}
+
+	for _, cont := range prev.containers(conf.Container) {
+		if err = r.moveContainer(ctx, cont); err != nil {
+			return r.stats, err
+		}
+	}
+
+	if !finish {
+		return r.stats, nil
+	}
+
+	if !prune {
+		log.Printf("swift: container %s sharded by %s. Copies sharded by %s are kept until pruned", conf.Container, to, from)
+		return r.stats, sto.writeMarker(ctx, &shardMarker{ShardScheme: to, Old: &from})
+	}
+
+	current := make(map[string]bool)
+
+	for _, cont := range next.containers(conf.Container) {
+		current[cont] = true
+	}
+
+	for _, cont := range prev.containers(conf.Container) {
+		if current[cont] {
+			continue
+		}
+
+		err = sto.pool.do(ctx, func(c *poolConn) error {
+			return c.ContainerDelete(cont)
+		})
+
+		// containers receiving blobs from a server that wasn't
+		// restarted are left alone.
+		if err != nil && err != swift.ContainerNotFound && err != swift.ContainerNotEmpty {
+			return r.stats, err
+		}
+	}
+
+	return r.stats, sto.writeMarker(ctx, &shardMarker{ShardScheme: to})
+}
+
+type resharder struct {
+	sto    *swiftStorage
+	next   *sharder
+	remove bool // remove blobs from the old layout
+	stats  ReshardStats
+
+	mu      sync.Mutex
+	created map[string]bool
+}
+
+// moveContainer moves the blobs of the container cont of the old
+// layout.
+func (r *resharder) moveContainer(ctx context.Context, cont string) error {
+	var names []string
+
+	err := r.sto.pool.do(ctx, func(c *poolConn) (err error) {
+		names, err = c.ObjectNamesAll(cont, nil)
+		return
+	})
+
+	if err == swift.ContainerNotFound {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var wg syncutil.Group
+
+	for _, name := range names {
+		name := name
+		dst := r.next.container(r.sto.containerName, name)
+
+		if dst == cont {
+			continue
+		}
+
+		c, err := r.sto.pool.get(ctx)
+
+		if err != nil {
+			wg.Go(func() error { return err })
+			break
+		}
+
+		wg.Go(func() error {
+			defer r.sto.pool.put(c)
+			return r.move(c, cont, dst, name)
+		})
+	}
+
+	if err := wg.Err(); err != nil {
+		return err
+	}
+
+	log.Printf("swift: reshard %s: %d blobs", cont, len(names))
+	return nil
+}
+
+func (r *resharder) move(c *poolConn, src, dst, name string) error {
+	_, _, err := c.Object(dst, name)
+
+	switch err {
+	case nil:
+		atomic.AddInt64(&r.stats.Present, 1)
+	case swift.ObjectNotFound:
+		if err = r.createContainer(c, dst); err != nil {
+			return err
+		}
+
+		if _, err = c.ObjectCopy(src, name, dst, name, nil); err != nil {
+			return fmt.Errorf("swift: copy %s/%s to %s: %v", src, name, dst, err)
+		}
+
+		atomic.AddInt64(&r.stats.Copied, 1)
+	default:
+		return err
+	}
+
+	if !r.remove {
+		return nil
+	}
+
+	if err = c.ObjectDelete(src, name); err != nil && err != swift.ObjectNotFound {
+		return err
+	}
+
+	atomic.AddInt64(&r.stats.Removed, 1)
+	return nil
+}
+
+// createContainer creates the container cont of the new layout unless
+// this reshard has created it already.
+func (r *resharder) createContainer(c *poolConn, cont string) error {
+	r.mu.Lock()
+	done := r.created[cont]
+	r.mu.Unlock()
+
+	if done {
+		return nil
+	}
+
+	if _, err := r.sto.ensureContainer(c, cont); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.created[cont] = true
+	r.mu.Unlock()
+	return nil
+}
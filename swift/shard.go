@@ -6,33 +6,115 @@ package swift
 
 import (
 	"crypto/md5"
-	"encoding/hex"
+	"crypto/sha1"
+	"encoding/binary"
 	"fmt"
-	"strconv"
+	"hash/fnv"
+
+	"github.com/simonz05/blobserver/config"
 )
 
-const shardCount = 8 << 7
+// ShardScheme says how the blobs of a sharded storage are spread over
+// its containers.
+type ShardScheme struct {
+	Count int    `json:"count"`
+	Hash  string `json:"hash"`
+}
+
+// DefaultShardScheme is the layout of storages which don't configure
+// one, and of all storages created before it was configurable.
+var DefaultShardScheme = ShardScheme{Count: 8 << 7, Hash: "md5"}
+
+func (s ShardScheme) String() string {
+	return fmt.Sprintf("%s/%d", s.Hash, s.Count)
+}
+
+// configShardScheme returns the scheme set in conf.
+func configShardScheme(conf *config.SwiftConfig) ShardScheme {
+	s := DefaultShardScheme
+
+	if conf.ShardCount != 0 {
+		s.Count = conf.ShardCount
+	}
 
-type sharder [shardCount]string
+	if conf.ShardHash != "" {
+		s.Hash = conf.ShardHash
+	}
 
-func (s sharder) shard(v string) string {
-	src := md5.Sum([]byte(v))
-	str := hex.EncodeToString(src[:])
-	return s[int(s.num(str))]
+	return s
 }
 
-func (s sharder) num(digest string) uint32 {
-	return s.sum32(digest) % uint32(shardCount)
+// shardHashes are the hash functions a blob name can be sharded by,
+// with the largest number of shards each supports.
+var shardHashes = map[string]struct {
+	sum func(string) uint32
+	max int
+}{
+	// md5 uses the first 4 hex digits of the digest.
+	"md5": {func(v string) uint32 {
+		src := md5.Sum([]byte(v))
+		return uint32(binary.BigEndian.Uint16(src[:2]))
+	}, 1 << 16},
+	"sha1": {func(v string) uint32 {
+		src := sha1.Sum([]byte(v))
+		return binary.BigEndian.Uint32(src[:4])
+	}, 1 << 20},
+	"fnv": {func(v string) uint32 {
+		h := fnv.New32a()
+		h.Write([]byte(v))
+		return h.Sum32()
+	}, 1 << 20},
 }
 
-func (s sharder) sum32(digest string) uint32 {
-	vv, _ := strconv.ParseUint(digest[:4], 16, 32)
-	return uint32(vv)
+type sharder struct {
+	ShardScheme
+	sum   func(string) uint32
+	names []string
 }
 
-func newSharder() (s sharder) {
-	for i := range s {
-		s[i] = fmt.Sprintf("%0.2x", i)
+func newSharder(s ShardScheme) (*sharder, error) {
+	h, ok := shardHashes[s.Hash]
+
+	if !ok {
+		return nil, fmt.Errorf("swift: unknown shard hash %q", s.Hash)
 	}
-	return s
+
+	if s.Count <= 0 || s.Count > h.max {
+		return nil, fmt.Errorf("swift: shard count %d out of range 1-%d for %s", s.Count, h.max, s.Hash)
+	}
+
+	sh := &sharder{
+		ShardScheme: s,
+		sum:         h.sum,
+		names:       make([]string, s.Count),
+	}
+
+	for i := range sh.names {
+		sh.names[i] = fmt.Sprintf("%0.2x", i)
+	}
+
+	return sh, nil
+}
+
+// shard returns the name of the shard holding the blob named v.
+func (s *sharder) shard(v string) string {
+	return s.names[s.sum(v)%uint32(s.Count)]
+}
+
+// container returns the container of the blob named v in the storage
+// with base container name.
+func (s *sharder) container(name, v string) string {
+	return fmt.Sprintf("%s-%s", name, s.shard(v))
+}
+
+// containers returns the names of all containers of the storage with
+// base container name.
+func (s *sharder) containers(name string) []string {
+	conts := make([]string, len(s.names))
+
+	for i, shard := range s.names {
+		conts[i] = fmt.Sprintf("%s-%s", name, shard)
+	}
+
+	return conts
 }
@@ -9,21 +9,37 @@ import (
 )
 
 func TestShard(t *testing.T) {
-	s := newSharder()
 	tests := []struct {
-		data string
-		exp  string
+		scheme ShardScheme
+		data   string
+		exp    string
 	}{
-		{
-			data: string("\x00"),
-			exp:  "3b8",
-		},
+		{DefaultShardScheme, "\x00", "3b8"},
+		{ShardScheme{Count: 16, Hash: "md5"}, "\x00", "08"},
+		{ShardScheme{Count: 1 << 12, Hash: "sha1"}, "\x00", "c9d"},
+		{ShardScheme{Count: 256, Hash: "fnv"}, "\x00", "1f"},
 	}
 
 	for i, tt := range tests {
+		s, err := newSharder(tt.scheme)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
 		shard := s.shard(tt.data)
 		if shard != tt.exp {
 			t.Fatalf("%d: exp %s got %s", i, tt.exp, shard)
 		}
 	}
 }
+
+func TestShardScheme(t *testing.T) {
+	for _, s := range []ShardScheme{
+		{Count: 0, Hash: "md5"},
+		{Count: 1<<16 + 1, Hash: "md5"},
+		{Count: 16, Hash: "crc32"},
+	} {
+		if _, err := newSharder(s); err == nil {
+			t.Errorf("%s: no error", s)
+		}
+	}
+}
@@ -5,7 +5,7 @@
 package swift
 
 import (
-	"fmt"
+	"context"
 
 	"github.com/ncw/swift"
 	"github.com/simonz05/blobserver/blob"
@@ -13,33 +13,58 @@ import (
 	"github.com/simonz05/util/syncutil"
 )
 
-var statGate = syncutil.NewGate(20) // arbitrary
-
 func (sto *swiftStorage) StatBlobs(dest chan<- blob.SizedInfoRef, blobs []blob.Ref) error {
+	return sto.StatBlobsContext(context.Background(), dest, blobs)
+}
+
+// StatBlobsContext is like StatBlobs but stops statting once ctx is
+// done. Requests already in flight are not interrupted.
+func (sto *swiftStorage) StatBlobsContext(ctx context.Context, dest chan<- blob.SizedInfoRef, blobs []blob.Ref) error {
 	var wg syncutil.Group
 
 	for _, br := range blobs {
-		br := sto.createPathRef(br)
-		statGate.Start()
+		ref, conts := sto.refContainers(br)
+		c, err := sto.pool.get(ctx)
+		if err != nil {
+			wg.Go(func() error { return err })
+			break
+		}
 		wg.Go(func() error {
-			defer statGate.Done()
-			ref, cont := sto.refContainer(br)
-			log.Println("REF:", ref, cont)
-			info, _, err := sto.conn.Object(cont, ref)
-			log.Println("Stat:", info, err, ref, br.Path)
+			defer sto.pool.put(c)
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			log.Println("REF:", ref, conts)
+			var info swift.Object
+			var cont string
+			var err error
+
+			for _, cont = range conts {
+				if info, _, err = c.Object(cont, ref); err != swift.ObjectNotFound {
+					break
+				}
+			}
+			log.Println("Stat:", info, err, ref, cont)
 
 			if err == nil {
-				dest <- blob.SizedInfoRef{
-					Ref:  br,
-					Size: uint32(info.Bytes),
-					MD5:  info.Hash,
+				sb := blob.SizedInfoRef{
+					Ref:         blob.Ref{Path: cont + "/" + ref},
+					Size:        uint32(info.Bytes),
+					MD5:         info.Hash,
+					ModTime:     info.LastModified,
+					ContentType: info.ContentType,
+				}
+				select {
+				case dest <- sb:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
 				}
-				return nil
 			}
-			if err == swift.ObjectNotFound {
+			if err == swift.ObjectNotFound || err == swift.ContainerNotFound {
 				return nil
 			}
-			return fmt.Errorf("error statting %v: %v", br, err)
+			return translateError(err)
 		})
 	}
 	return wg.Err()
@@ -8,28 +8,41 @@
 package swift
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"strings"
+	"time"
 
-	"github.com/ncw/swift"
 	"github.com/simonz05/blobserver"
 	"github.com/simonz05/blobserver/blob"
 	"github.com/simonz05/blobserver/config"
-	"github.com/simonz05/util/log"
 )
 
-var shards sharder
-
 type swiftStorage struct {
-	conn             *swift.Connection
+	pool             *connPool
+	authURL          string
 	containerName    string
 	shard            bool
+	shards           *sharder // nil unless shard
+	prevShards       *sharder // the other layout during a reshard
+	oldShards        *sharder // the layout a finished reshard kept copies in
 	containerReadACL string
 	cdnUrl           string
+	redirect         string // redirectTempURL, redirectCDN or none
+	redirectExpiry   time.Duration
+	tempURLKey       string
 }
 
+const (
+	redirectTempURL = "tempurl"
+	redirectCDN     = "cdn"
+
+	defaultRedirectExpiry = 5 * time.Minute
+)
+
 func (s *swiftStorage) String() string {
-	return fmt.Sprintf("\"swift\" blob storage at host %v, container %v", s.conn.AuthUrl, s.container)
+	return fmt.Sprintf("\"swift\" blob storage at host %v, container %v", s.authURL, s.containerName)
 }
 
 func (s *swiftStorage) Config() *blobserver.Config {
@@ -51,7 +64,7 @@ func (s *swiftStorage) container(b blob.Ref) string {
 		return ref[:idx]
 	}
 
-	return fmt.Sprintf("%s-%s", s.containerName, shards.shard(ref[:]))
+	return s.shards.container(s.containerName, ref)
 }
 
 func (s *swiftStorage) refContainer(b blob.Ref) (name string, container string) {
@@ -65,40 +78,44 @@ func (s *swiftStorage) refContainer(b blob.Ref) (name string, container string)
 	return b.String(), s.container(b)
 }
 
-func (sto *swiftStorage) createContainer(name string) (err error) {
-	for i := 0; i < 3; i++ {
-		if err = sto.createCheckContainer(name); err != nil {
-			log.Errorf("create container failed %d, %v", i, err)
-		}
-	}
-	return
-}
-
-func (sto *swiftStorage) createCheckContainer(name string) (err error) {
-	h := swift.Headers{"X-Container-Read": sto.containerReadACL}
-	err = sto.conn.ContainerCreate(name, h)
+// refContainers is like refContainer, but returns every container the
+// blob may be in. While a reshard is in progress the blob may not have
+// been moved yet, and after it a copy may be kept in the old layout.
+// Refs qualified by a container of another layout are looked up in the
+// current one too, so refs issued before a reshard keep working.
+func (s *swiftStorage) refContainers(b blob.Ref) (name string, conts []string) {
+	name, cont := s.refContainer(b)
+	conts = []string{cont}
 
-	if err != nil {
-		return err
+	if !s.shard {
+		return
 	}
 
-	_, headers, err := sto.conn.Container(name)
-
-	if err != nil {
-		return err
+	if strings.Index(b.String(), "/") > 0 && !strings.HasPrefix(cont, s.containerName+"-") {
+		return
 	}
 
-	r, ok := headers["X-Container-Read"]
+	for _, sh := range []*sharder{s.shards, s.prevShards, s.oldShards} {
+		if sh == nil {
+			continue
+		}
 
-	if !ok {
-		return fmt.Errorf("create container exp X-Container-Read key missing")
+		if c := sh.container(s.containerName, name); !containsString(conts, c) {
+			conts = append(conts, c)
+		}
 	}
 
-	if r != sto.containerReadACL {
-		return fmt.Errorf("create container exp X-Container-Read: %s", sto.containerReadACL)
+	return
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
 	}
 
-	return nil
+	return false
 }
 
 func (s *swiftStorage) createPathRef(b blob.Ref) blob.Ref {
@@ -106,36 +123,79 @@ func (s *swiftStorage) createPathRef(b blob.Ref) blob.Ref {
 	return blob.Ref{Path: cont + "/" + name}
 }
 
-func newFromConfig(conf *config.Config) (blobserver.Storage, error) {
-	swiftConf := conf.Swift
+// newStorage returns an authenticated storage for swiftConf.
+func newStorage(swiftConf *config.SwiftConfig) (*swiftStorage, error) {
+	// pooled connections share one transport so that keep-alive
+	// connections to the host are reused between them.
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost: maxConns(swiftConf.MaxConns),
+	}
 
-	conn := &swift.Connection{
-		UserName: swiftConf.APIUser,
-		ApiKey:   swiftConf.APIKey,
-		AuthUrl:  swiftConf.AuthURL,
-		Region:   swiftConf.Region,
-		Tenant:   swiftConf.Tenant,
-		//TenantId: swiftConf.TenantID,
+	newConn, err := newAuth(swiftConf, transport)
+
+	if err != nil {
+		return nil, err
 	}
 
 	sto := &swiftStorage{
-		conn:             conn,
+		pool:             newConnPool(swiftConf.MaxConns, newConn),
+		authURL:          swiftConf.AuthURL,
 		shard:            swiftConf.Shard,
 		containerName:    swiftConf.Container,
 		containerReadACL: ".r:*,.rlistings",
 		cdnUrl:           swiftConf.CDNUrl,
+		redirect:         swiftConf.Redirect,
+		redirectExpiry:   swiftConf.RedirectExpiry.Duration,
+		tempURLKey:       swiftConf.TempURLKey,
+	}
+
+	switch sto.redirect {
+	case "":
+	case redirectTempURL:
+		if sto.tempURLKey == "" {
+			return nil, fmt.Errorf("swift: redirect %s needs temp_url_key", redirectTempURL)
+		}
+	case redirectCDN:
+		if sto.cdnUrl == "" {
+			return nil, fmt.Errorf("swift: redirect %s needs cdn_url", redirectCDN)
+		}
+	default:
+		return nil, fmt.Errorf("swift: redirect must be %s or %s, got %q", redirectTempURL, redirectCDN, sto.redirect)
+	}
+
+	if sto.redirectExpiry == 0 {
+		sto.redirectExpiry = defaultRedirectExpiry
 	}
 
 	if swiftConf.ContainerReadACL != "" {
 		sto.containerReadACL = swiftConf.ContainerReadACL
 	}
 
-	err := sto.conn.Authenticate()
+	err = sto.pool.do(context.Background(), func(c *poolConn) error {
+		return c.Authenticate()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sto, nil
+}
+
+func newFromConfig(conf *config.Config) (blobserver.Storage, error) {
+	sto, err := newStorage(conf.Swift)
+
 	if err != nil {
 		return nil, err
 	}
 
-	if swiftConf.CheckInit {
+	if sto.shard {
+		if err = sto.initShards(configShardScheme(conf.Swift)); err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.Swift.CheckInit {
 		if err = sto.checkInit(); err != nil {
 			return nil, err
 		}
@@ -145,6 +205,5 @@ func newFromConfig(conf *config.Config) (blobserver.Storage, error) {
 }
 
 func init() {
-	shards = newSharder()
 	blobserver.RegisterStorageConstructor("swift", blobserver.StorageConstructor(newFromConfig))
 }
@@ -5,11 +5,25 @@
 package swift
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/ncw/swift"
+	"github.com/ncw/swift/swifttest"
 	"github.com/simonz05/blobserver"
+	"github.com/simonz05/blobserver/blob"
 	"github.com/simonz05/blobserver/config"
 	"github.com/simonz05/blobserver/storagetest"
 )
@@ -40,7 +54,10 @@ func TestSwift(t *testing.T) {
 
 func creator(ech chan error, in, out chan string, sto *swiftStorage) {
 	for cont := range in {
-		err := sto.createContainer(cont)
+		err := sto.pool.do(context.Background(), func(c *poolConn) error {
+			_, err := sto.ensureContainer(c, cont)
+			return err
+		})
 		if err != nil {
 			ech <- err
 			return
@@ -52,7 +69,11 @@ func creator(ech chan error, in, out chan string, sto *swiftStorage) {
 
 func statter(ech chan error, in, out chan string, sto *swiftStorage) {
 	for cont := range in {
-		_, headers, err := sto.conn.Container(cont)
+		var headers swift.Headers
+		err := sto.pool.do(context.Background(), func(c *poolConn) (err error) {
+			_, headers, err = c.Container(cont)
+			return
+		})
 		if err != nil {
 			ech <- err
 			return
@@ -70,7 +91,9 @@ func statter(ech chan error, in, out chan string, sto *swiftStorage) {
 
 func deleter(ech chan error, in, out chan string, sto *swiftStorage) {
 	for cont := range in {
-		err := sto.conn.ContainerDelete(cont)
+		err := sto.pool.do(context.Background(), func(c *poolConn) error {
+			return c.ContainerDelete(cont)
+		})
 		if err != nil {
 			ech <- err
 			return
@@ -99,12 +122,12 @@ func TestSwiftContainerACL(t *testing.T) {
 	}
 
 	var shards []string
-	ss := newSharder()
+	ss, _ := newSharder(DefaultShardScheme)
 
 	if testing.Short() {
-		shards = ss[:5]
+		shards = ss.names[:5]
 	} else {
-		shards = ss[:100]
+		shards = ss.names[:100]
 	}
 
 	for _, shard := range shards {
@@ -126,3 +149,991 @@ func TestSwiftContainerACL(t *testing.T) {
 	close(dch)
 	close(qch)
 }
+
+// swiftProxy sits in front of a swifttest server and adds what it
+// lacks: tokens issued before the last call to expire are rejected,
+// like on a Swift cluster whose tokens time out, container read ACLs
+// are kept and Keystone v2 and v3 auth is emulated.
+//
+// Keystone lists the proxy as the public endpoint of RegionOne and
+// internal as its internal endpoint.
+type swiftProxy struct {
+	srv      *swifttest.SwiftServer
+	backend  string
+	proxy    *httptest.Server
+	internal *httptest.Server
+
+	mu      sync.Mutex
+	valid   map[string]bool
+	acls    map[string]string
+	failing map[string]bool
+	auths   int
+}
+
+// isContainerPath reports whether path names a container, that is
+// /v1/{account}/{container}.
+func isContainerPath(path string) bool {
+	return len(strings.Split(strings.Trim(path, "/"), "/")) == 3
+}
+
+func newSwiftProxy(t *testing.T) *swiftProxy {
+	srv, err := swifttest.NewSwiftServer("localhost")
+	if err != nil {
+		t.Fatalf("swifttest: %v", err)
+	}
+
+	backend := "http://" + srv.Listener.Addr().String()
+	p := &swiftProxy{
+		srv:     srv,
+		backend: backend,
+		valid:   make(map[string]bool),
+		acls:    make(map[string]string),
+		failing: make(map[string]bool),
+	}
+	target, _ := url.Parse(backend)
+	rp := httputil.NewSingleHostReverseProxy(target)
+	rp.ModifyResponse = func(resp *http.Response) error {
+		if path := resp.Request.URL.Path; isContainerPath(path) {
+			p.mu.Lock()
+			if acl, ok := p.acls[path]; ok {
+				resp.Header.Set("X-Container-Read", acl)
+			}
+			p.mu.Unlock()
+			return nil
+		}
+
+		token := resp.Header.Get("X-Auth-Token")
+
+		if resp.Request.URL.Path != "/v1.0" || token == "" {
+			return nil
+		}
+
+		p.issue(token)
+		storageURL := resp.Header.Get("X-Storage-Url")
+		resp.Header.Set("X-Storage-Url", strings.Replace(storageURL, backend, p.proxy.URL, 1))
+		return nil
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch path := req.URL.Path; {
+		case strings.HasSuffix(path, "/auth/tokens"):
+			p.keystoneV3(w, req)
+			return
+		case strings.HasSuffix(path, "/tokens"):
+			p.keystoneV2(w, req)
+			return
+		case path == "/v1.0":
+		default:
+			p.mu.Lock()
+			// TempURLs are checked by the backend.
+			ok := p.valid[req.Header.Get("X-Auth-Token")] || req.URL.Query().Get("temp_url_sig") != ""
+			failing := p.failing[path]
+			p.mu.Unlock()
+
+			if !ok {
+				io.Copy(ioutil.Discard, req.Body)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			if failing {
+				io.Copy(ioutil.Discard, req.Body)
+				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		if acl, ok := req.Header["X-Container-Read"]; ok && isContainerPath(req.URL.Path) {
+			p.mu.Lock()
+			p.acls[req.URL.Path] = acl[0]
+			p.mu.Unlock()
+		}
+		rp.ServeHTTP(w, req)
+	})
+	p.proxy = httptest.NewServer(handler)
+	p.internal = httptest.NewServer(handler)
+
+	return p
+}
+
+// issue marks token as valid.
+func (p *swiftProxy) issue(token string) {
+	p.mu.Lock()
+	p.valid[token] = true
+	p.auths++
+	p.mu.Unlock()
+}
+
+// Credentials accepted by the Keystone emulation besides the
+// swifttest account, which lives in the default domain.
+const (
+	testProjectID     = "project-id"
+	testProject       = "blobserver"
+	testAppCredID     = "appcred-id"
+	testAppCredName   = "appcred"
+	testAppCredSecret = "appcred-secret"
+)
+
+// token authenticates with the swifttest server and returns a token
+// for the proxy.
+func (p *swiftProxy) token() (string, error) {
+	req, _ := http.NewRequest("GET", p.backend+"/v1.0", nil)
+	req.Header.Set("X-Auth-User", swifttest.TEST_ACCOUNT)
+	req.Header.Set("X-Auth-Key", swifttest.TEST_ACCOUNT)
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		return "", err
+	}
+
+	resp.Body.Close()
+	token := resp.Header.Get("X-Auth-Token")
+
+	if token == "" {
+		return "", fmt.Errorf("swifttest auth: %s", resp.Status)
+	}
+
+	p.issue(token)
+	return token, nil
+}
+
+func (p *swiftProxy) storageURL(base string) string {
+	return base + "/v1/AUTH_" + swifttest.TEST_ACCOUNT
+}
+
+func (p *swiftProxy) keystoneV2(w http.ResponseWriter, req *http.Request) {
+	var r struct {
+		Auth struct {
+			PasswordCredentials *struct {
+				Username, Password string
+			}
+			TenantID   string `json:"tenantId"`
+			TenantName string `json:"tenantName"`
+		}
+	}
+
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	creds := r.Auth.PasswordCredentials
+
+	if creds == nil || creds.Username != swifttest.TEST_ACCOUNT || creds.Password != swifttest.TEST_ACCOUNT ||
+		(r.Auth.TenantID != testProjectID && r.Auth.TenantName != testProject) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	token, err := p.token()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, `{"access": {"token": {"id": %q}, "serviceCatalog": [{"type": "object-store", "endpoints": [
+		{"region": "RegionOne", "publicURL": %q, "internalURL": %q}]}]}}`,
+		token, p.storageURL(p.proxy.URL), p.storageURL(p.internal.URL))
+}
+
+func (p *swiftProxy) keystoneV3(w http.ResponseWriter, req *http.Request) {
+	var r v3AuthRequest
+
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	inDefault := func(d *v3Domain) bool {
+		return d != nil && (d.Name == "Default" || d.ID == "default")
+	}
+	isUser := func(u *v3User) bool {
+		return u != nil && u.Name == swifttest.TEST_ACCOUNT && inDefault(u.Domain)
+	}
+
+	id := r.Auth.Identity
+	scoped := false
+
+	switch {
+	case len(id.Methods) != 1:
+	case id.Methods[0] == "password" && id.Password != nil:
+		if !isUser(id.Password.User) || id.Password.User.Password != swifttest.TEST_ACCOUNT {
+			break
+		}
+		if s := r.Auth.Scope; s != nil && s.Project != nil {
+			scoped = s.Project.ID == testProjectID ||
+				(s.Project.Name == testProject && inDefault(s.Project.Domain))
+		}
+	case id.Methods[0] == "application_credential" && id.AppCred != nil:
+		if r.Auth.Scope != nil {
+			http.Error(w, "application credentials can't request a scope", http.StatusBadRequest)
+			return
+		}
+		scoped = id.AppCred.Secret == testAppCredSecret && (id.AppCred.ID == testAppCredID ||
+			(id.AppCred.Name == testAppCredName && isUser(id.AppCred.User)))
+	}
+
+	if !scoped {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	token, err := p.token()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("X-Subject-Token", token)
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, `{"token": {"catalog": [
+		{"type": "identity", "endpoints": [{"interface": "public", "region": "RegionOne", "url": %q}]},
+		{"type": "object-store", "endpoints": [
+			{"interface": "public", "region": "RegionOne", "url": %q},
+			{"interface": "internal", "region": "RegionOne", "url": %q},
+			{"interface": "public", "region": "RegionTwo", "url": "http://region-two.invalid/v1"}]}]}}`,
+		p.proxy.URL+"/v3", p.storageURL(p.proxy.URL), p.storageURL(p.internal.URL))
+}
+
+func (p *swiftProxy) authURL() string {
+	return p.proxy.URL + "/v1.0"
+}
+
+func (p *swiftProxy) expire() {
+	p.mu.Lock()
+	p.valid = make(map[string]bool)
+	p.mu.Unlock()
+}
+
+// fail makes requests for the container cont fail.
+func (p *swiftProxy) fail(cont string) {
+	p.mu.Lock()
+	p.failing["/v1/AUTH_"+swifttest.TEST_ACCOUNT+"/"+cont] = true
+	p.mu.Unlock()
+}
+
+func (p *swiftProxy) authCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.auths
+}
+
+func (p *swiftProxy) close() {
+	p.internal.Close()
+	p.proxy.Close()
+	p.srv.Close()
+}
+
+// newLocalStorage returns a swift storage configured by conf which
+// is backed by a swifttest server.
+func newLocalStorage(t *testing.T, conf *config.SwiftConfig) (*swiftStorage, *swiftProxy) {
+	p := newSwiftProxy(t)
+	sto, err := newProxyStorage(p, conf)
+
+	if err != nil {
+		p.close()
+		t.Fatalf("newFromConfig error: %v", err)
+	}
+
+	return sto, p
+}
+
+// newProxyStorage returns a swift storage configured by conf which is
+// backed by the swifttest server behind p.
+func newProxyStorage(p *swiftProxy, conf *config.SwiftConfig) (*swiftStorage, error) {
+	conf.APIUser = swifttest.TEST_ACCOUNT
+	conf.APIKey = swifttest.TEST_ACCOUNT
+	conf.AuthURL = p.authURL()
+
+	sto, err := newFromConfig(&config.Config{Swift: conf})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return sto.(*swiftStorage), nil
+}
+
+// containerACL returns the read ACL of the container name.
+func containerACL(sto *swiftStorage, name string) (acl string, err error) {
+	err = sto.pool.do(context.Background(), func(c *poolConn) error {
+		_, headers, err := c.Container(name)
+		acl = headers["X-Container-Read"]
+		return err
+	})
+	return
+}
+
+func TestSwiftLocal(t *testing.T) {
+	storagetest.Test(t, func(t *testing.T) (blobserver.Storage, func()) {
+		sto, p := newLocalStorage(t, &config.SwiftConfig{Container: "blobserver-test"})
+		return sto, p.close
+	})
+}
+
+func TestSwiftLocalSharded(t *testing.T) {
+	storagetest.Test(t, func(t *testing.T) (blobserver.Storage, func()) {
+		sto, p := newLocalStorage(t, &config.SwiftConfig{
+			Container: "blobserver-test",
+			Shard:     true,
+		})
+		return sto, p.close
+	})
+}
+
+func TestSwiftReceiveCreatesContainer(t *testing.T) {
+	for _, shard := range []bool{false, true} {
+		sto, p := newLocalStorage(t, &config.SwiftConfig{
+			Container:        "blobserver-test",
+			ContainerReadACL: ".r:*",
+			Shard:            shard,
+		})
+
+		b := storagetest.NewBlob("foo")
+		cont := sto.container(b.BlobRef)
+
+		if _, err := containerACL(sto, cont); err != swift.ContainerNotFound {
+			t.Errorf("shard %v: container %s exists before receive: %v", shard, cont, err)
+		}
+
+		sb, err := sto.ReceiveBlob(b.BlobRef, b.Reader())
+		if err != nil {
+			t.Fatalf("shard %v: ReceiveBlob: %v", shard, err)
+		}
+
+		if exp := cont + "/" + b.BlobRef.String(); sb.Ref.String() != exp {
+			t.Errorf("shard %v: got ref %s, want %s", shard, sb.Ref, exp)
+		}
+
+		acl, err := containerACL(sto, cont)
+		if err != nil {
+			t.Errorf("shard %v: container %s: %v", shard, cont, err)
+		} else if acl != ".r:*" {
+			t.Errorf("shard %v: container %s read ACL is %q, want %q", shard, cont, acl, ".r:*")
+		}
+
+		p.close()
+	}
+}
+
+func TestSwiftOptions(t *testing.T) {
+	sto, p := newLocalStorage(t, &config.SwiftConfig{Container: "blobserver-test"})
+	defer p.close()
+
+	b := storagetest.NewBlob("foo")
+	opts := blob.Options{ContentDisposition: "attachment"}
+
+	if _, err := sto.ReceiveBlobOptions(context.Background(), b.BlobRef, b.Reader(), opts); err != nil {
+		t.Fatalf("ReceiveBlobOptions: %v", err)
+	}
+
+	var headers swift.Headers
+	err := sto.pool.do(context.Background(), func(c *poolConn) (err error) {
+		_, headers, err = c.Object(sto.container(b.BlobRef), b.BlobRef.String())
+		return
+	})
+	if err != nil {
+		t.Fatalf("Object: %v", err)
+	}
+
+	if headers["Content-Disposition"] != "attachment" {
+		t.Errorf("Content-Disposition is %q, want %q", headers["Content-Disposition"], "attachment")
+	}
+
+	invalid := []blob.Options{
+		{StorageClass: "STANDARD_IA"},
+		{ServerSideEncryption: "AES256"},
+		{ServerSideEncryption: "aws:kms", KMSKeyID: "key-1"},
+	}
+	for _, opts := range invalid {
+		if _, err := sto.ReceiveBlobOptions(context.Background(), b.BlobRef, b.Reader(), opts); err != blobserver.ErrInvalidOptions {
+			t.Errorf("ReceiveBlobOptions %+v: got %v, want %v", opts, err, blobserver.ErrInvalidOptions)
+		}
+	}
+}
+
+func TestSwiftSignedURL(t *testing.T) {
+	sto, p := newLocalStorage(t, &config.SwiftConfig{
+		Container:  "blobserver-test",
+		Shard:      true,
+		Redirect:   redirectTempURL,
+		TempURLKey: "temp-url-key",
+	})
+	defer p.close()
+
+	err := sto.pool.do(context.Background(), func(c *poolConn) error {
+		return c.AccountUpdate(swift.Headers{"X-Account-Meta-Temp-Url-Key": "temp-url-key"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := storagetest.NewBlob("foo")
+
+	sb, err := sto.ReceiveBlob(b.BlobRef, b.Reader())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := sto.SignedURL(context.Background(), b.BlobRef)
+	if err != nil {
+		t.Fatalf("SignedURL: %v", err)
+	}
+
+	if !strings.HasPrefix(u, p.proxy.URL) || !strings.Contains(u, "temp_url_sig=") {
+		t.Fatalf("SignedURL is %s, want a TempURL of %s", u, p.proxy.URL)
+	}
+
+	res, err := http.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if res.StatusCode != 200 || string(body) != "foo" {
+		t.Errorf("GET TempURL: %s %q, want 200 \"foo\"", res.Status, body)
+	}
+
+	sto.redirect = redirectCDN
+	sto.cdnUrl = "https://cdn.example.com/"
+
+	// CDN URLs name the container of sharded blobs.
+	for _, br := range []blob.Ref{b.BlobRef, sb.Ref} {
+		if u, _ = sto.SignedURL(context.Background(), br); u != "https://cdn.example.com/"+sb.Ref.Path {
+			t.Errorf("CDN SignedURL of %s is %s, want https://cdn.example.com/%s", br, u, sb.Ref.Path)
+		}
+	}
+
+	sto.redirect = ""
+
+	if _, err = sto.SignedURL(context.Background(), b.BlobRef); err != blobserver.ErrNoSignedURL {
+		t.Errorf("SignedURL without redirect: got %v, want ErrNoSignedURL", err)
+	}
+
+	_, err = newProxyStorage(p, &config.SwiftConfig{Container: "blobserver-test", Redirect: redirectTempURL})
+	if err == nil {
+		t.Error("redirect tempurl without temp_url_key accepted")
+	}
+}
+
+func TestSwiftCheckInit(t *testing.T) {
+	sto, p := newLocalStorage(t, &config.SwiftConfig{
+		Container: "blobserver-test",
+		Shard:     true,
+		CheckInit: true,
+	})
+	defer p.close()
+
+	var names []string
+	err := sto.pool.do(context.Background(), func(c *poolConn) (err error) {
+		names, err = c.ContainerNamesAll(nil)
+		return
+	})
+	if err != nil {
+		t.Fatalf("ContainerNamesAll: %v", err)
+	}
+
+	conts := sto.shards.containers("blobserver-test")
+
+	// the base container holds the shard marker.
+	if len(names) != len(conts)+1 {
+		t.Fatalf("got %d containers, want %d", len(names), len(conts)+1)
+	}
+
+	for _, name := range conts {
+		acl, err := containerACL(sto, name)
+		if err != nil {
+			t.Fatalf("container %s: %v", name, err)
+		}
+		if acl != sto.containerReadACL {
+			t.Fatalf("container %s read ACL is %q, want %q", name, acl, sto.containerReadACL)
+		}
+	}
+
+	// checkInit restores a changed ACL
+	name := conts[0]
+	err = sto.pool.do(context.Background(), func(c *poolConn) error {
+		return c.ContainerUpdate(name, swift.Headers{"X-Container-Read": ".r:other"})
+	})
+	if err != nil {
+		t.Fatalf("ContainerUpdate: %v", err)
+	}
+	if err := sto.checkInit(); err != nil {
+		t.Fatalf("checkInit: %v", err)
+	}
+	if acl, _ := containerACL(sto, name); acl != sto.containerReadACL {
+		t.Fatalf("container %s read ACL is %q after checkInit, want %q", name, acl, sto.containerReadACL)
+	}
+}
+
+func TestSwiftAuth(t *testing.T) {
+	p := newSwiftProxy(t)
+	defer p.close()
+
+	user, key := swifttest.TEST_ACCOUNT, swifttest.TEST_ACCOUNT
+	public, internal := p.storageURL(p.proxy.URL), p.storageURL(p.internal.URL)
+	v2, v3 := p.proxy.URL+"/v2.0", p.proxy.URL+"/v3"
+
+	tests := []struct {
+		name       string
+		conf       config.SwiftConfig
+		storageURL string // empty if newFromConfig fails
+	}{
+		{"v1", config.SwiftConfig{AuthURL: p.authURL(), APIUser: user, APIKey: key}, public},
+		{"v2 tenant id", config.SwiftConfig{AuthURL: v2, APIUser: user, APIKey: key, TenantID: testProjectID}, public},
+		{"v2 tenant", config.SwiftConfig{AuthURL: v2, APIUser: user, APIKey: key, Tenant: testProject, EndpointType: "internal"}, internal},
+		{"v2 wrong tenant", config.SwiftConfig{AuthURL: v2, APIUser: user, APIKey: key, TenantID: "other"}, ""},
+		{"v3 project id", config.SwiftConfig{AuthURL: v3, APIUser: user, APIKey: key, Domain: "Default", TenantID: testProjectID}, public},
+		{"v3 project", config.SwiftConfig{AuthURL: v3, APIUser: user, APIKey: key, DomainID: "default", Tenant: testProject}, public},
+		{"v3 project domain", config.SwiftConfig{AuthURL: v3, APIUser: user, APIKey: key, Domain: "Default", Tenant: testProject, ProjectDomainID: "default"}, public},
+		{"v3 internal", config.SwiftConfig{AuthURL: v3, APIUser: user, APIKey: key, Domain: "Default", TenantID: testProjectID, EndpointType: "internal"}, internal},
+		{"v3 region", config.SwiftConfig{AuthURL: v3, APIUser: user, APIKey: key, Domain: "Default", TenantID: testProjectID, Region: "RegionTwo"}, "http://region-two.invalid/v1"},
+		{"v3 auth version", config.SwiftConfig{AuthURL: p.proxy.URL + "/identity", AuthVersion: 3, APIUser: user, APIKey: key, Domain: "Default", TenantID: testProjectID}, public},
+		{"v3 app cred id", config.SwiftConfig{AuthURL: v3, ApplicationCredentialID: testAppCredID, ApplicationCredentialSecret: testAppCredSecret}, public},
+		{"v3 app cred name", config.SwiftConfig{AuthURL: v3, APIUser: user, Domain: "Default", ApplicationCredentialName: testAppCredName, ApplicationCredentialSecret: testAppCredSecret}, public},
+		{"v3 wrong password", config.SwiftConfig{AuthURL: v3, APIUser: user, APIKey: "wrong", Domain: "Default", TenantID: testProjectID}, ""},
+		{"v3 wrong domain", config.SwiftConfig{AuthURL: v3, APIUser: user, APIKey: key, Domain: "Other", TenantID: testProjectID}, ""},
+		{"v3 unscoped", config.SwiftConfig{AuthURL: v3, APIUser: user, APIKey: key, Domain: "Default"}, ""},
+		{"v3 wrong app cred", config.SwiftConfig{AuthURL: v3, ApplicationCredentialID: testAppCredID, ApplicationCredentialSecret: "wrong"}, ""},
+		{"no auth version", config.SwiftConfig{AuthURL: p.proxy.URL + "/identity", APIUser: user, APIKey: key}, ""},
+		{"bad auth version", config.SwiftConfig{AuthURL: v3, AuthVersion: 4, APIUser: user, APIKey: key}, ""},
+		{"bad endpoint type", config.SwiftConfig{AuthURL: v3, APIUser: user, APIKey: key, TenantID: testProjectID, EndpointType: "admin"}, ""},
+		{"v2 app cred", config.SwiftConfig{AuthURL: v2, ApplicationCredentialID: testAppCredID, ApplicationCredentialSecret: testAppCredSecret}, ""},
+		{"app cred without secret", config.SwiftConfig{AuthURL: v3, ApplicationCredentialID: testAppCredID}, ""},
+		{"app cred name without user", config.SwiftConfig{AuthURL: v3, ApplicationCredentialName: testAppCredName, ApplicationCredentialSecret: testAppCredSecret}, ""},
+	}
+
+	for _, tt := range tests {
+		conf := tt.conf
+		conf.Container = "blobserver-test"
+		sto, err := newFromConfig(&config.Config{Swift: &conf})
+
+		if tt.storageURL == "" {
+			if err == nil {
+				t.Errorf("%s: newFromConfig succeeded, want error", tt.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: newFromConfig error: %v", tt.name, err)
+			continue
+		}
+
+		sw := sto.(*swiftStorage)
+		var storageURL string
+		sw.pool.do(context.Background(), func(c *poolConn) error {
+			storageURL = c.StorageUrl
+			return nil
+		})
+
+		if storageURL != tt.storageURL {
+			t.Errorf("%s: got storage URL %s, want %s", tt.name, storageURL, tt.storageURL)
+			continue
+		}
+
+		if !strings.Contains(storageURL, ".invalid") {
+			if err := roundTrip(sto, 0); err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+		}
+	}
+}
+
+func TestSwiftProvision(t *testing.T) {
+	sto, p := newLocalStorage(t, &config.SwiftConfig{
+		Container:  "blobserver-test",
+		Shard:      true,
+		ShardCount: 16,
+		MaxConns:   4,
+	})
+	defer p.close()
+
+	conf := &config.SwiftConfig{
+		APIUser:    swifttest.TEST_ACCOUNT,
+		APIKey:     swifttest.TEST_ACCOUNT,
+		AuthURL:    p.authURL(),
+		Container:  "blobserver-test",
+		Shard:      true,
+		ShardCount: 16,
+	}
+	conts := sto.containers()
+
+	stats, err := Provision(context.Background(), conf)
+	if err != nil {
+		t.Fatalf("Provision: %v", err)
+	}
+	if stats != (ProvisionStats{Created: 16}) {
+		t.Errorf("first run: got %+v", stats)
+	}
+
+	stats, err = Provision(context.Background(), conf)
+	if err != nil {
+		t.Fatalf("Provision: %v", err)
+	}
+	if stats != (ProvisionStats{OK: 16}) {
+		t.Errorf("second run: got %+v", stats)
+	}
+
+	// a changed ACL and a missing container are repaired.
+	err = sto.pool.do(context.Background(), func(c *poolConn) error {
+		if err := c.ContainerUpdate(conts[0], swift.Headers{"X-Container-Read": ".r:other"}); err != nil {
+			return err
+		}
+		return c.ContainerDelete(conts[1])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err = Provision(context.Background(), conf)
+	if err != nil {
+		t.Fatalf("Provision: %v", err)
+	}
+	if stats != (ProvisionStats{Created: 1, Repaired: 1, OK: 14}) {
+		t.Errorf("repair: got %+v", stats)
+	}
+
+	// the other containers are provisioned when some fail.
+	p.fail(conts[2])
+	p.fail(conts[3])
+
+	stats, err = Provision(context.Background(), conf)
+	if perr, ok := err.(*ProvisionError); !ok || len(perr.Errs) != 2 {
+		t.Errorf("got error %v, want 2 failed containers", err)
+	}
+	if stats != (ProvisionStats{OK: 14}) {
+		t.Errorf("failing containers: got %+v", stats)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := sto.provision(ctx, conts); err != context.Canceled {
+		t.Errorf("canceled: got error %v", err)
+	}
+}
+
+// fetchAll fetches the blobs refs from sto.
+func fetchAll(sto blobserver.Storage, refs []blob.Ref) error {
+	for _, br := range refs {
+		rc, _, err := sto.Fetch(br)
+
+		if err != nil {
+			return fmt.Errorf("fetch %s: %v", br, err)
+		}
+
+		rc.Close()
+	}
+
+	return nil
+}
+
+func TestSwiftReshard(t *testing.T) {
+	p := newSwiftProxy(t)
+	defer p.close()
+
+	conf := func(count int, hash string) *config.SwiftConfig {
+		return &config.SwiftConfig{
+			Container:  "blobserver-test",
+			Shard:      true,
+			ShardCount: count,
+			ShardHash:  hash,
+		}
+	}
+
+	oldConf, newConf := conf(16, "md5"), conf(8, "fnv")
+	old, err := newProxyStorage(p, oldConf)
+	if err != nil {
+		t.Fatalf("newFromConfig: %v", err)
+	}
+
+	next, _ := newSharder(ShardScheme{Count: 8, Hash: "fnv"})
+
+	// blobs are looked up by name, and by the container-qualified refs
+	// issued on upload.
+	var refs, issued []blob.Ref
+	var moved int64
+	var movedRef blob.Ref
+
+	for i := 0; i < 32; i++ {
+		b := storagetest.NewBlob(fmt.Sprintf("blob-%d", i))
+		sb, err := old.ReceiveBlob(b.BlobRef, b.Reader())
+		if err != nil {
+			t.Fatalf("ReceiveBlob: %v", err)
+		}
+		refs = append(refs, b.BlobRef)
+		issued = append(issued, sb.Ref)
+
+		if old.container(b.BlobRef) != next.container("blobserver-test", b.BlobRef.String()) {
+			moved++
+			movedRef = b.BlobRef
+		}
+	}
+
+	if _, err := newProxyStorage(p, newConf); err == nil {
+		t.Fatal("started with a different shard scheme before reshard")
+	}
+
+	if _, err := Reshard(context.Background(), newConf, false, true); err == nil {
+		t.Fatal("pruned before the reshard was finished")
+	}
+
+	stats, err := Reshard(context.Background(), newConf, false, false)
+	if err != nil {
+		t.Fatalf("Reshard: %v", err)
+	}
+
+	if stats != (ReshardStats{Copied: moved}) {
+		t.Errorf("first run: got %+v, want %d copied", stats, moved)
+	}
+
+	// both schemes may be configured while resharding, and new
+	// blobs go to the configured one.
+	sto, err := newProxyStorage(p, newConf)
+	if err != nil {
+		t.Fatalf("newFromConfig with next scheme: %v", err)
+	}
+
+	b := storagetest.NewBlob("new")
+	sb, err := sto.ReceiveBlob(b.BlobRef, b.Reader())
+	if err != nil {
+		t.Fatalf("ReceiveBlob: %v", err)
+	}
+	refs = append(refs, b.BlobRef)
+	issued = append(issued, sb.Ref)
+
+	if _, err := newProxyStorage(p, conf(32, "sha1")); err == nil {
+		t.Error("started with a third shard scheme")
+	}
+
+	restarted, err := newProxyStorage(p, conf(16, "md5"))
+	if err != nil {
+		t.Fatalf("newFromConfig with previous scheme: %v", err)
+	}
+
+	for _, s := range []*swiftStorage{restarted, sto} {
+		if err := fetchAll(s, refs); err != nil {
+			t.Fatal(err)
+		}
+		if err := fetchAll(s, issued); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats2, err := Reshard(context.Background(), newConf, true, false)
+	if err != nil {
+		t.Fatalf("Reshard finish: %v", err)
+	}
+
+	if stats2 != (ReshardStats{Present: moved}) {
+		t.Errorf("finish: got %+v, want %d present", stats2, moved)
+	}
+
+	if _, err := newProxyStorage(p, conf(16, "md5")); err == nil {
+		t.Error("started with the old shard scheme after reshard")
+	}
+
+	if _, err := Reshard(context.Background(), conf(32, "sha1"), false, false); err == nil {
+		t.Error("resharded again before the old copies were pruned")
+	}
+
+	sto, err = newProxyStorage(p, conf(8, "fnv"))
+	if err != nil {
+		t.Fatalf("newFromConfig after reshard: %v", err)
+	}
+
+	if sto.prevShards != nil || sto.oldShards == nil {
+		t.Error("storage doesn't keep the old copies after reshard")
+	}
+
+	// the old copies are kept for CDN URLs, and removed with the blob.
+	if err := fetchAll(sto, issued); err != nil {
+		t.Fatal(err)
+	}
+
+	oldRef := old.createPathRef(movedRef)
+
+	if err := sto.RemoveBlobs([]blob.Ref{movedRef}); err != nil {
+		t.Fatalf("RemoveBlobs: %v", err)
+	}
+
+	if _, _, err := old.Fetch(oldRef); err != blobserver.ErrNotFound {
+		t.Errorf("fetch old copy of removed blob: got %v, want ErrNotFound", err)
+	}
+
+	var kept []blob.Ref
+
+	for i, br := range refs {
+		if br != movedRef {
+			kept = append(kept, issued[i])
+		}
+	}
+
+	stats3, err := Reshard(context.Background(), newConf, false, true)
+	if err != nil {
+		t.Fatalf("Reshard prune: %v", err)
+	}
+
+	if stats3 != (ReshardStats{Present: moved - 1, Removed: moved - 1}) {
+		t.Errorf("prune: got %+v, want %d present and removed", stats3, moved-1)
+	}
+
+	sto, err = newProxyStorage(p, conf(8, "fnv"))
+	if err != nil {
+		t.Fatalf("newFromConfig after prune: %v", err)
+	}
+
+	if sto.prevShards != nil || sto.oldShards != nil {
+		t.Error("storage looks up blobs in the old layout after prune")
+	}
+
+	// refs issued before the reshard are found in the new layout.
+	if err := fetchAll(sto, kept); err != nil {
+		t.Fatal(err)
+	}
+
+	sto.redirect = redirectCDN
+	sto.cdnUrl = "https://cdn.example.com/"
+
+	for _, br := range kept {
+		sb, err := blobserver.StatBlob(sto, br)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if u, _ := sto.SignedURL(context.Background(), br); u != sto.cdnUrl+sb.Ref.Path {
+			t.Errorf("CDN SignedURL of %s is %s, want %s", br, u, sto.cdnUrl+sb.Ref.Path)
+		}
+	}
+}
+
+func roundTrip(sto blobserver.Storage, i int) error {
+	b := storagetest.NewBlob(fmt.Sprintf("blob-%d", i))
+	sb, err := sto.ReceiveBlob(b.BlobRef, b.Reader())
+
+	if err != nil {
+		return fmt.Errorf("receive %d: %v", i, err)
+	}
+
+	if _, err := blobserver.StatBlob(sto, sb.Ref); err != nil {
+		return fmt.Errorf("stat %d: %v", i, err)
+	}
+
+	rc, _, err := sto.Fetch(sb.Ref)
+
+	if err != nil {
+		return fmt.Errorf("fetch %d: %v", i, err)
+	}
+
+	_, err = io.Copy(ioutil.Discard, rc)
+	rc.Close()
+
+	if err != nil {
+		return fmt.Errorf("read %d: %v", i, err)
+	}
+
+	if err := sto.RemoveBlobs([]blob.Ref{sb.Ref}); err != nil {
+		return fmt.Errorf("remove %d: %v", i, err)
+	}
+
+	return nil
+}
+
+func TestSwiftConcurrentReauth(t *testing.T) {
+	const maxConns = 4
+	sto, p := newLocalStorage(t, &config.SwiftConfig{
+		Container: "blobserver-test",
+		MaxConns:  maxConns,
+	})
+	defer p.close()
+
+	n := 64
+	if testing.Short() {
+		n = 16
+	}
+
+	done := make(chan struct{})
+	expiries := make(chan int)
+
+	go func() {
+		cnt := 0
+		for {
+			select {
+			case <-done:
+				expiries <- cnt
+				return
+			case <-time.After(50 * time.Millisecond):
+				p.expire()
+				cnt++
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errc := make(chan error, n)
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errc <- roundTrip(sto, i)
+		}(i)
+	}
+
+	wg.Wait()
+	close(done)
+	close(errc)
+
+	for err := range errc {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// each connection authenticates at most once per expiry, the
+	// others pick up the new token from the pool.
+	max := 1 + <-expiries*maxConns
+	if got := p.authCount(); got > max {
+		t.Errorf("authenticated %d times, want at most %d", got, max)
+	}
+}
+
+func TestSwiftHealth(t *testing.T) {
+	sto, p := newLocalStorage(t, &config.SwiftConfig{})
+	defer p.close()
+	ctx := context.Background()
+
+	if err := sto.CheckHealth(ctx); err != nil {
+		t.Fatalf("CheckHealth: %v", err)
+	}
+
+	// an expired token is renewed.
+	auths := p.authCount()
+	p.expire()
+
+	if err := sto.CheckHealth(ctx); err != nil {
+		t.Fatalf("CheckHealth after token expiry: %v", err)
+	}
+
+	if p.authCount() != auths+1 {
+		t.Errorf("got %d auths, want %d", p.authCount(), auths+1)
+	}
+
+	p.mu.Lock()
+	p.failing["/v1/AUTH_"+swifttest.TEST_ACCOUNT] = true
+	p.mu.Unlock()
+
+	if err := sto.CheckHealth(ctx); err == nil {
+		t.Errorf("CheckHealth of unavailable account: expected error")
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	if err := sto.CheckHealth(cctx); err != context.Canceled {
+		t.Errorf("CheckHealth with done context: got %v, want %v", err, context.Canceled)
+	}
+}